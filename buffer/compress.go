@@ -0,0 +1,143 @@
+package buffer
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"io/ioutil"
+)
+
+/*
+*************************************************************
+
+	STRUCT DEFINITION
+
+*************************************************************
+*/
+
+/*
+compressor gathers records into batches compressed with flate before they enter the buffer,
+and hands out the records of the batches read back. A batch is stored as a single record:
+
+	count   4 bytes little endian, number of records in the batch
+	data    the records behind their headers, compressed with flate
+*/
+type compressor struct {
+	batch   int           // number of records per batch
+	fw      *flate.Writer // reused across batches
+	zbuf    bytes.Buffer  // output of fw
+	pending [][]byte      // records waiting for their batch to be complete, oldest first
+	tag     byte          // tag of the pending batch, see add
+	out     [][]byte      // records of the batch being read, oldest first
+
+	raw        int64 // bytes of records before compression
+	compressed int64 // bytes of compressed batches
+}
+
+/*
+*************************************************************
+
+	COMPRESSOR
+
+*************************************************************
+*/
+
+// Returns a compressor of batch records per batch, at a given flate compression level.
+func newCompressor(level int, batch int) (*compressor, error) {
+	c := &compressor{batch: batch}
+	fw, err := flate.NewWriter(&c.zbuf, level)
+	if err != nil {
+		return nil, err
+	}
+	c.fw = fw
+	return c, nil
+}
+
+/*
+Adds a copy of p, of a given tag, to the pending batch. Returns the encoded batch and its tag once it is complete,
+nil otherwise. A batch is as severe as its most severe record, a record of unknown level making it LevelNone,
+and has a category only if all its records have the same.
+*/
+func (c *compressor) add(p []byte, tag byte) ([]byte, byte) {
+	if len(c.pending) == 0 {
+		c.tag = tag
+	} else {
+		level, category := tagLevel(c.tag), tagCategory(c.tag)
+		if tagLevel(tag) < level {
+			level = tagLevel(tag)
+		}
+		if tagCategory(tag) != category {
+			category = 0
+		}
+		c.tag = recordTag(level, category)
+	}
+
+	c.pending = append(c.pending, append([]byte(nil), p...))
+	if len(c.pending) < c.batch {
+		return nil, 0
+	}
+	return c.encode(), c.tag
+}
+
+// Encodes and clears the pending records.
+func (c *compressor) encode() []byte {
+	c.zbuf.Reset()
+	c.fw.Reset(&c.zbuf)
+	for _, p := range c.pending {
+		_, _ = c.fw.Write(recordHeader(len(p), 0))
+		_, _ = c.fw.Write(p)
+		c.raw += int64(RecordHeaderSize + len(p))
+	}
+	_ = c.fw.Close()
+
+	data := make([]byte, 4+c.zbuf.Len())
+	binary.LittleEndian.PutUint32(data, uint32(len(c.pending)))
+	copy(data[4:], c.zbuf.Bytes())
+	c.compressed += int64(len(data))
+
+	c.pending = nil
+	return data
+}
+
+// Returns the records of an encoded batch, oldest first, or ErrBadRecord if data is not one.
+func decodeBatch(data []byte) ([][]byte, error) {
+	count, err := batchCount(data)
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := ioutil.ReadAll(flate.NewReader(bytes.NewReader(data[4:])))
+	if err != nil {
+		return nil, ErrBadRecord
+	}
+
+	records := make([][]byte, 0, count)
+	for len(raw) > 0 {
+		p, size, err := parseRecord(raw)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, p)
+		raw = raw[size:]
+	}
+	if len(records) != count {
+		return nil, ErrBadRecord
+	}
+	return records, nil
+}
+
+// Returns the number of records of an encoded batch.
+func batchCount(data []byte) (int, error) {
+	if len(data) < 4 {
+		return 0, ErrBadRecord
+	}
+	return int(binary.LittleEndian.Uint32(data)), nil
+}
+
+// Drops the pending records and the records being read, and clears the counters.
+func (c *compressor) reset() {
+	c.pending = nil
+	c.out = nil
+	c.raw = 0
+	c.compressed = 0
+}
@@ -0,0 +1,51 @@
+package buffer
+
+import "io"
+
+/*
+*************************************************************
+
+	INTERFACE DEFINITION
+
+*************************************************************
+*/
+
+// LogBuffer is the storage logs are parked in until they get flushed.
+// Implementations are safe for concurrent writers and a single drainer, and overwrite the oldest data at maximum size.
+type LogBuffer interface {
+	io.Reader
+	io.Writer
+	io.Closer
+
+	// Writes all slices of ps back to back as a single unit.
+	WriteBatch(ps ...[]byte) (n int, err error)
+	// Runs fn so that everything read through r is consumed as a single unit.
+	ReadBatch(fn func(r io.Reader) error) error
+
+	// Writes p as a single record, its header followed by p.
+	WriteRecord(p []byte) error
+	// Writes p as a single record of a given level.
+	WriteRecordLevel(p []byte, level Level) error
+	// Writes p as a single record of a given level and category.
+	WriteRecordCategory(p []byte, level Level, category string) error
+	// Reads the oldest record and returns its payload, or ErrIsEmpty if there is none.
+	// ErrBadRecord means malformed data was dropped, the next call reads on. Any other error consumes nothing.
+	ReadRecord() ([]byte, error)
+	// Returns the payload of the oldest record without consuming it.
+	PeekRecord() ([]byte, error)
+	// Drops the oldest records as long as drop returns true for their payload, and returns how many.
+	DropRecords(drop func(p []byte) bool) int
+	// Returns the number of records available to read.
+	RecordCount() int
+
+	Length() int
+	Capacity() int
+	IsEmpty() bool
+	IsFull() bool
+	Reset()
+}
+
+var (
+	_ LogBuffer = (*RingBuffer)(nil)
+	_ LogBuffer = (*MPSCBuffer)(nil)
+)
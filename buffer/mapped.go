@@ -0,0 +1,229 @@
+package buffer
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+)
+
+/*
+*************************************************************
+
+	CONSTANT
+
+*************************************************************
+*/
+
+/*
+Header at the beginning of a memory-mapped buffer file, followed by the blocks of the buffer:
+
+	magic   8 bytes  mappedMagic
+	version 4 bytes  mappedVersion
+	size    4 bytes  size of the buffer
+	r       8 bytes  logical read pointer
+	w       8 bytes  logical write pointer
+	empty   1 byte   1 if the buffer is empty
+	idLen   1 byte   length of the run ID
+	runID   30 bytes ID of the run writing the buffer
+
+All integers are little endian.
+*/
+const (
+	mappedMagic      = "S1RBMMAP"
+	mappedVersion    = 1
+	mappedHeaderSize = 64
+	MaxRunIDLength   = 30
+)
+
+/*
+*************************************************************
+
+	VARIABLE
+
+*************************************************************
+*/
+
+var (
+	ErrNotSupported = errors.New("memory-mapped buffer is not supported on this platform")
+	ErrLocked       = errors.New("memory-mapped buffer file is used by another buffer")
+)
+
+/*
+*************************************************************
+
+	STRUCT DEFINITION
+
+*************************************************************
+*/
+
+// Recovered holds the records a previous run left unread in a memory-mapped buffer.
+type Recovered struct {
+	RunID   string   // ID of the previous run
+	Records [][]byte // payloads of the records, oldest first
+	Skipped int      // number of malformed bytes skipped, e.g. a record torn by the crash
+}
+
+// mapping is a memory-mapped file holding a header followed by the blocks of a buffer.
+type mapping struct {
+	f    *os.File
+	data []byte
+}
+
+/*
+*************************************************************
+
+	MAIN API
+
+*************************************************************
+*/
+
+/*
+Returns a ringbuffer of a fixed size whose blocks live in the memory-mapped file at path, tagged with runID.
+Records are written in the checksummed framing, and the pointers are stored in the file after every operation,
+so buffered records survive a crash of the process, such as an OOM kill or SIGKILL, though not a crash of the machine.
+If the file holds records a previous run did not read, they are returned, and the buffer starts empty anyway.
+The file is locked while the buffer is open, returns ErrLocked if another buffer, of this process or another, has it open.
+Note: Only supported on Linux, see ErrNotSupported, the file system is left untouched elsewhere.
+Close releases the mapping and the lock, the file is kept for the next run.
+*/
+func OpenMappedRingBuffer(path string, size int, runID string) (*RingBuffer, *Recovered, error) {
+	if size <= 0 {
+		return nil, nil, fmt.Errorf("%w: size %d must be positive", ErrInvalidSize, size)
+	}
+	if !mmapSupported {
+		return nil, nil, ErrNotSupported
+	}
+	if len(runID) > MaxRunIDLength {
+		runID = runID[:MaxRunIDLength]
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, nil, err
+	}
+	// the records of a live buffer are not to be recovered, nor its blocks shared
+	if err := lockFile(f); err != nil {
+		f.Close()
+		if errors.Is(err, ErrLocked) {
+			return nil, nil, fmt.Errorf("%w: %s", ErrLocked, path)
+		}
+		return nil, nil, err
+	}
+
+	recovered, err := recoverMapped(f)
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+
+	rb, _ := (&RingBuffer{}).Init(size, size, 0) // size is positive
+	rb.SetFraming(FramingChecksum)
+	length := mappedHeaderSize + rb.size
+	if err := f.Truncate(int64(length)); err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	data, err := mmap(f, length)
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+
+	// the blocks are consecutive slices of the mapping, a buffer of fixed size never reorders them
+	for i := range rb.blocks {
+		off := mappedHeaderSize + i*rb.blockSize
+		rb.blocks[i] = data[off : off+rb.blockSize : off+rb.blockSize]
+	}
+
+	m := &mapping{f: f, data: data}
+	copy(data, mappedMagic)
+	binary.LittleEndian.PutUint32(data[8:12], mappedVersion)
+	binary.LittleEndian.PutUint32(data[12:16], uint32(rb.size))
+	data[33] = byte(len(runID))
+	copy(data[34:mappedHeaderSize], runID)
+	m.store(rb)
+
+	rb.mapping = m
+	return rb, recovered, nil
+}
+
+// Reads the records left unread in the buffer file f, if it is one. Returns nil if there is nothing to recover.
+func recoverMapped(f *os.File) (*Recovered, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() < mappedHeaderSize {
+		return nil, nil
+	}
+
+	data, err := mmap(f, int(info.Size()))
+	if err != nil {
+		return nil, err
+	}
+	defer munmap(data)
+
+	if string(data[:8]) != mappedMagic || binary.LittleEndian.Uint32(data[8:12]) != mappedVersion {
+		return nil, nil
+	}
+	size := int(binary.LittleEndian.Uint32(data[12:16]))
+	r := int(binary.LittleEndian.Uint64(data[16:24]))
+	w := int(binary.LittleEndian.Uint64(data[24:32]))
+	idLen := int(data[33])
+	if data[32] == 1 || size <= 0 || mappedHeaderSize+size > len(data) || r >= size || w >= size || idLen > MaxRunIDLength {
+		return nil, nil
+	}
+
+	// read the records through a buffer made of the previous blocks, as a single one
+	view := &RingBuffer{
+		blocks:    [][]byte{data[mappedHeaderSize : mappedHeaderSize+size]},
+		blockSize: size,
+		initSize:  size,
+		size:      size,
+		maxSize:   size,
+		framing:   FramingChecksum,
+		r:         r,
+		vr:        r,
+		w:         w,
+	}
+
+	recovered := &Recovered{RunID: string(data[34 : 34+idLen])}
+	for {
+		p, err := view.ReadRecord()
+		if errors.Is(err, ErrBadRecord) {
+			// malformed data has been skipped, and counted
+			continue
+		}
+		if err != nil {
+			break
+		}
+		recovered.Records = append(recovered.Records, p)
+	}
+	recovered.Skipped = view.skipped
+
+	if len(recovered.Records) == 0 && recovered.Skipped == 0 {
+		return nil, nil
+	}
+	return recovered, nil
+}
+
+// Stores the pointers of rb into the header.
+func (m *mapping) store(rb *RingBuffer) {
+	binary.LittleEndian.PutUint64(m.data[16:24], uint64(rb.r))
+	binary.LittleEndian.PutUint64(m.data[24:32], uint64(rb.w))
+	if rb.isEmpty {
+		m.data[32] = 1
+	} else {
+		m.data[32] = 0
+	}
+}
+
+// Unmaps and closes the file, which releases the lock.
+func (m *mapping) close() error {
+	err := munmap(m.data)
+	if e := m.f.Close(); err == nil {
+		err = e
+	}
+	return err
+}
@@ -0,0 +1,30 @@
+//go:build linux
+// +build linux
+
+package buffer
+
+import (
+	"os"
+	"syscall"
+)
+
+const mmapSupported = true
+
+// Maps the first length bytes of f into memory, shared with the file.
+func mmap(f *os.File, length int) ([]byte, error) {
+	return syscall.Mmap(int(f.Fd()), 0, length, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+}
+
+// Unmaps data mapped by mmap.
+func munmap(data []byte) error {
+	return syscall.Munmap(data)
+}
+
+// Locks f exclusively without waiting, until it is closed or the process dies. Returns ErrLocked if it is already locked.
+func lockFile(f *os.File) error {
+	err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return ErrLocked
+	}
+	return err
+}
@@ -0,0 +1,23 @@
+//go:build !linux
+// +build !linux
+
+package buffer
+
+import "os"
+
+const mmapSupported = false
+
+// Maps the first length bytes of f into memory, shared with the file.
+func mmap(f *os.File, length int) ([]byte, error) {
+	return nil, ErrNotSupported
+}
+
+// Unmaps data mapped by mmap.
+func munmap(data []byte) error {
+	return ErrNotSupported
+}
+
+// Locks f exclusively without waiting.
+func lockFile(f *os.File) error {
+	return ErrNotSupported
+}
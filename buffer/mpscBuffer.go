@@ -0,0 +1,359 @@
+package buffer
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+	"sync/atomic"
+	"unsafe"
+)
+
+/*
+*************************************************************
+
+	STRUCT DEFINITION
+
+*************************************************************
+*/
+
+// MPSCBuffer is a lock-free multi-producer single-consumer ring of records.
+// Every Write or WriteBatch atomically reserves one slot, so records are never interleaved.
+// Producers finding the ring full, by slots or by bytes, drop the oldest records.
+type MPSCBuffer struct {
+	// the counters come first, so they are 64-bit aligned on 32-bit platforms as atomic operations require,
+	// and are padded so they stay on cache lines of their own
+	enq uint64 // enqueue position
+	_   [56]byte
+	deq uint64 // dequeue position
+	_   [56]byte
+	n   int64 // number of bytes held, including the unread part of cur
+	_   [56]byte
+
+	slots []slot // ring of records
+	mask  uint64 // len(slots) - 1
+
+	maxSize int // maximum size of buffer in bytes
+
+	cur []byte // record being read, owned by the consumer
+}
+
+/*
+slot holds one record. seq tells producers and consumers whose turn it is.
+Slots are padded to a multiple of 8 bytes, so seq is 64-bit aligned in every slot of the ring on 32-bit platforms.
+*/
+type slot struct {
+	seq  uint64
+	data []byte
+	_    [(8 - unsafe.Sizeof([]byte(nil))%8) % 8]byte
+}
+
+/*
+*************************************************************
+
+	MAIN API
+
+*************************************************************
+*/
+
+// Returns a lock-free buffer holding up to slots records and maxSize bytes. slots is rounded up to a power of two.
+func NewMPSCBuffer(slots int, maxSize int) *MPSCBuffer {
+	size := 1
+	for size < slots {
+		size <<= 1
+	}
+
+	mb := &MPSCBuffer{
+		slots:   make([]slot, size),
+		mask:    uint64(size - 1),
+		maxSize: maxSize,
+	}
+	for i := range mb.slots {
+		mb.slots[i].seq = uint64(i)
+	}
+	return mb
+}
+
+/*
+Writes p into a slot of its own.
+If the buffer is full, the oldest records are dropped until both a slot and enough bytes are available.
+Returns ErrTooLarge if p alone exceeds the maximum size.
+*/
+func (mb *MPSCBuffer) Write(p []byte) (n int, err error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	return mb.push(append([]byte(nil), p...))
+}
+
+// Writes all slices of ps into a single slot, so they are read back to back.
+func (mb *MPSCBuffer) WriteBatch(ps ...[]byte) (n int, err error) {
+	for _, p := range ps {
+		n += len(p)
+	}
+	if n == 0 {
+		return 0, nil
+	}
+
+	data := make([]byte, 0, n)
+	for _, p := range ps {
+		data = append(data, p...)
+	}
+	return mb.push(data)
+}
+
+/*
+Reads buffer content into p, continuing across records until p is full or the buffer is empty.
+Returns io.EOF if the buffer is empty.
+Note: Must only be called by the consumer.
+*/
+func (mb *MPSCBuffer) Read(p []byte) (n int, err error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	for n < len(p) {
+		if len(mb.cur) == 0 {
+			data, ok := mb.dequeue()
+			if !ok {
+				break
+			}
+			mb.cur = data
+		}
+		c := copy(p[n:], mb.cur)
+		mb.cur = mb.cur[c:]
+		n += c
+	}
+
+	if n == 0 {
+		return 0, io.EOF
+	}
+	atomic.AddInt64(&mb.n, -int64(n))
+	return n, nil
+}
+
+/*
+Runs fn with the consumer's reader.
+A record is only ever dropped by producers before the consumer starts reading it, so reading a whole record through r is a single unit.
+Note: Must only be called by the consumer.
+*/
+func (mb *MPSCBuffer) ReadBatch(fn func(r io.Reader) error) error {
+	return fn(mb)
+}
+
+// Writes p as a single record, its header followed by p, into a slot of its own.
+func (mb *MPSCBuffer) WriteRecord(p []byte) error {
+	return mb.WriteRecordLevel(p, LevelNone)
+}
+
+// Writes p as a single record of a given level. The category is not kept, quotas are not supported.
+func (mb *MPSCBuffer) WriteRecordCategory(p []byte, level Level, category string) error {
+	return mb.WriteRecordLevel(p, level)
+}
+
+/*
+Writes p as a single record of a given level. Returns ErrTooLarge if p is longer than MaxRecordSize.
+Note: The level is kept in the record, but the oldest records are dropped regardless of it.
+*/
+func (mb *MPSCBuffer) WriteRecordLevel(p []byte, level Level) error {
+	if !recordFits(len(p)) {
+		return ErrTooLarge
+	}
+
+	data := make([]byte, 0, RecordHeaderSize+len(p))
+	data = append(append(data, recordHeader(len(p), recordTag(level, 0))...), p...)
+	_, err := mb.push(data)
+	return err
+}
+
+/*
+Reads the oldest record and returns its payload.
+Returns ErrIsEmpty if there is no record, and ErrBadRecord if the oldest slot does not hold a complete record, which is then dropped.
+Note: Must only be called by the consumer.
+*/
+func (mb *MPSCBuffer) ReadRecord() ([]byte, error) {
+	p, size, err := mb.peekRecord()
+	if err == ErrBadRecord {
+		size = len(mb.cur)
+	}
+
+	mb.cur = mb.cur[size:]
+	atomic.AddInt64(&mb.n, -int64(size))
+	return p, err
+}
+
+/*
+Returns the payload of the oldest record without consuming it. Errors are the same as ReadRecord, without dropping.
+Note: Must only be called by the consumer.
+*/
+func (mb *MPSCBuffer) PeekRecord() ([]byte, error) {
+	p, _, err := mb.peekRecord()
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(nil), p...), nil
+}
+
+/*
+Drops the oldest records as long as drop returns true for their payload. Stops at the first record kept or malformed.
+Returns the number of records dropped.
+Note: Must only be called by the consumer.
+*/
+func (mb *MPSCBuffer) DropRecords(drop func(p []byte) bool) int {
+	dropped := 0
+	for {
+		p, size, err := mb.peekRecord()
+		if err != nil || !drop(p) {
+			return dropped
+		}
+		mb.cur = mb.cur[size:]
+		atomic.AddInt64(&mb.n, -int64(size))
+		dropped++
+	}
+}
+
+// Returns the number of records available to read. It is only approximate while producers are writing.
+func (mb *MPSCBuffer) RecordCount() int {
+	n := int(atomic.LoadUint64(&mb.enq) - atomic.LoadUint64(&mb.deq))
+	if len(mb.cur) > 0 {
+		n++
+	}
+	return n
+}
+
+// Moves the oldest record into cur, unless cur still holds data, and parses it.
+func (mb *MPSCBuffer) peekRecord() (p []byte, size int, err error) {
+	if len(mb.cur) == 0 {
+		data, ok := mb.dequeue()
+		if !ok {
+			return nil, 0, ErrIsEmpty
+		}
+		mb.cur = data
+	}
+	return parseRecord(mb.cur)
+}
+
+// Returns the number of bytes available to read.
+func (mb *MPSCBuffer) Length() int {
+	if n := atomic.LoadInt64(&mb.n); n > 0 {
+		return int(n)
+	}
+	return 0
+}
+
+// Returns the maximum size of buffer in bytes.
+func (mb *MPSCBuffer) Capacity() int {
+	return mb.maxSize
+}
+
+// Checks if buffer is empty
+func (mb *MPSCBuffer) IsEmpty() bool {
+	return mb.Length() == 0
+}
+
+// Checks if buffer is full
+func (mb *MPSCBuffer) IsFull() bool {
+	return mb.Length() >= mb.maxSize
+}
+
+/*
+Drops every record.
+Note: Must only be called by the consumer.
+*/
+func (mb *MPSCBuffer) Reset() {
+	atomic.AddInt64(&mb.n, -int64(len(mb.cur)))
+	mb.cur = nil
+	for mb.drop() {
+	}
+}
+
+/*
+Drops every record. There is nothing else to release.
+Note: Must only be called by the consumer.
+*/
+func (mb *MPSCBuffer) Close() error {
+	mb.Reset()
+	return nil
+}
+
+func (mb *MPSCBuffer) String() string {
+	return fmt.Sprintf("MPSC Buffer: \n\tSlots: %d\n\tCapacity: %d\n\tReadable Bytes: %d\n", len(mb.slots), mb.maxSize, mb.Length())
+}
+
+// Pushes data into a slot, dropping the oldest records while the buffer is full.
+func (mb *MPSCBuffer) push(data []byte) (n int, err error) {
+	n = len(data)
+	if n > mb.maxSize {
+		return 0, ErrTooLarge
+	}
+
+	// account for the bytes first, so the consumer never reads more than is accounted for
+	atomic.AddInt64(&mb.n, int64(n))
+
+	for !mb.enqueue(data) {
+		if !mb.drop() {
+			// slots are reserved by producers which have not published yet
+			runtime.Gosched()
+		}
+	}
+
+	for atomic.LoadInt64(&mb.n) > int64(mb.maxSize) {
+		if !mb.drop() {
+			// the remaining bytes are still being read or published
+			break
+		}
+	}
+	return n, nil
+}
+
+// Drops the oldest record. Returns false if there was nothing to drop.
+func (mb *MPSCBuffer) drop() bool {
+	data, ok := mb.dequeue()
+	if ok {
+		atomic.AddInt64(&mb.n, -int64(len(data)))
+	}
+	return ok
+}
+
+// Publishes data into the next slot. Returns false if all slots are taken.
+func (mb *MPSCBuffer) enqueue(data []byte) bool {
+	pos := atomic.LoadUint64(&mb.enq)
+	for {
+		s := &mb.slots[pos&mb.mask]
+		seq := atomic.LoadUint64(&s.seq)
+
+		switch dif := int64(seq) - int64(pos); {
+		case dif == 0:
+			if atomic.CompareAndSwapUint64(&mb.enq, pos, pos+1) {
+				s.data = data
+				atomic.StoreUint64(&s.seq, pos+1)
+				return true
+			}
+		case dif < 0:
+			return false
+		}
+		pos = atomic.LoadUint64(&mb.enq)
+	}
+}
+
+// Takes the record out of the oldest slot. Returns false if no slot is published.
+// Both the consumer and producers dropping records dequeue, hence the CAS.
+func (mb *MPSCBuffer) dequeue() ([]byte, bool) {
+	pos := atomic.LoadUint64(&mb.deq)
+	for {
+		s := &mb.slots[pos&mb.mask]
+		seq := atomic.LoadUint64(&s.seq)
+
+		switch dif := int64(seq) - int64(pos+1); {
+		case dif == 0:
+			if atomic.CompareAndSwapUint64(&mb.deq, pos, pos+1) {
+				data := s.data
+				s.data = nil
+				atomic.StoreUint64(&s.seq, pos+mb.mask+1)
+				return data, true
+			}
+		case dif < 0:
+			return nil, false
+		}
+		pos = atomic.LoadUint64(&mb.deq)
+	}
+}
@@ -0,0 +1,232 @@
+package buffer
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+/*
+*************************************************************
+
+	CONSTANT
+
+*************************************************************
+*/
+
+// OverflowPolicy tells what a buffer at maximum size does with a write it has no room for.
+type OverflowPolicy int
+
+const (
+	// OverflowDropOldest overwrites the oldest data until the write fits.
+	OverflowDropOldest OverflowPolicy = iota
+	// OverflowDropNewest drops the write, reported as successful, and keeps the buffered data.
+	OverflowDropNewest
+	// OverflowBlock waits for a reader to make room, up to a timeout, then fails the write with ErrFull.
+	OverflowBlock
+	// OverflowError fails the write with ErrFull.
+	OverflowError
+	/*
+		OverflowDropLowest evicts the least severe records first, oldest first among equals, see Level.
+		The remaining records keep their order. Data written without records is overwritten as with OverflowDropOldest.
+	*/
+	OverflowDropLowest
+)
+
+/*
+*************************************************************
+
+	VARIABLE
+
+*************************************************************
+*/
+
+var (
+	ErrFull          = errors.New("ring buffer is full")
+	ErrUnknownPolicy = errors.New("unknown overflow policy")
+
+	// returned internally by reserve when a write is dropped by OverflowDropNewest
+	errDropped = errors.New("write dropped")
+
+	overflowNames = map[OverflowPolicy]string{
+		OverflowDropOldest: "drop-oldest",
+		OverflowDropNewest: "drop-newest",
+		OverflowBlock:      "block",
+		OverflowError:      "error",
+		OverflowDropLowest: "drop-lowest",
+	}
+)
+
+/*
+*************************************************************
+
+	OVERFLOW POLICY
+
+*************************************************************
+*/
+
+// Returns the name of the policy: drop-oldest, drop-newest, block, error or drop-lowest.
+func (p OverflowPolicy) String() string {
+	if name, ok := overflowNames[p]; ok {
+		return name
+	}
+	return fmt.Sprintf("OverflowPolicy(%d)", int(p))
+}
+
+// Returns the policy of a given name, see String. Returns ErrUnknownPolicy if there is none.
+func ParseOverflowPolicy(name string) (OverflowPolicy, error) {
+	for p, n := range overflowNames {
+		if n == name {
+			return p, nil
+		}
+	}
+	return OverflowDropOldest, fmt.Errorf("%w: %q", ErrUnknownPolicy, name)
+}
+
+/*
+Returns a channel closed once a reader makes room. A writer which must not wait holding a lock of its own, one the
+reader needs, can write with OverflowError and, on ErrFull, wait on the channel without its lock before writing again.
+*/
+func (rb *RingBuffer) Freed() <-chan struct{} {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	if rb.freed == nil {
+		rb.freed = make(chan struct{})
+	}
+	return rb.freed
+}
+
+/*
+Releases the lock until a reader makes room or the deadline passes, and takes it again.
+Returns false if the deadline passed.
+*/
+func (rb *RingBuffer) waitFree(deadline time.Time) bool {
+	d := time.Until(deadline)
+	if d <= 0 {
+		return false
+	}
+
+	if rb.freed == nil {
+		rb.freed = make(chan struct{})
+	}
+	freed := rb.freed
+
+	rb.mu.Unlock()
+	defer rb.mu.Lock()
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-freed:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// Wakes up the writers waiting for room.
+func (rb *RingBuffer) signalFree() {
+	if rb.freed != nil {
+		close(rb.freed)
+		rb.freed = nil
+	}
+}
+
+/*
+Makes room for n bytes for a record of a given tag by evicting records, and moving the remaining records up to the
+write pointer, in order. Malformed data is dropped along, and counted as skipped. Records beyond the maximum of a quota
+go first, oldest first, then records in the order of the policy: oldest first, or least severe first with
+OverflowDropLowest, those below the minimum of a quota last.
+At least 1/16 of the buffer is freed at once, so the records are not walked on every write.
+Falls back to overwriting the oldest data if the records cannot be walked.
+*/
+func (rb *RingBuffer) evict(n int, tag byte) {
+	type record struct {
+		pos, size int
+		tag       byte
+		evicted   bool
+	}
+
+	var records []record
+	length, walked := rb.length(), 0
+	rb.walkRecords(func(pos int, size int) bool {
+		records = append(records, record{pos: pos, size: size, tag: rb.recordTag(pos)})
+		walked += size
+		return true
+	})
+	if walked < length && rb.framing != FramingChecksum {
+		// record boundaries are lost
+		_ = rb.overwrite(rb.free(), n, true)
+		return
+	}
+
+	want := n - rb.free()
+	if want < rb.size/16 {
+		want = rb.size / 16
+	}
+
+	// bytes held by the records of every quota, the incoming record included
+	usage := make([]int, len(rb.quotas))
+	for _, r := range records {
+		rb.addUsage(usage, r.tag, r.size)
+	}
+	rb.addUsage(usage, tag, n)
+
+	freed := length - walked
+	remove := func(i int) {
+		records[i].evicted = true
+		freed += records[i].size
+		rb.addUsage(usage, records[i].tag, -records[i].size)
+	}
+
+	for i := range records {
+		if rb.exceedsQuota(usage, records[i].tag) {
+			remove(i)
+		}
+	}
+
+	order := make([]int, len(records))
+	for i := range order {
+		order[i] = i
+	}
+	if rb.overflow == OverflowDropLowest {
+		sort.SliceStable(order, func(a, b int) bool {
+			return tagLevel(records[order[a]].tag) > tagLevel(records[order[b]].tag)
+		})
+	}
+	for _, quotas := range []bool{true, false} {
+		for _, i := range order {
+			if freed >= want {
+				break
+			}
+			if !records[i].evicted && !(quotas && rb.keptByQuota(usage, records[i].tag, records[i].size)) {
+				remove(i)
+			}
+		}
+	}
+
+	// move the remaining records up to the write pointer, newest first, so none is overwritten before it moves
+	rb.skipped += length - walked
+	pos := rb.w
+	for i := len(records) - 1; i >= 0; i-- {
+		if records[i].evicted {
+			continue
+		}
+		pos = (pos - records[i].size + rb.size) % rb.size
+		if pos != records[i].pos {
+			data := make([]byte, records[i].size)
+			rb.copyOut(data, records[i].pos)
+			rb.copyIn(pos, data)
+		}
+	}
+
+	if pos == rb.w {
+		rb.consumeAll()
+		return
+	}
+	rb.r = pos
+	rb.syncVirtual()
+}
@@ -0,0 +1,162 @@
+package buffer
+
+import (
+	"errors"
+	"fmt"
+)
+
+/*
+*************************************************************
+
+	VARIABLE
+
+*************************************************************
+*/
+
+var (
+	ErrInvalidQuota = errors.New("invalid quota")
+)
+
+/*
+*************************************************************
+
+	STRUCT DEFINITION
+
+*************************************************************
+*/
+
+/*
+Quota bounds the share of the buffer held by the records of a level, or of a category if Category is set.
+Shares are fractions of the maximum size of the buffer, e.g. 0.3 for 30%.
+*/
+type Quota struct {
+	Level    Level   // level of the records, unless Category is set
+	Category string  // category of the records
+	Min      float64 // share kept for the records: below it, they are evicted last
+	Max      float64 // share the records may take at most: beyond it, they are evicted first. 0 for no maximum
+}
+
+// QuotaUsage is the share of the buffer currently held by the records of a quota.
+type QuotaUsage struct {
+	Quota
+	Bytes int     // bytes of the records, headers included
+	Share float64 // fraction of the maximum size of the buffer
+}
+
+/*
+*************************************************************
+
+	QUOTA
+
+*************************************************************
+*/
+
+/*
+Sets the quotas eviction honors once the maximum size is reached, with OverflowDropOldest or OverflowDropLowest:
+records beyond the maximum of a quota are evicted first, oldest first, then records in the order of the policy,
+those below the minimum of a quota last. Quotas only apply when records are evicted: records may fill free room
+beyond their maximum, but yield it first once the buffer is full. See Stats for the usage of every quota.
+Returns ErrInvalidQuota if a share is not between 0 and 1, a minimum exceeds its maximum, the minimums add up
+to more than 1, a level exceeds MaxLevel, or there are more than 15 categories.
+Note: Must be set before the first record is written. Spilling does not apply with quotas.
+*/
+func (rb *RingBuffer) SetQuotas(quotas ...Quota) error {
+	var categories []string
+	min := 0.0
+	for _, q := range quotas {
+		if q.Min < 0 || q.Min > 1 || q.Max < 0 || q.Max > 1 || (q.Max > 0 && q.Min > q.Max) {
+			return fmt.Errorf("%w: shares %v and %v must be between 0 and 1, in order", ErrInvalidQuota, q.Min, q.Max)
+		}
+		if q.Level > MaxLevel {
+			return fmt.Errorf("%w: level %d exceeds %d", ErrInvalidQuota, q.Level, MaxLevel)
+		}
+		min += q.Min
+
+		if q.Category != "" && indexOf(categories, q.Category) < 0 {
+			categories = append(categories, q.Category)
+		}
+	}
+	if min > 1 {
+		return fmt.Errorf("%w: minimum shares add up to %v", ErrInvalidQuota, min)
+	}
+	if len(categories) > 15 {
+		return fmt.Errorf("%w: %d categories exceed 15", ErrInvalidQuota, len(categories))
+	}
+
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	rb.quotas = append([]Quota(nil), quotas...)
+	rb.categories = categories
+	return nil
+}
+
+// Returns the index of category in the categories of the quotas plus one, 0 if it has no quota.
+func (rb *RingBuffer) categoryIndex(category string) int {
+	if category == "" {
+		return 0
+	}
+	return indexOf(rb.categories, category) + 1
+}
+
+// Tells if a record of a given tag falls under q.
+func (rb *RingBuffer) underQuota(q Quota, tag byte) bool {
+	if q.Category != "" {
+		idx := tagCategory(tag)
+		return idx > 0 && idx <= len(rb.categories) && rb.categories[idx-1] == q.Category
+	}
+	return tagLevel(tag) == q.Level
+}
+
+// Adds size to the usage of every quota a record of a given tag falls under.
+func (rb *RingBuffer) addUsage(usage []int, tag byte, size int) {
+	for i, q := range rb.quotas {
+		if rb.underQuota(q, tag) {
+			usage[i] += size
+		}
+	}
+}
+
+// Tells if a record of a given tag falls under a quota beyond its maximum.
+func (rb *RingBuffer) exceedsQuota(usage []int, tag byte) bool {
+	for i, q := range rb.quotas {
+		if q.Max > 0 && float64(usage[i]) > q.Max*float64(rb.maxSize) && rb.underQuota(q, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// Tells if evicting a record of a given tag and size would bring a quota below its minimum.
+func (rb *RingBuffer) keptByQuota(usage []int, tag byte, size int) bool {
+	for i, q := range rb.quotas {
+		if q.Min > 0 && float64(usage[i]-size) < q.Min*float64(rb.maxSize) && rb.underQuota(q, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the current usage of every quota.
+func (rb *RingBuffer) quotaUsage() []QuotaUsage {
+	usage := make([]int, len(rb.quotas))
+	rb.walkRecords(func(pos int, size int) bool {
+		rb.addUsage(usage, rb.recordTag(pos), size)
+		return true
+	})
+
+	stats := make([]QuotaUsage, len(rb.quotas))
+	for i, q := range rb.quotas {
+		stats[i] = QuotaUsage{Quota: q, Bytes: usage[i], Share: float64(usage[i]) / float64(rb.maxSize)}
+	}
+	return stats
+}
+
+func indexOf(values []string, value string) int {
+	for i, v := range values {
+		if v == value {
+			return i
+		}
+	}
+	return -1
+}
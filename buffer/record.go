@@ -0,0 +1,195 @@
+package buffer
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+)
+
+/*
+*************************************************************
+
+	CONSTANT
+
+*************************************************************
+*/
+
+/*
+Size of the header in front of every record:
+
+	length  4 bytes little endian, length of the payload
+	tag     1 byte  level in the low 4 bits, see Level, and category in the high 4 bits, see Quota
+*/
+const RecordHeaderSize = 5
+
+// Largest payload of a record, its length being stored in 4 bytes.
+const MaxRecordSize = 1<<32 - 1
+
+/*
+Checksummed record header, see FramingChecksum:
+
+	magic   1 byte  RecordMagic
+	version 1 byte  RecordVersion
+	tag     1 byte  as in the header of FramingLength
+	length  4 bytes little endian, length of the payload
+	crc32   4 bytes little endian, IEEE checksum of version, tag, length and payload
+
+Records of version 1 have no tag, their header being 10 bytes long, and are still read, as records of LevelNone.
+*/
+const (
+	RecordMagic        byte = 0xA5
+	RecordVersion      byte = 2
+	ChecksumHeaderSize      = 11
+
+	checksumHeaderSizeV1 = 10
+)
+
+// Framing tells how records are delimited in a buffer.
+type Framing int
+
+const (
+	// FramingLength prefixes every record with the length of its payload.
+	FramingLength Framing = iota
+	// FramingChecksum prefixes every record with a checksummed header, so corrupted data can be detected and skipped.
+	FramingChecksum
+)
+
+/*
+Level is the severity of a record, kept in its header so eviction can prefer the least severe records
+without parsing them. The greater the level, the less severe: logrus levels plus one fit, e.g. 4 for warn
+and 7 for trace.
+*/
+type Level uint8
+
+const (
+	// LevelNone marks a record of unknown severity, evicted last.
+	LevelNone Level = 0
+	// MaxLevel is the greatest level a record header can hold, greater levels are stored as MaxLevel.
+	MaxLevel Level = 15
+)
+
+/*
+*************************************************************
+
+	VARIABLE
+
+*************************************************************
+*/
+
+var (
+	ErrBadRecord = errors.New("malformed record")
+)
+
+/*
+*************************************************************
+
+	FRAMING
+
+*************************************************************
+*/
+
+// Returns the tag of a record of a given level, in the category of a given index, 0 for none.
+func recordTag(level Level, category int) byte {
+	if level > MaxLevel {
+		level = MaxLevel
+	}
+	return byte(level) | byte(category)<<4
+}
+
+// Returns the level of a record of a given tag.
+func tagLevel(tag byte) Level {
+	return Level(tag & 0x0F)
+}
+
+// Returns the index of the category of a record of a given tag, 0 for none.
+func tagCategory(tag byte) int {
+	return int(tag >> 4)
+}
+
+// Returns the header of a record of a given tag whose payload is n bytes long.
+func recordHeader(n int, tag byte) []byte {
+	h := make([]byte, RecordHeaderSize)
+	binary.LittleEndian.PutUint32(h, uint32(n))
+	h[4] = tag
+	return h
+}
+
+// Tells if a payload n bytes long fits in a record.
+func recordFits(n int) bool {
+	return uint64(n) <= MaxRecordSize
+}
+
+// Returns the offset of the tag in the header of a record.
+func (f Framing) tagOffset() int {
+	if f == FramingChecksum {
+		return 2
+	}
+	return 4
+}
+
+// Returns the header of a record of a given tag holding payload p.
+func (f Framing) header(p []byte, tag byte) []byte {
+	if f != FramingChecksum {
+		return recordHeader(len(p), tag)
+	}
+
+	h := make([]byte, ChecksumHeaderSize)
+	h[0] = RecordMagic
+	h[1] = RecordVersion
+	h[2] = tag
+	binary.LittleEndian.PutUint32(h[3:7], uint32(len(p)))
+	binary.LittleEndian.PutUint32(h[7:11], crc32.Update(headerChecksum(h), crc32.IEEETable, p))
+	return h
+}
+
+// Returns the size of a checksummed header of a given version, 0 if the version is unknown.
+func checksumHeaderSize(version byte) int {
+	switch version {
+	case 1:
+		return checksumHeaderSizeV1
+	case RecordVersion:
+		return ChecksumHeaderSize
+	}
+	return 0
+}
+
+/*
+Returns the payload length and checksum a checksummed header holds, or ErrBadRecord if h is not one.
+h must hold the whole header, as long as its version tells.
+*/
+func parseChecksumHeader(h []byte) (l int, crc uint32, err error) {
+	if len(h) < 2 || h[0] != RecordMagic || checksumHeaderSize(h[1]) != len(h) {
+		return 0, 0, ErrBadRecord
+	}
+	n := len(h)
+	l = payloadLength(h[n-8 : n-4])
+	if l < 0 {
+		return 0, 0, ErrBadRecord
+	}
+	return l, binary.LittleEndian.Uint32(h[n-4:]), nil
+}
+
+// Returns the checksum of a checksummed header but its magic and checksum, to be updated with the payload.
+func headerChecksum(h []byte) uint32 {
+	return crc32.ChecksumIEEE(h[1 : len(h)-4])
+}
+
+// Returns the payload length a record header holds.
+func payloadLength(h []byte) int {
+	return int(binary.LittleEndian.Uint32(h))
+}
+
+/*
+Returns the payload of the record at the beginning of data and the size of the whole record.
+Returns ErrBadRecord if data does not hold a complete record.
+*/
+func parseRecord(data []byte) (p []byte, size int, err error) {
+	if len(data) < RecordHeaderSize {
+		return nil, 0, ErrBadRecord
+	}
+	l := payloadLength(data)
+	if l < 0 || l > len(data)-RecordHeaderSize {
+		return nil, 0, ErrBadRecord
+	}
+	return data[RecordHeaderSize : RecordHeaderSize+l : RecordHeaderSize+l], RecordHeaderSize + l, nil
+}
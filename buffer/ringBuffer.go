@@ -1,13 +1,25 @@
 package buffer
 
 import (
-	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash/crc32"
+	"io"
 	"sync"
-	"unsafe"
+	"time"
 )
 
+/*
+*************************************************************
+
+	CONSTANT
+
+*************************************************************
+*/
+
+// Size of the memory blocks a buffer is made of, unless its default size is smaller.
+const DefaultBlockSize = 4096
+
 /*
 *************************************************************
 
@@ -17,9 +29,12 @@ import (
 */
 
 var (
-	ErrIsEmpty = errors.New("ring buffer is empty")
-
-	once sync.Once // implement singleton
+	ErrIsEmpty            = errors.New("ring buffer is empty")
+	ErrInvalidSize        = errors.New("invalid buffer size")
+	ErrInvalidCoefficient = errors.New("invalid extension coefficient")
+	ErrTooLarge           = errors.New("data exceeds the maximum size of buffer")
+	ErrNegativeCount      = errors.New("negative count")
+	ErrInvalidUnreadByte  = errors.New("invalid use of UnreadByte")
 )
 
 /*
@@ -30,9 +45,12 @@ var (
 *************************************************************
 */
 
-// RingBuffer
+// RingBuffer is safe for concurrent writers and a single drainer.
 type RingBuffer struct {
-	buf []byte // buffer
+	mu sync.Mutex // guards everything below
+
+	blocks    [][]byte // fixed size memory blocks, in logical order
+	blockSize int      // size of every block
 
 	initSize int // initial size of buffer
 	size     int // dynamic size of buffer
@@ -44,6 +62,56 @@ type RingBuffer struct {
 	w  int // logical write pointer
 
 	isEmpty bool
+	vempty  bool // the virtual read pointer caught up with the write pointer
+	readSeq int  // incremented whenever records are consumed or a transaction begins, see ReadTx
+	unread  bool // the last operation was a ReadByte, which UnreadByte can undo
+
+	framing Framing  // how records are delimited
+	skipped int      // number of malformed bytes skipped by record reads
+	spill   *spill   // keeps overwritten records on disk, nil if disabled
+	mapping *mapping // memory-mapped file backing the blocks, nil if in memory
+
+	compress *compressor // compresses records in batches, nil if disabled
+
+	overflow        OverflowPolicy // what to do with a write there is no room for at maximum size
+	overflowTimeout time.Duration  // maximum time to wait for room with OverflowBlock
+	freed           chan struct{}  // closed when a reader makes room, nil if no writer waits
+	dropped         int            // number of writes dropped or failed for lack of room
+
+	quotas     []Quota  // shares of the buffer bounded by level or category
+	categories []string // categories of the quotas, a record stores the index of its category plus one
+
+	shrink    ShrinkPolicy // policy to shrink back to the initial size after a burst
+	lowSince  time.Time    // when the buffer went below the low-water mark, zero if above
+	lowWrites int          // number of writes since the buffer went below the low-water mark
+}
+
+/*
+ShrinkPolicy shrinks a grown buffer back to its initial size once it has been drained and stayed
+at or below LowWater bytes for After, or for Writes writes, whichever comes first.
+A zero After or Writes disables the respective trigger.
+*/
+type ShrinkPolicy struct {
+	LowWater int           // low-water mark in bytes
+	After    time.Duration // time to stay below the low-water mark
+	Writes   int           // number of writes to stay below the low-water mark
+}
+
+// Stats is a snapshot of the state of a ringbuffer.
+type Stats struct {
+	Records      int // records available to read, see RecordCount
+	Length       int // bytes in memory
+	Capacity     int // current size of the buffer
+	MaxSize      int // maximum size of the buffer
+	SkippedBytes int // malformed bytes skipped, see SkippedBytes
+	Spilled      int // records spilled to disk and not read yet
+	SpillDropped int // spilled records dropped
+	Dropped      int // writes dropped or failed by the overflow policy
+
+	Quotas []QuotaUsage // usage of every quota, see SetQuotas
+
+	RawBytes        int64 // bytes of records before compression
+	CompressedBytes int64 // bytes of compressed batches
 }
 
 /*
@@ -54,19 +122,219 @@ type RingBuffer struct {
 *************************************************************
 */
 
-// Returns a ringbuffer initialized with a given default size, maximum size and extension coefficient.
-func (rb *RingBuffer) Init(defaultSize int, maxSize int, extCoef int) *RingBuffer {
-	once.Do(func() {
-		rb.buf = make([]byte, defaultSize)
-		rb.initSize = defaultSize
-		rb.size = defaultSize
-		rb.maxSize = maxSize
-		rb.extCoef = extCoef
-		rb.isEmpty = true
-		rb.r = 0
-		rb.w = 0
-		rb.vr = 0
-	})
+/*
+Returns a new ringbuffer with a given default size, maximum size and extension coefficient.
+Every buffer is independent of the others.
+Returns ErrInvalidSize if the default size is not positive or the maximum size is smaller than it,
+and ErrInvalidCoefficient if the extension coefficient is negative.
+*/
+func NewRingBuffer(defaultSize int, maxSize int, extCoef int) (*RingBuffer, error) {
+	return (&RingBuffer{}).Init(defaultSize, maxSize, extCoef)
+}
+
+/*
+Initializes the ringbuffer with a given default size, maximum size and extension coefficient, dropping any data.
+Returns the same errors as NewRingBuffer, leaving the buffer untouched.
+*/
+func (rb *RingBuffer) Init(defaultSize int, maxSize int, extCoef int) (*RingBuffer, error) {
+	if defaultSize <= 0 {
+		return nil, fmt.Errorf("%w: default size %d must be positive", ErrInvalidSize, defaultSize)
+	}
+	if maxSize < defaultSize {
+		return nil, fmt.Errorf("%w: maximum size %d is smaller than default size %d", ErrInvalidSize, maxSize, defaultSize)
+	}
+	if extCoef < 0 {
+		return nil, fmt.Errorf("%w: %d must not be negative", ErrInvalidCoefficient, extCoef)
+	}
+
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	rb.blockSize = DefaultBlockSize
+	if defaultSize < rb.blockSize {
+		rb.blockSize = defaultSize
+	}
+	rb.blocks = newBlocks((defaultSize+rb.blockSize-1)/rb.blockSize, rb.blockSize)
+	rb.initSize = len(rb.blocks) * rb.blockSize
+	rb.size = rb.initSize
+	rb.maxSize = maxSize
+	rb.extCoef = extCoef
+	rb.isEmpty = true
+	rb.unread = false
+	rb.r = 0
+	rb.w = 0
+	rb.syncVirtual()
+	rb.lowSince = time.Time{}
+	rb.lowWrites = 0
+	return rb, nil
+}
+
+/*
+Sets how records are delimited. With FramingChecksum, corrupted records are detected and skipped,
+and reading resumes at the next valid record.
+Note: Must be set before the first record is written.
+*/
+func (rb *RingBuffer) SetFraming(framing Framing) *RingBuffer {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	rb.framing = framing
+	return rb
+}
+
+// Returns the number of malformed bytes skipped while reading or overwriting records.
+func (rb *RingBuffer) SkippedBytes() int {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	return rb.skipped
+}
+
+/*
+Enables spilling: once the maximum size is reached, overwritten records are kept in temporary files
+inside dir instead of being dropped, up to maxSize bytes on disk. Beyond that, the oldest spilled records are dropped.
+Spilled records are read back by the record API before the records in memory, so order is kept.
+Note: Byte reads only return the data in memory. Call Close to remove the temporary files.
+*/
+func (rb *RingBuffer) SetSpill(dir string, maxSize int) error {
+	s, err := newSpill(dir, maxSize)
+	if err != nil {
+		return err
+	}
+
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	if rb.spill != nil {
+		_ = rb.spill.close()
+	}
+	rb.spill = s
+	return nil
+}
+
+// Returns the number of records spilled to disk and not read yet, and the number of spilled records dropped.
+func (rb *RingBuffer) Spilled() (records int, dropped int) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	if rb.spill == nil {
+		return 0, 0
+	}
+	return rb.spill.records, rb.spill.dropped
+}
+
+// Returns a snapshot of the state of the buffer.
+func (rb *RingBuffer) Stats() Stats {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	stats := Stats{
+		Records:      rb.recordCount(),
+		Length:       rb.length(),
+		Capacity:     rb.size,
+		MaxSize:      rb.maxSize,
+		SkippedBytes: rb.skipped,
+		Dropped:      rb.dropped,
+	}
+	if rb.spill != nil {
+		stats.Spilled = rb.spill.records
+		stats.SpillDropped = rb.spill.dropped
+	}
+	if rb.compress != nil {
+		stats.RawBytes = rb.compress.raw
+		stats.CompressedBytes = rb.compress.compressed
+	}
+	if len(rb.quotas) > 0 {
+		stats.Quotas = rb.quotaUsage()
+	}
+	return stats
+}
+
+// Returns how many times smaller the compressed batches are than the records they hold, 1 if nothing was compressed.
+func (s Stats) CompressionRatio() float64 {
+	if s.CompressedBytes == 0 {
+		return 1
+	}
+	return float64(s.RawBytes) / float64(s.CompressedBytes)
+}
+
+/*
+Enables compression: records are gathered into batches of batch records, compressed with flate at a given level,
+and every batch is stored as a single record. Records are decompressed transparently by the record API.
+A batch not complete yet is kept aside in memory, and read after the batches in the buffer.
+A batch of 0 disables compression. Returns an error if the level is not a valid flate level.
+Note: Must be set before the first record is written. Byte reads return the compressed batches.
+*/
+func (rb *RingBuffer) SetCompression(level int, batch int) error {
+	var c *compressor
+	if batch > 0 {
+		var err error
+		if c, err = newCompressor(level, batch); err != nil {
+			return err
+		}
+	}
+
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	rb.compress = c
+	return nil
+}
+
+/*
+Drops every record and releases the temporary files of the spill and the memory-mapped file, if any.
+The buffer keeps working in memory afterwards.
+*/
+func (rb *RingBuffer) Close() error {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	rb.consumeAll()
+	rb.unread = false
+	rb.signalFree()
+	if rb.compress != nil {
+		rb.compress.reset()
+	}
+
+	var err error
+	if rb.spill != nil {
+		err = rb.spill.close()
+		rb.spill = nil
+	}
+	if rb.mapping != nil {
+		rb.mapping.store(rb)
+		rb.blocks = newBlocks(len(rb.blocks), rb.blockSize)
+		if e := rb.mapping.close(); err == nil {
+			err = e
+		}
+		rb.mapping = nil
+	}
+	return err
+}
+
+// Sets the policy to shrink back to the initial size after a burst. The zero policy never shrinks.
+func (rb *RingBuffer) SetShrinkPolicy(policy ShrinkPolicy) *RingBuffer {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	rb.shrink = policy
+	rb.lowSince = time.Time{}
+	rb.lowWrites = 0
+	return rb
+}
+
+/*
+Sets what to do with a write there is no room for once the maximum size is reached, see OverflowPolicy.
+With OverflowBlock, a write waits up to timeout for a reader to make room. Writes dropped or failed are counted in Stats.
+Note: Spilling only applies to the data overwritten by OverflowDropOldest without quotas. A WriteBatch waiting for room
+is no longer a single unit, other writers may write meanwhile.
+*/
+func (rb *RingBuffer) SetOverflowPolicy(policy OverflowPolicy, timeout time.Duration) *RingBuffer {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	rb.overflow = policy
+	rb.overflowTimeout = timeout
 	return rb
 }
 
@@ -75,10 +343,13 @@ Refreshes the virtual read pointer.
 Note: Should be used with Virtual[*] functions.
 */
 func (rb *RingBuffer) VirtualRefresh() {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	defer rb.afterUpdate(false)
+
 	rb.r = rb.vr
-	if rb.r == rb.w {
-		rb.isEmpty = true
-	}
+	rb.isEmpty = rb.isEmpty || rb.vempty
+	rb.syncVirtual()
 }
 
 /*
@@ -86,55 +357,36 @@ Reverts the virtual read pointer.
 Note: Should be used with Virtual[*] functions.
 */
 func (rb *RingBuffer) VirtualRevert() {
-	rb.vr = rb.r
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	rb.syncVirtual()
 }
 
 /*
 Virtually reads buffer without moving read pointer.
+Returns io.EOF once everything has been read virtually.
 Note: Only the virtual read pointer will be modified, logical read pointer remains stable.
 Note: Should be used with Virtual[] functions.
 */
 func (rb *RingBuffer) VirtualRead(p []byte) (n int, err error) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
 	if len(p) == 0 {
 		return 0, nil
 	}
-	if rb.isEmpty {
-		return 0, ErrIsEmpty
+	if rb.isEmpty || rb.vempty {
+		return 0, io.EOF
 	}
-	n = len(p)
 
-	// write pointer ahead of read pointer
-	if rb.w > rb.vr {
-		if n > rb.w-rb.vr {
-			n = rb.w - rb.vr
-		}
-		copy(p, rb.buf[rb.vr:rb.vr+n])
-
-		rb.vr = (rb.vr + n) % rb.size
-		if rb.vr == rb.w {
-			rb.isEmpty = true
-		}
-		return n, err
-	}
-
-	// write pointer behind read pointer
-	// cycle formed
-	if n > rb.size-rb.vr+rb.w {
-		n = rb.size - rb.vr + rb.w
-	}
-	if rb.vr+n <= rb.size {
-		copy(p, rb.buf[rb.vr:rb.vr+n])
-	} else {
-		// tail
-		c1 := rb.size - rb.vr
-		copy(p, rb.buf[rb.vr:rb.size])
-		// head
-		c2 := n - c1
-		copy(p[c1:], rb.buf[0:c2])
+	n = len(p)
+	if vLen := rb.virtualLength(); n > vLen {
+		n = vLen
 	}
-
-	rb.vr = (rb.vr + n) % rb.size
-	return n, err
+	rb.copyOut(p[:n], rb.vr)
+	rb.advanceVirtual(n)
+	return n, nil
 }
 
 /*
@@ -142,31 +394,57 @@ Returns the number of bytes available to read virtually.
 Note: Should be used with Virtual[] functions.
 */
 func (rb *RingBuffer) VirtualLength() int {
-	if rb.w == rb.vr {
-		if rb.isEmpty {
-			return 0
-		}
-		return rb.size
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	return rb.virtualLength()
+}
+
+func (rb *RingBuffer) virtualLength() int {
+	if rb.isEmpty || rb.vempty {
+		return 0
 	}
 
+	// the virtual read pointer only meets the write pointer behind the read pointer when the buffer is full
 	if rb.w > rb.vr {
 		return rb.w - rb.vr
 	}
 	return rb.size - rb.vr + rb.w
 }
 
+// Moves the virtual read pointer n bytes forward.
+func (rb *RingBuffer) advanceVirtual(n int) {
+	rb.vr = (rb.vr + n) % rb.size
+	rb.vempty = rb.vr == rb.w
+}
+
+// Moves the virtual read pointer back to the read pointer, aborting the open read transaction.
+func (rb *RingBuffer) syncVirtual() {
+	rb.vr = rb.r
+	rb.vempty = rb.isEmpty
+	rb.readSeq++
+}
+
 /*
 Reads buffer content into p.
-Returns the number of bytes read (0 <= n <= len(p)) and any error encountered.
+Returns the number of bytes read (0 <= n <= len(p)) and any error encountered, io.EOF if the buffer is empty.
 Note: Both logical and virtual read pointer will be modified.
 */
 func (rb *RingBuffer) Read(p []byte) (n int, err error) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	defer rb.afterUpdate(false)
+
+	return rb.read(p)
+}
+
+func (rb *RingBuffer) read(p []byte) (n int, err error) {
 	if len(p) == 0 {
 		return 0, nil
 	}
 
 	if rb.isEmpty {
-		return 0, ErrIsEmpty
+		return 0, io.EOF
 	}
 	n = len(p)
 
@@ -175,13 +453,13 @@ func (rb *RingBuffer) Read(p []byte) (n int, err error) {
 		if n > rb.w-rb.r {
 			n = rb.w - rb.r
 		}
-		copy(p, rb.buf[rb.r:rb.r+n])
+		rb.copyOut(p[:n], rb.r)
 
 		rb.r = (rb.r + n) % rb.size
 		if rb.r == rb.w {
 			rb.isEmpty = true
 		}
-		rb.vr = rb.r
+		rb.syncVirtual()
 		return n, err
 	}
 
@@ -190,33 +468,34 @@ func (rb *RingBuffer) Read(p []byte) (n int, err error) {
 	if n > rb.size-rb.r+rb.w {
 		n = rb.size - rb.r + rb.w
 	}
-	if rb.r+n <= rb.size {
-		copy(p, rb.buf[rb.r:rb.r+n])
-	} else {
-		// tail
-		c1 := rb.size - rb.r
-		copy(p, rb.buf[rb.r:rb.size])
-		// head
-		c2 := n - c1
-		copy(p[c1:], rb.buf[0:c2])
-	}
+	rb.copyOut(p[:n], rb.r)
 
 	rb.r = (rb.r + n) % rb.size
 	if rb.r == rb.w {
 		rb.isEmpty = true
 	}
-	rb.vr = rb.r
+	rb.syncVirtual()
 	return n, err
 }
 
-// Reads and returns the next byte from the buffer or returns error.
+// Reads and returns the next byte from the buffer, or io.EOF if the buffer is empty.
 // Note: Both logical and virtual read pointer will be modified.
 func (rb *RingBuffer) ReadByte() (b byte, err error) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	// the byte can be unread as long as shrinking did not move the data
+	size := rb.size
+	defer func() {
+		rb.unread = err == nil && rb.size == size
+	}()
+	defer rb.afterUpdate(false)
+
 	if rb.isEmpty {
-		return 0, ErrIsEmpty
+		return 0, io.EOF
 	}
 
-	b = rb.buf[rb.r]
+	b = rb.blocks[rb.r/rb.blockSize][rb.r%rb.blockSize]
 	rb.r++
 
 	if rb.r == rb.size {
@@ -225,34 +504,163 @@ func (rb *RingBuffer) ReadByte() (b byte, err error) {
 	if rb.w == rb.r {
 		rb.isEmpty = true
 	}
-	rb.vr = rb.r
+	rb.syncVirtual()
 
 	return b, err
 }
 
+// Unreads the last byte read by ReadByte. Returns ErrInvalidUnreadByte if the last operation was not a ReadByte.
+func (rb *RingBuffer) UnreadByte() error {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	if !rb.unread {
+		return ErrInvalidUnreadByte
+	}
+	defer rb.afterUpdate(false)
+
+	rb.r = (rb.r - 1 + rb.size) % rb.size
+	rb.isEmpty = false
+	rb.syncVirtual()
+	return nil
+}
+
+/*
+Returns a copy of the next n bytes without moving the read pointer.
+If fewer than n bytes are available, returns them along with io.EOF. Returns ErrNegativeCount if n is negative.
+*/
+func (rb *RingBuffer) Peek(n int) ([]byte, error) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	if n < 0 {
+		return nil, ErrNegativeCount
+	}
+
+	var err error
+	if l := rb.length(); n > l {
+		n, err = l, io.EOF
+	}
+	p := make([]byte, n)
+	rb.copyOut(p, rb.r)
+	return p, err
+}
+
+/*
+Skips the next n bytes, returning the number of bytes discarded.
+If fewer than n bytes are available, discards them and returns io.EOF. Returns ErrNegativeCount if n is negative.
+*/
+func (rb *RingBuffer) Discard(n int) (discarded int, err error) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	defer rb.afterUpdate(false)
+
+	if n < 0 {
+		return 0, ErrNegativeCount
+	}
+
+	if l := rb.length(); n > l {
+		n, err = l, io.EOF
+	}
+	if n > 0 {
+		rb.consume(n)
+	}
+	return n, err
+}
+
+/*
+Writes buffer content to w until the buffer is empty or an error occurs, consuming what was written.
+Returns the number of bytes written. Implements io.WriterTo, so the buffer being empty is not an error.
+Note: The buffer is locked while writing to w.
+*/
+func (rb *RingBuffer) WriteTo(w io.Writer) (n int64, err error) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	defer rb.afterUpdate(false)
+
+	for !rb.isEmpty {
+		// the contiguous bytes of the block under the read pointer
+		off := rb.r % rb.blockSize
+		chunk := rb.blocks[rb.r/rb.blockSize][off:]
+		if l := rb.length(); len(chunk) > l {
+			chunk = chunk[:l]
+		}
+
+		m, err := w.Write(chunk)
+		if m > 0 {
+			rb.consume(m)
+			n += int64(m)
+		}
+		if err != nil {
+			return n, err
+		}
+		if m < len(chunk) {
+			return n, io.ErrShortWrite
+		}
+	}
+	return n, nil
+}
+
+/*
+Writes the content of r to the buffer until io.EOF or an error occurs. Returns the number of bytes read from r.
+Implements io.ReaderFrom, so io.EOF is not an error. Data is written as by Write, chunk by chunk.
+*/
+func (rb *RingBuffer) ReadFrom(r io.Reader) (n int64, err error) {
+	chunk := make([]byte, DefaultBlockSize)
+	for {
+		m, err := r.Read(chunk)
+		if m > 0 {
+			n += int64(m)
+			if _, werr := rb.Write(chunk[:m]); werr != nil {
+				return n, werr
+			}
+		}
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+}
+
 // Consumes all available bytes to without returning them.
 func (rb *RingBuffer) ConsumeAll() {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	defer rb.afterUpdate(false)
+
+	rb.consumeAll()
+}
+
+func (rb *RingBuffer) consumeAll() {
 	rb.r = 0
 	rb.w = 0
-	rb.vr = 0
 	rb.isEmpty = true
+	rb.syncVirtual()
 }
 
 // Consumes len bytes without returning them.
 func (rb *RingBuffer) Consume(len int) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	defer rb.afterUpdate(false)
+
 	if rb.isEmpty || len <= 0 {
 		return
 	}
+	rb.consume(len)
+}
 
-	if len < rb.Length() {
+func (rb *RingBuffer) consume(len int) {
+	if len < rb.length() {
 		rb.r = (rb.r + len) % rb.size
-		rb.vr = rb.r
-
 		if rb.w == rb.r {
 			rb.isEmpty = true
 		}
+		rb.syncVirtual()
 	} else {
-		rb.ConsumeAll()
+		rb.consumeAll()
 	}
 }
 
@@ -265,57 +673,64 @@ If buffer available size not enough to write, there are two scenarios:
 Returns the number of bytes written from p (0 <= n <= len(p)) and any error encountered that caused write to stop early.
 */
 func (rb *RingBuffer) Write(p []byte) (n int, err error) {
-	if len(p) == 0 {
-		return 0, nil
-	}
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	defer rb.afterUpdate(true)
 
-	n = len(p)
-	free := rb.Free()
-	if n > free {
-		if !rb.isMaximumReached() {
-			// allocate additional (n - free) memory
-			rb.alloc(n - free)
-		} else {
-			// overwrite old logs
-			rb.overwrite(free, n, true)
+	return rb.write(p)
+}
+
+// Writes all slices of ps back to back as a single unit, so concurrent writers cannot interleave with it.
+// Returns the total number of bytes written and the first error encountered.
+func (rb *RingBuffer) WriteBatch(ps ...[]byte) (n int, err error) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	defer rb.afterUpdate(true)
+
+	for _, p := range ps {
+		m, err := rb.write(p)
+		n += m
+		if err != nil {
+			return n, err
 		}
 	}
+	return n, nil
+}
 
-	if rb.w >= rb.r {
-		if rb.size-rb.w >= n {
-			copy(rb.buf[rb.w:], p)
-			rb.w += n
-		} else {
-			copy(rb.buf[rb.w:], p[:rb.size-rb.w])
-			copy(rb.buf[0:], p[rb.size-rb.w:])
-			rb.w += n - rb.size
-		}
-	} else {
-		copy(rb.buf[rb.w:], p)
-		rb.w += n
+func (rb *RingBuffer) write(p []byte) (n int, err error) {
+	if len(p) == 0 {
+		return 0, nil
 	}
 
-	if rb.w == rb.size {
-		rb.w = 0
+	n = len(p)
+	if err := rb.reserve(n, true, 0); err == errDropped {
+		return n, nil
+	} else if err != nil {
+		return 0, err
 	}
 
+	rb.copyIn(rb.w, p)
+	rb.w = (rb.w + n) % rb.size
+
 	rb.isEmpty = false
+	rb.vempty = false
 	return n, err
 }
 
 // Writes one byte into buffer, and returns ErrIsFull if buffer is full.
 func (rb *RingBuffer) WriteByte(b byte) error {
-	if rb.Free() < 1 {
-		if !rb.isMaximumReached() {
-			// allocate additional 1 byte memory
-			rb.alloc(1)
-		} else {
-			// overwrite old data
-			rb.overwrite(rb.Free(), 1, false)
-		}
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	defer rb.afterUpdate(true)
+
+	// allocate additional 1 byte memory or overwrite old data
+	if err := rb.reserve(1, false, 0); err == errDropped {
+		return nil
+	} else if err != nil {
+		return err
 	}
 
-	rb.buf[rb.w] = b
+	rb.blocks[rb.w/rb.blockSize][rb.w%rb.blockSize] = b
 	rb.w++
 
 	if rb.w == rb.size {
@@ -323,11 +738,19 @@ func (rb *RingBuffer) WriteByte(b byte) error {
 	}
 
 	rb.isEmpty = false
+	rb.vempty = false
 	return nil
 }
 
 // Returns the number of bytes available to read
 func (rb *RingBuffer) Length() int {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	return rb.length()
+}
+
+func (rb *RingBuffer) length() int {
 	if rb.w == rb.r {
 		if rb.isEmpty {
 			return 0
@@ -343,63 +766,96 @@ func (rb *RingBuffer) Length() int {
 
 // Returns the underlying size of buffer
 func (rb *RingBuffer) Capacity() int {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
 	return rb.size
 }
 
-// Writes the contents of the string s to buffer, which accepts a slice of bytes.
+// Writes the contents of the string s to buffer. Implements io.StringWriter.
 func (rb *RingBuffer) WriteString(s string) (n int, err error) {
-	x := (*[2]uintptr)(unsafe.Pointer(&s))
-	h := [3]uintptr{x[0], x[1], x[1]}
-	buf := *(*[]byte)(unsafe.Pointer(&h))
-	return rb.Write(buf)
+	return rb.Write([]byte(s))
 }
 
 // Returns all available read bytes. It does not move the read pointer and only copy the available data.
 func (rb *RingBuffer) Bytes() []byte {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
 	if rb.isEmpty {
 		return nil
 	}
 
-	if rb.w > rb.r {
-		buf := make([]byte, rb.w-rb.r)
-		copy(buf, rb.buf[rb.r:rb.w])
-		return buf
-	}
-
-	buf := make([]byte, rb.size-rb.r+rb.w)
-	copy(buf, rb.buf[rb.r:rb.size])
-	copy(buf[rb.size-rb.r:], rb.buf[0:rb.w])
+	buf := make([]byte, rb.length())
+	rb.copyOut(buf, rb.r)
 	return buf
 }
 
 // Checks if buffer is full
 func (rb *RingBuffer) IsFull() bool {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
 	return !rb.isEmpty && rb.w == rb.r
 }
 
-// Checks if buffer is empty
+// Checks if buffer is empty, including spilled records and records waiting for compression.
 func (rb *RingBuffer) IsEmpty() bool {
-	return rb.isEmpty
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	if rb.compress != nil && len(rb.compress.pending)+len(rb.compress.out) > 0 {
+		return false
+	}
+	return rb.isEmpty && (rb.spill == nil || rb.spill.records == 0)
 }
 
 // When Reset called, everything will be refreshed and reset to initial state, including the size of the buffer
 func (rb *RingBuffer) Reset() {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
 	rb.r = 0
-	rb.vr = 0
 	rb.w = 0
 	rb.isEmpty = true
+	rb.syncVirtual()
+	rb.unread = false
+	rb.skipped = 0
+	rb.dropped = 0
+	rb.signalFree()
+	if rb.spill != nil {
+		rb.spill.reset()
+	}
+	if rb.compress != nil {
+		rb.compress.reset()
+	}
+	rb.lowSince = time.Time{}
+	rb.lowWrites = 0
 	if rb.size > rb.initSize {
-		rb.buf = make([]byte, rb.initSize)
+		rb.blocks = newBlocks(rb.initSize/rb.blockSize, rb.blockSize)
 		rb.size = rb.initSize
 	}
+	if rb.mapping != nil {
+		rb.mapping.store(rb)
+	}
 }
 
 func (rb *RingBuffer) String() string {
-	return fmt.Sprintf("Ring Buffer: \n\tCapacity: %d\n\tReadable Bytes: %d\n\tWriteable Bytes: %d\n\tBuffer: %s\n", rb.size, rb.Length(), rb.Free(), rb.buf)
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	return fmt.Sprintf("Ring Buffer: \n\tCapacity: %d\n\tReadable Bytes: %d\n\tWriteable Bytes: %d\n\tBuffer: %s\n", rb.size, rb.length(), rb.free(), rb.flatten())
 }
 
 // Returns the length of available bytes to write.
 func (rb *RingBuffer) Free() int {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	return rb.free()
+}
+
+func (rb *RingBuffer) free() int {
 	if rb.w == rb.r {
 		if rb.isEmpty {
 			return rb.size
@@ -413,6 +869,507 @@ func (rb *RingBuffer) Free() int {
 	return rb.size - rb.w + rb.r
 }
 
+// Runs fn with exclusive access to the buffer. Everything fn reads through r is consumed as a single unit,
+// so concurrent writers cannot overwrite it halfway, e.g. between a length prefix and its log.
+// Note: Reads through r behave as Read, r must not be used once fn returns.
+func (rb *RingBuffer) ReadBatch(fn func(r io.Reader) error) error {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	defer rb.afterUpdate(false)
+
+	return fn(batchReader{rb})
+}
+
+// batchReader reads a buffer whose lock is already held.
+type batchReader struct {
+	rb *RingBuffer
+}
+
+func (br batchReader) Read(p []byte) (n int, err error) {
+	return br.rb.read(p)
+}
+
+/*
+Writes p as a single record: its header, see RecordHeaderSize, followed by p.
+Room for the whole record is reserved at once, so overwriting old records can never split it.
+Returns ErrTooLarge if the record does not fit in the buffer at maximum size, or is longer than MaxRecordSize.
+Note: With compression, p is kept aside until its batch is complete, and the batch is written as a single record.
+*/
+func (rb *RingBuffer) WriteRecord(p []byte) error {
+	return rb.WriteRecordLevel(p, LevelNone)
+}
+
+// Writes p as a single record of a given level, see OverflowDropLowest. Errors are the same as WriteRecord.
+func (rb *RingBuffer) WriteRecordLevel(p []byte, level Level) error {
+	return rb.WriteRecordCategory(p, level, "")
+}
+
+/*
+Writes p as a single record of a given level and category, see SetQuotas. Errors are the same as WriteRecord.
+Note: Only the categories of the quotas are kept, any other is stored as no category.
+*/
+func (rb *RingBuffer) WriteRecordCategory(p []byte, level Level, category string) error {
+	if !recordFits(len(p)) {
+		return ErrTooLarge
+	}
+
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	defer rb.afterUpdate(true)
+
+	tag := recordTag(level, rb.categoryIndex(category))
+	if rb.compress != nil {
+		batch, batchTag := rb.compress.add(p, tag)
+		if batch == nil {
+			return nil
+		}
+		if !recordFits(len(batch)) {
+			return ErrTooLarge
+		}
+		p, tag = batch, batchTag
+	}
+	return rb.writeRecord(p, tag)
+}
+
+func (rb *RingBuffer) writeRecord(p []byte, tag byte) error {
+	h := rb.framing.header(p, tag)
+	n := len(h) + len(p)
+	if err := rb.reserve(n, true, tag); err == errDropped {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	rb.copyIn(rb.w, h)
+	rb.copyIn((rb.w+len(h))%rb.size, p)
+	rb.w = (rb.w + n) % rb.size
+
+	rb.isEmpty = false
+	rb.vempty = false
+	return nil
+}
+
+/*
+Reads the oldest record and returns its payload.
+Returns ErrIsEmpty if there is no record, and ErrBadRecord if the data at the read pointer is not a complete record.
+Note: With FramingChecksum, malformed data is skipped up to the next valid record, which is returned.
+Otherwise, or if there is no valid record left, the remaining data is dropped and ErrBadRecord returned.
+ErrBadRecord thus always moves past the malformed data, and a caller may read on.
+*/
+func (rb *RingBuffer) ReadRecord() ([]byte, error) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	defer rb.afterUpdate(false)
+
+	if rb.compress != nil {
+		return rb.nextRecord(true)
+	}
+	return rb.readStored(true)
+}
+
+/*
+Returns the payload of the oldest record without consuming it. Errors are the same as ReadRecord, without dropping.
+Note: With compression, the batch holding the record is decoded but left in the buffer, so an open ReadTx goes on.
+*/
+func (rb *RingBuffer) PeekRecord() ([]byte, error) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	defer rb.afterUpdate(false)
+
+	if rb.compress != nil {
+		return rb.nextRecord(false)
+	}
+	return rb.readStored(false)
+}
+
+/*
+Drops the oldest records as long as drop returns true for their payload, e.g. records past their time to live.
+Stops at the first record kept or malformed. Returns the number of records dropped.
+Note: The buffer is locked while dropping, drop must not call its methods.
+*/
+func (rb *RingBuffer) DropRecords(drop func(p []byte) bool) int {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	defer rb.afterUpdate(false)
+
+	next := rb.readStored
+	if rb.compress != nil {
+		next = rb.nextRecord
+	}
+
+	dropped := 0
+	for {
+		p, err := next(false)
+		if err != nil || !drop(p) {
+			return dropped
+		}
+		_, _ = next(true)
+		dropped++
+	}
+}
+
+// Returns the number of complete records available to read, including spilled and pending compressed records.
+func (rb *RingBuffer) RecordCount() int {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	return rb.recordCount()
+}
+
+func (rb *RingBuffer) recordCount() int {
+	if rb.compress != nil {
+		count := len(rb.compress.out) + len(rb.compress.pending)
+		rb.rangeStored(func(p []byte) bool {
+			n, _ := batchCount(p)
+			count += n
+			return true
+		})
+		return count
+	}
+
+	count := 0
+	if rb.spill != nil {
+		count = rb.spill.records
+	}
+	rb.walkRecords(func(pos int, size int) bool {
+		count++
+		return true
+	})
+	return count
+}
+
+/*
+Calls fn with the payload of every record available to read, oldest first, without consuming them.
+Stops when fn returns false or at the first malformed record, unless malformed data can be skipped with FramingChecksum.
+Note: The buffer is locked while iterating, fn must not call its methods.
+*/
+func (rb *RingBuffer) RangeRecords(fn func(p []byte) bool) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	if rb.compress == nil {
+		rb.rangeStored(fn)
+		return
+	}
+
+	each := func(records [][]byte) bool {
+		for _, p := range records {
+			if !fn(p) {
+				return false
+			}
+		}
+		return true
+	}
+	if !each(rb.compress.out) {
+		return
+	}
+	more := true
+	rb.rangeStored(func(p []byte) bool {
+		records, err := decodeBatch(p)
+		if err != nil {
+			return true
+		}
+		more = each(records)
+		return more
+	})
+	if more {
+		each(rb.compress.pending)
+	}
+}
+
+// Reads the oldest record as stored, spilled records first, moving past it if consume is set.
+func (rb *RingBuffer) readStored(consume bool) ([]byte, error) {
+	if rb.spill != nil && rb.spill.records > 0 {
+		if consume {
+			rb.readSeq++
+		}
+		p, _, err := rb.spill.read(consume)
+		return p, err
+	}
+
+	p, size, err := rb.peekRecord()
+	if err == ErrBadRecord && consume && rb.resync() {
+		p, size, err = rb.peekRecord()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if consume {
+		rb.consume(size)
+	}
+	return p, nil
+}
+
+// Calls fn with the payload of every record stored, spilled records first, until fn returns false.
+func (rb *RingBuffer) rangeStored(fn func(p []byte) bool) {
+	if rb.spill != nil && !rb.spill.rangeRecords(fn) {
+		return
+	}
+
+	rb.walkRecords(func(pos int, size int) bool {
+		hs := rb.headerSizeAt(pos)
+		p := make([]byte, size-hs)
+		rb.copyOut(p, (pos+hs)%rb.size)
+		return fn(p)
+	})
+}
+
+/*
+Returns the oldest record with compression, moving past it if consume is set:
+the records of the batch being read first, then the batches stored, then the pending records.
+Batches are moved out of storage only when consuming, since that aborts an open transaction.
+*/
+func (rb *RingBuffer) nextRecord(consume bool) ([]byte, error) {
+	c := rb.compress
+	if len(c.out) == 0 && !consume {
+		return rb.peekBatch()
+	}
+	for len(c.out) == 0 {
+		batch, err := rb.readStored(true)
+		if err == ErrIsEmpty {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if c.out, err = decodeBatch(batch); err != nil {
+			return nil, err
+		}
+	}
+
+	records := &c.out
+	if len(c.out) == 0 {
+		records = &c.pending
+	}
+	if len(*records) == 0 {
+		return nil, ErrIsEmpty
+	}
+
+	p := (*records)[0]
+	if consume {
+		(*records)[0] = nil
+		*records = (*records)[1:]
+		rb.readSeq++
+	}
+	return p, nil
+}
+
+// Returns the first record of the oldest batch stored with compression, or of the pending records, leaving them in place.
+func (rb *RingBuffer) peekBatch() ([]byte, error) {
+	batch, err := rb.readStored(false)
+	if err == ErrIsEmpty {
+		if len(rb.compress.pending) == 0 {
+			return nil, ErrIsEmpty
+		}
+		return rb.compress.pending[0], nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	records, err := decodeBatch(batch)
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, ErrBadRecord
+	}
+	return records[0], nil
+}
+
+func (rb *RingBuffer) peekRecord() (p []byte, size int, err error) {
+	if rb.isEmpty {
+		return nil, 0, ErrIsEmpty
+	}
+
+	size, err = rb.recordSize(rb.r, rb.length())
+	if err != nil {
+		return nil, 0, err
+	}
+
+	hs := rb.headerSizeAt(rb.r)
+	p = make([]byte, size-hs)
+	rb.copyOut(p, (rb.r+hs)%rb.size)
+	return p, size, nil
+}
+
+// Returns the size of the record at logical position pos, given avail bytes are readable from there.
+func (rb *RingBuffer) recordSize(pos int, avail int) (int, error) {
+	if avail < 2 {
+		return 0, ErrBadRecord
+	}
+	if rb.framing == FramingChecksum && rb.byteAt(pos) != RecordMagic {
+		return 0, ErrBadRecord
+	}
+	hs := rb.headerSizeAt(pos)
+	if avail < hs {
+		return 0, ErrBadRecord
+	}
+
+	h := make([]byte, hs)
+	rb.copyOut(h, pos)
+	if rb.framing != FramingChecksum {
+		l := payloadLength(h)
+		if l < 0 || l > avail-hs {
+			return 0, ErrBadRecord
+		}
+		return hs + l, nil
+	}
+
+	l, crc, err := parseChecksumHeader(h)
+	if err != nil || l > avail-hs {
+		return 0, ErrBadRecord
+	}
+	if rb.checksum(headerChecksum(h), (pos+hs)%rb.size, l) != crc {
+		return 0, ErrBadRecord
+	}
+	return hs + l, nil
+}
+
+/*
+Returns the size of the header of the record at logical position pos, which is at least 2 bytes long:
+a checksummed header of version 1 is shorter, one of an unknown version is assumed to be of the current one.
+*/
+func (rb *RingBuffer) headerSizeAt(pos int) int {
+	if rb.framing != FramingChecksum {
+		return RecordHeaderSize
+	}
+	if hs := checksumHeaderSize(rb.byteAt((pos + 1) % rb.size)); hs > 0 {
+		return hs
+	}
+	return ChecksumHeaderSize
+}
+
+// Returns the tag of the record at logical position pos, none for a checksummed record of version 1.
+func (rb *RingBuffer) recordTag(pos int) byte {
+	if rb.framing == FramingChecksum && rb.byteAt((pos+1)%rb.size) != RecordVersion {
+		return 0
+	}
+	return rb.byteAt((pos + rb.framing.tagOffset()) % rb.size)
+}
+
+// Returns the byte at logical position pos.
+func (rb *RingBuffer) byteAt(pos int) byte {
+	return rb.blocks[pos/rb.blockSize][pos%rb.blockSize]
+}
+
+// Updates crc with n bytes from logical position pos, wrapping around the end of buffer.
+func (rb *RingBuffer) checksum(crc uint32, pos int, n int) uint32 {
+	for n > 0 {
+		off := pos % rb.blockSize
+		chunk := rb.blocks[pos/rb.blockSize][off:]
+		if len(chunk) > n {
+			chunk = chunk[:n]
+		}
+		crc = crc32.Update(crc, crc32.IEEETable, chunk)
+		n -= len(chunk)
+		pos = (pos + len(chunk)) % rb.size
+	}
+	return crc
+}
+
+/*
+Skips malformed data at the read pointer up to the next valid record, and returns whether there is one.
+Only checksummed records can be told apart from malformed data, with FramingLength everything is dropped.
+*/
+func (rb *RingBuffer) resync() bool {
+	length := rb.length()
+	if rb.framing == FramingChecksum {
+		for n := 1; n < length; n++ {
+			if _, err := rb.recordSize((rb.r+n)%rb.size, length-n); err == nil {
+				rb.skipped += n
+				rb.consume(n)
+				return true
+			}
+		}
+	}
+
+	rb.skipped += length
+	rb.consumeAll()
+	return false
+}
+
+// Calls fn with the position and size of every complete record available to read, until fn returns false.
+func (rb *RingBuffer) walkRecords(fn func(pos int, size int) bool) {
+	if rb.isEmpty {
+		return
+	}
+
+	pos, avail := rb.r, rb.length()
+	for avail > 0 {
+		size, err := rb.recordSize(pos, avail)
+		if err != nil && rb.framing == FramingChecksum {
+			// look for the next valid record
+			pos = (pos + 1) % rb.size
+			avail--
+			continue
+		}
+		if err != nil || !fn(pos, size) {
+			return
+		}
+		pos = (pos + size) % rb.size
+		avail -= size
+	}
+}
+
+/*
+Makes room for n bytes at the write pointer, by allocating additional memory or, once the maximum size is reached,
+according to the overflow policy: by overwriting old data, whole records if records is set, or by waiting for a reader.
+The quotas are honored when making room for a record of a given tag.
+Returns ErrTooLarge if n bytes do not fit in the buffer at maximum size, ErrFull if the policy fails the write,
+and errDropped if the policy drops it.
+*/
+func (rb *RingBuffer) reserve(n int, records bool, tag byte) error {
+	var deadline time.Time
+	for {
+		free := rb.free()
+		if n <= free {
+			return nil
+		}
+		if n > rb.size && n > rb.maxSize {
+			return ErrTooLarge
+		}
+
+		if !rb.isMaximumReached() {
+			// allocate additional (n - free) memory
+			rb.alloc(n - free)
+			return nil
+		}
+		if n > rb.size {
+			return ErrTooLarge
+		}
+
+		switch rb.overflow {
+		case OverflowDropNewest:
+			rb.dropped++
+			return errDropped
+		case OverflowError:
+			rb.dropped++
+			return ErrFull
+		case OverflowDropOldest, OverflowDropLowest:
+			if records && (rb.overflow == OverflowDropLowest || len(rb.quotas) > 0) {
+				rb.evict(n, tag)
+				return nil
+			}
+		case OverflowBlock:
+			if deadline.IsZero() {
+				deadline = time.Now().Add(rb.overflowTimeout)
+			}
+			if !rb.waitFree(deadline) {
+				rb.dropped++
+				return ErrFull
+			}
+			// the buffer may have changed in any way meanwhile, start over
+			continue
+		}
+
+		// overwrite old logs, malformed data is skipped or dropped, which leaves room anyway
+		_ = rb.overwrite(free, n, records)
+		return nil
+	}
+}
+
 // Overwrites old data until memory abundant to write new data.
 func (rb *RingBuffer) overwrite(free int, need int, logOverriding bool) error {
 	if free >= need {
@@ -421,26 +1378,31 @@ func (rb *RingBuffer) overwrite(free int, need int, logOverriding bool) error {
 
 	if logOverriding {
 		for free < need && !rb.isEmpty {
-			rd := make([]byte, 4)
-			n, err := rb.Read(rd)
-
-			if n != 4 || err != nil {
-				return err
+			size, err := rb.recordSize(rb.r, rb.length())
+			if err != nil {
+				// skip malformed data, or drop everything if record boundaries are lost
+				if !rb.resync() {
+					return err
+				}
+				free = rb.free()
+				continue
 			}
 
-			l := int(binary.LittleEndian.Uint32(rd))
-			rd = make([]byte, l)
-			n, err = rb.Read(rd)
-
-			if n != l || err != nil {
-				return err
+			if rb.spill != nil {
+				hs := rb.headerSizeAt(rb.r)
+				p := make([]byte, size-hs)
+				rb.copyOut(p, (rb.r+hs)%rb.size)
+				// a record failing to spill is dropped, as without spilling
+				_ = rb.spill.append(p, rb.recordTag(rb.r))
 			}
-			free += n + 4
+
+			rb.consume(size)
+			free += size
 		}
 	} else {
 		for free < need && !rb.isEmpty {
 			rd := make([]byte, 1)
-			n, err := rb.Read(rd)
+			n, err := rb.read(rd)
 
 			if n != 1 || err != nil {
 				return err
@@ -452,19 +1414,151 @@ func (rb *RingBuffer) overwrite(free int, need int, logOverriding bool) error {
 	return nil
 }
 
-// Allocate additional memory for buffer specified by len.
+/*
+Allocate additional memory for buffer specified by len.
+New blocks are inserted at the write pointer, so data is never copied, except the part of the block
+under the write pointer that lies ahead of it, when the write pointer is in the middle of a block.
+*/
 func (rb *RingBuffer) alloc(len int) {
-	vLen := rb.VirtualLength()
+	vLen := rb.virtualLength()
 	newSize := rb.extend(rb.size + len)
-	newBuf := make([]byte, newSize)
-	oldLen := rb.Length()
-	_, _ = rb.Read(newBuf)
+	count := (newSize - rb.size + rb.blockSize - 1) / rb.blockSize
+	added := count * rb.blockSize
+	blocks := newBlocks(count, rb.blockSize)
+
+	switch {
+	case rb.isEmpty:
+		// nothing to keep in order, restart from the beginning
+		rb.blocks = append(rb.blocks, blocks...)
+		rb.r, rb.w = 0, 0
+	case rb.w > rb.r || rb.w == 0:
+		// data does not wrap around the end, append after it
+		if rb.w == 0 {
+			rb.w = rb.size
+		}
+		rb.blocks = append(rb.blocks, blocks...)
+	default:
+		// data wraps around the end, insert between the newest and the oldest data
+		idx, off := rb.w/rb.blockSize, rb.w%rb.blockSize
+		if off > 0 {
+			// move what lies ahead of the write pointer to the same offset of the last new block
+			copy(blocks[count-1][off:], rb.blocks[idx][off:])
+			idx++
+		}
+		rb.blocks = append(rb.blocks[:idx], append(blocks, rb.blocks[idx:]...)...)
+		rb.r += added
+	}
 
-	rb.w = oldLen
-	rb.r = 0
-	rb.vr = oldLen - vLen
+	rb.size += added
+	rb.vr = ((rb.w-vLen)%rb.size + rb.size) % rb.size
+}
+
+// Copies len(dst) bytes from logical position pos, wrapping around the end of buffer.
+func (rb *RingBuffer) copyOut(dst []byte, pos int) {
+	for len(dst) > 0 {
+		off := pos % rb.blockSize
+		n := copy(dst, rb.blocks[pos/rb.blockSize][off:])
+		dst = dst[n:]
+		pos = (pos + n) % rb.size
+	}
+}
+
+// Copies src into logical position pos, wrapping around the end of buffer.
+func (rb *RingBuffer) copyIn(pos int, src []byte) {
+	for len(src) > 0 {
+		off := pos % rb.blockSize
+		n := copy(rb.blocks[pos/rb.blockSize][off:], src)
+		src = src[n:]
+		pos = (pos + n) % rb.size
+	}
+}
+
+// Called after every operation moving the read or write pointer.
+func (rb *RingBuffer) afterUpdate(wrote bool) {
+	rb.unread = false
+	rb.shrinkIfIdle(wrote)
+	if !wrote {
+		rb.signalFree()
+	}
+	if rb.mapping != nil {
+		rb.mapping.store(rb)
+	}
+}
+
+/*
+Shrinks the buffer according to its shrink policy. Called after every operation changing the length of buffer.
+The idle period starts once the buffer is at or below the low-water mark, and restarts whenever it goes above.
+*/
+func (rb *RingBuffer) shrinkIfIdle(wrote bool) {
+	if rb.shrink.After <= 0 && rb.shrink.Writes <= 0 {
+		return
+	}
+	if rb.size <= rb.initSize || rb.length() > rb.shrink.LowWater {
+		rb.lowSince = time.Time{}
+		rb.lowWrites = 0
+		return
+	}
+
+	if rb.lowSince.IsZero() {
+		rb.lowSince = time.Now()
+		return
+	}
+	if wrote {
+		rb.lowWrites++
+	}
+
+	if (rb.shrink.After > 0 && time.Since(rb.lowSince) >= rb.shrink.After) ||
+		(rb.shrink.Writes > 0 && rb.lowWrites >= rb.shrink.Writes) {
+		rb.shrinkToFit()
+		rb.lowSince = time.Time{}
+		rb.lowWrites = 0
+	}
+}
+
+/*
+Shrinks the buffer back to its initial size, or to the fewest blocks holding the unread data if more.
+Only the unread data is copied, to the beginning of new blocks.
+*/
+func (rb *RingBuffer) shrinkToFit() {
+	length := rb.length()
+	vLen := rb.virtualLength()
+	newSize := rb.initSize
+	if length > newSize {
+		newSize = (length + rb.blockSize - 1) / rb.blockSize * rb.blockSize
+	}
+	if newSize >= rb.size {
+		return
+	}
+
+	blocks := newBlocks(newSize/rb.blockSize, rb.blockSize)
+	buf := make([]byte, length)
+	rb.copyOut(buf, rb.r)
+
+	rb.blocks = blocks
 	rb.size = newSize
-	rb.buf = newBuf
+	rb.copyIn(0, buf)
+	rb.r = 0
+	rb.w = length % newSize
+	rb.vr = ((rb.w-vLen)%rb.size + rb.size) % rb.size
+}
+
+// Returns a copy of all blocks, in logical order.
+func (rb *RingBuffer) flatten() []byte {
+	buf := make([]byte, 0, rb.size)
+	for _, block := range rb.blocks {
+		buf = append(buf, block...)
+	}
+	return buf
+}
+
+// Returns count blocks of the given size, backed by a single allocation.
+func newBlocks(count int, size int) [][]byte {
+	mem := make([]byte, count*size)
+	blocks := make([][]byte, count)
+	for i := range blocks {
+		blocks[i] = mem[i*size : (i+1)*size : (i+1)*size]
+	}
+	return blocks
 }
 
 /*
@@ -518,20 +1612,71 @@ func (rb *RingBuffer) isMaximumReached() bool {
 
 // Returns the value of the write pointer.
 func (rb *RingBuffer) GetW() int {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
 	return rb.w
 }
 
 // Returns the value of the read pointer.
 func (rb *RingBuffer) GetR() int {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
 	return rb.r
 }
 
 // Returns the value of the virtual read pointer.
 func (rb *RingBuffer) GetVR() int {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
 	return rb.vr
 }
 
-// Returns the buffer.
+// Returns a copy of the buffer, made of all blocks in logical order.
 func (rb *RingBuffer) GetBuf() []byte {
-	return rb.buf
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	return rb.flatten()
+}
+
+// Overwrites the byte at logical position pos, to simulate corrupted data.
+func (rb *RingBuffer) SetByte(pos int, b byte) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	rb.blocks[pos/rb.blockSize][pos%rb.blockSize] = b
+}
+
+// Sets when the buffer went below the low-water mark of its shrink policy.
+func (rb *RingBuffer) SetLowSince(t time.Time) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	rb.lowSince = t
+}
+
+// Returns the number of blocks of the buffer.
+func (rb *RingBuffer) GetBlocks() int {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	return len(rb.blocks)
+}
+
+// Returns the level of the oldest record as stored, spilled records first.
+func (rb *RingBuffer) GetRecordLevel() (Level, error) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	if rb.spill != nil && rb.spill.records > 0 {
+		_, tag, err := rb.spill.read(false)
+		return tagLevel(tag), err
+	}
+	if rb.isEmpty {
+		return LevelNone, ErrIsEmpty
+	}
+	return tagLevel(rb.recordTag(rb.r)), nil
 }
@@ -0,0 +1,208 @@
+package buffer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+/*
+*************************************************************
+
+	BASELINE
+
+*************************************************************
+*/
+
+/*
+baselineRingBuffer is a copy of the RingBuffer this package started with, trimmed to its write path:
+a single contiguous slice, copied whenever it grows, and no locking.
+It stands for the baseline of the benchmarks in buffer/test, and is never used outside of them.
+*/
+type baselineRingBuffer struct {
+	buf []byte // buffer
+
+	size    int // dynamic size of buffer
+	maxSize int // maximum size of buffer
+	extCoef int // coefficient for extending buffer strategy
+
+	r int // logical read pointer
+	w int // logical write pointer
+
+	isEmpty bool
+}
+
+func newBaselineRingBuffer(defaultSize int, maxSize int, extCoef int) *baselineRingBuffer {
+	return &baselineRingBuffer{
+		buf:     make([]byte, defaultSize),
+		size:    defaultSize,
+		maxSize: maxSize,
+		extCoef: extCoef,
+		isEmpty: true,
+	}
+}
+
+// Writes the parts of a record, one after the other.
+func (rb *baselineRingBuffer) WriteBatch(parts ...[]byte) {
+	for _, p := range parts {
+		rb.Write(p)
+	}
+}
+
+func (rb *baselineRingBuffer) Write(p []byte) {
+	if len(p) == 0 {
+		return
+	}
+
+	n := len(p)
+	free := rb.Free()
+	if n > free {
+		if rb.size < rb.maxSize {
+			rb.alloc(n - free)
+		} else {
+			rb.overwrite(free, n)
+		}
+	}
+
+	if rb.w >= rb.r {
+		if rb.size-rb.w >= n {
+			copy(rb.buf[rb.w:], p)
+			rb.w += n
+		} else {
+			copy(rb.buf[rb.w:], p[:rb.size-rb.w])
+			copy(rb.buf[0:], p[rb.size-rb.w:])
+			rb.w += n - rb.size
+		}
+	} else {
+		copy(rb.buf[rb.w:], p)
+		rb.w += n
+	}
+
+	if rb.w == rb.size {
+		rb.w = 0
+	}
+	rb.isEmpty = false
+}
+
+func (rb *baselineRingBuffer) Read(p []byte) int {
+	if len(p) == 0 || rb.isEmpty {
+		return 0
+	}
+	n := len(p)
+	if l := rb.Length(); n > l {
+		n = l
+	}
+
+	if rb.r+n <= rb.size {
+		copy(p, rb.buf[rb.r:rb.r+n])
+	} else {
+		c1 := rb.size - rb.r
+		copy(p, rb.buf[rb.r:rb.size])
+		copy(p[c1:], rb.buf[0:n-c1])
+	}
+
+	rb.r = (rb.r + n) % rb.size
+	if rb.r == rb.w {
+		rb.isEmpty = true
+	}
+	return n
+}
+
+func (rb *baselineRingBuffer) Length() int {
+	if rb.w == rb.r {
+		if rb.isEmpty {
+			return 0
+		}
+		return rb.size
+	}
+	if rb.w > rb.r {
+		return rb.w - rb.r
+	}
+	return rb.size - rb.r + rb.w
+}
+
+func (rb *baselineRingBuffer) Free() int {
+	return rb.size - rb.Length()
+}
+
+// Overwrites whole records until there is room for need bytes.
+func (rb *baselineRingBuffer) overwrite(free int, need int) {
+	h := make([]byte, RecordHeaderSize)
+	for free < need && !rb.isEmpty {
+		if rb.Read(h) != RecordHeaderSize {
+			return
+		}
+		l := int(binary.LittleEndian.Uint32(h))
+		if l > rb.Length() {
+			return
+		}
+		rb.r = (rb.r + l) % rb.size
+		rb.isEmpty = rb.r == rb.w
+		free += RecordHeaderSize + l
+	}
+}
+
+// Allocates len bytes more, copying the buffer into a new slice.
+func (rb *baselineRingBuffer) alloc(len int) {
+	newSize := rb.extend(rb.size + len)
+	newBuf := make([]byte, newSize)
+	oldLen := rb.Read(newBuf)
+
+	rb.w = oldLen
+	rb.r = 0
+	rb.isEmpty = oldLen == 0
+	rb.size = newSize
+	rb.buf = newBuf
+}
+
+func (rb *baselineRingBuffer) extend(expcap int) int {
+	newcap := rb.size
+	doublecap := newcap + newcap
+	if expcap > doublecap {
+		return expcap
+	}
+	if rb.size < rb.extCoef {
+		return doublecap
+	}
+	for 0 < newcap && newcap < expcap {
+		newcap += newcap / 4
+	}
+	if newcap <= 0 {
+		newcap = expcap
+	}
+	return newcap
+}
+
+/*
+*************************************************************
+
+	BENCHMARK
+
+*************************************************************
+*/
+
+// The baseline of BenchmarkRingBuffer_Write in buffer/test, to measure the cost of synchronization.
+func BenchmarkRingBuffer_WriteUnsynchronized(b *testing.B) {
+	rb := newBaselineRingBuffer(4096, 64*1024, 1024)
+
+	record := [][]byte{recordHeader(128, 0), bytes.Repeat([]byte{'a'}, 128)}
+	b.SetBytes(int64(RecordHeaderSize + 128))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rb.WriteBatch(record...)
+	}
+}
+
+// The baseline of BenchmarkRingBuffer_Burst in buffer/test, to measure what growing in blocks saves over copying.
+func BenchmarkRingBuffer_BurstCopyOnGrow(b *testing.B) {
+	record := [][]byte{recordHeader(256, 0), bytes.Repeat([]byte{'a'}, 256)}
+	b.SetBytes(int64(4 * 1024 * 1024))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		rb := newBaselineRingBuffer(4*1024, 4*1024*1024, 1024*1024)
+		for rb.Length() < 4*1024*1024-256-RecordHeaderSize {
+			rb.WriteBatch(record...)
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package buffer
+
+import (
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+/*
+*************************************************************
+
+	CONSTANT
+
+*************************************************************
+*/
+
+// Number of segments the disk cap of a spill is split into. The oldest segment is dropped as a whole when the cap is reached.
+const spillSegments = 8
+
+/*
+*************************************************************
+
+	STRUCT DEFINITION
+
+*************************************************************
+*/
+
+/*
+spill keeps the records evicted from a full buffer in append-only segment files, oldest first.
+Every segment file is a sequence of records in the checksummed framing, see FramingChecksum, keeping the tag
+they had in memory.
+*/
+type spill struct {
+	dir      string     // directory holding the segment files, removed on close
+	maxSize  int64      // maximum size on disk
+	segSize  int64      // size at which a new segment is started
+	segments []*segment // oldest first
+	size     int64      // bytes on disk
+	records  int        // records not read yet
+	dropped  int        // records dropped because of the disk cap or a disk error
+	seq      int        // sequence number of the next segment
+}
+
+// segment is a file of records, appended by the writer and read from the beginning.
+type segment struct {
+	f       *os.File
+	size    int64 // bytes written
+	off     int64 // read offset
+	records int   // records not read yet
+}
+
+/*
+*************************************************************
+
+	SPILL
+
+*************************************************************
+*/
+
+// Returns a spill storing its segments in a new directory inside dir, holding up to maxSize bytes on disk.
+func newSpill(dir string, maxSize int) (*spill, error) {
+	if maxSize <= 0 {
+		return nil, fmt.Errorf("%w: spill size %d must be positive", ErrInvalidSize, maxSize)
+	}
+
+	d, err := ioutil.TempDir(dir, "s1logger-spill-")
+	if err != nil {
+		return nil, err
+	}
+
+	s := &spill{
+		dir:     d,
+		maxSize: int64(maxSize),
+		segSize: int64(maxSize) / spillSegments,
+	}
+	if s.segSize == 0 {
+		s.segSize = 1
+	}
+	return s, nil
+}
+
+// Appends a record of a given tag holding payload p. The oldest segments are dropped while the disk cap is exceeded.
+func (s *spill) append(p []byte, tag byte) error {
+	data := append(FramingChecksum.header(p, tag), p...)
+	if int64(len(data)) > s.maxSize {
+		s.dropped++
+		return ErrTooLarge
+	}
+
+	if len(s.segments) == 0 || s.segments[len(s.segments)-1].size >= s.segSize {
+		if err := s.rotate(); err != nil {
+			s.dropped++
+			return err
+		}
+	}
+
+	seg := s.segments[len(s.segments)-1]
+	n, err := seg.f.Write(data)
+	seg.size += int64(n)
+	s.size += int64(n)
+	if err != nil {
+		// a partial record is skipped by the checksum when read
+		s.dropped++
+		return err
+	}
+	seg.records++
+	s.records++
+
+	for s.size > s.maxSize && len(s.segments) > 1 {
+		s.dropped += s.segments[0].records
+		s.records -= s.segments[0].records
+		s.remove()
+	}
+	return nil
+}
+
+// Reads the oldest record and its tag, moving past it if consume is set.
+func (s *spill) read(consume bool) ([]byte, byte, error) {
+	for len(s.segments) > 0 {
+		seg := s.segments[0]
+		if seg.off >= seg.size {
+			s.remove()
+			continue
+		}
+
+		p, tag, n, err := seg.readAt(seg.off)
+		if err != nil {
+			// the rest of the segment cannot be trusted
+			s.dropped += seg.records
+			s.records -= seg.records
+			s.remove()
+			return nil, 0, ErrBadRecord
+		}
+
+		if consume {
+			seg.off += n
+			seg.records--
+			s.records--
+			if seg.off >= seg.size {
+				// fully read, the writer starts a new segment when needed
+				s.remove()
+			}
+		}
+		return p, tag, nil
+	}
+	return nil, 0, ErrIsEmpty
+}
+
+// Calls fn with the payload of every record not read yet, oldest first, until fn returns false.
+func (s *spill) rangeRecords(fn func(p []byte) bool) bool {
+	for _, seg := range s.segments {
+		for off := seg.off; off < seg.size; {
+			p, _, n, err := seg.readAt(off)
+			if err != nil {
+				break
+			}
+			if !fn(p) {
+				return false
+			}
+			off += n
+		}
+	}
+	return true
+}
+
+// Drops every record and removes every segment file.
+func (s *spill) reset() {
+	for len(s.segments) > 0 {
+		s.remove()
+	}
+	s.records = 0
+	s.size = 0
+}
+
+// Drops every record and removes the directory of the spill.
+func (s *spill) close() error {
+	s.reset()
+	return os.RemoveAll(s.dir)
+}
+
+// Starts a new segment.
+func (s *spill) rotate() error {
+	f, err := os.OpenFile(filepath.Join(s.dir, fmt.Sprintf("%08d.seg", s.seq)), os.O_CREATE|os.O_EXCL|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	s.seq++
+	s.segments = append(s.segments, &segment{f: f})
+	return nil
+}
+
+// Removes the oldest segment.
+func (s *spill) remove() {
+	seg := s.segments[0]
+	s.segments[0] = nil
+	s.segments = s.segments[1:]
+	s.size -= seg.size
+
+	_ = seg.f.Close()
+	_ = os.Remove(seg.f.Name())
+}
+
+// Returns the payload and the tag of the record at offset off, and the size of the whole record.
+func (seg *segment) readAt(off int64) (p []byte, tag byte, n int64, err error) {
+	h := make([]byte, ChecksumHeaderSize)
+	if _, err := seg.f.ReadAt(h, off); err != nil {
+		return nil, 0, 0, err
+	}
+
+	l, crc, err := parseChecksumHeader(h)
+	if err != nil || int64(l) > seg.size-off-ChecksumHeaderSize {
+		return nil, 0, 0, ErrBadRecord
+	}
+
+	p = make([]byte, l)
+	if _, err := seg.f.ReadAt(p, off+ChecksumHeaderSize); err != nil {
+		return nil, 0, 0, err
+	}
+	if crc32.Update(headerChecksum(h), crc32.IEEETable, p) != crc {
+		return nil, 0, 0, ErrBadRecord
+	}
+	return p, h[FramingChecksum.tagOffset()], int64(ChecksumHeaderSize + l), nil
+}
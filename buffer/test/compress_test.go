@@ -0,0 +1,150 @@
+package buffer_test
+
+import (
+	"compress/flate"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	. "gitlab-smartgaia.sercomm.com/s1util/logger/buffer"
+)
+
+// newCompressBuffer returns a buffer compressing records in batches of 4.
+func newCompressBuffer(t *testing.T, defaultSize int, maxSize int) *RingBuffer {
+	rb, _ := NewRingBuffer(defaultSize, maxSize, 1024)
+	if err := rb.SetCompression(flate.BestSpeed, 4); err != nil {
+		t.Fatalf("expect no error but got %v", err)
+	}
+	return rb
+}
+
+func jsonRecord(i int) []byte {
+	return []byte(fmt.Sprintf(`{"file":"logger.go:42","func":"main.run","level":"debug","msg":"record %03d","time":"2020-01-01T00:00:00Z"}`, i))
+}
+
+func TestRingBuffer_Compression(t *testing.T) {
+	rb := newCompressBuffer(t, 1024, 1024)
+
+	for i := 0; i < 10; i++ {
+		if err := rb.WriteRecord(jsonRecord(i)); err != nil {
+			t.Fatalf("expect no error but got %v", err)
+		}
+	}
+
+	// 2 batches are stored, the last 2 records wait for the next one
+	stats := rb.Stats()
+	if stats.Records != 10 || rb.RecordCount() != 10 {
+		t.Fatalf("expect 10 records but got %d", stats.Records)
+	}
+	if int64(stats.Length) >= stats.RawBytes/2 || stats.CompressionRatio() <= 2 {
+		t.Fatalf("expect records to be compressed but got %d bytes stored, ratio %f", stats.Length, stats.CompressionRatio())
+	}
+
+	var ranged []string
+	rb.RangeRecords(func(p []byte) bool {
+		ranged = append(ranged, string(p))
+		return true
+	})
+	if len(ranged) != 10 || ranged[9] != string(jsonRecord(9)) {
+		t.Fatalf("expect all records but got %d", len(ranged))
+	}
+
+	if p, err := rb.PeekRecord(); err != nil || string(p) != string(jsonRecord(0)) {
+		t.Fatalf("expect %s but got %q, %v", jsonRecord(0), p, err)
+	}
+	for i := 0; i < 10; i++ {
+		p, err := rb.ReadRecord()
+		if err != nil || string(p) != string(jsonRecord(i)) {
+			t.Fatalf("expect %s but got %q, %v", jsonRecord(i), p, err)
+		}
+	}
+	if _, err := rb.ReadRecord(); err != ErrIsEmpty || !rb.IsEmpty() {
+		t.Fatalf("expect ErrIsEmpty but got %v", err)
+	}
+}
+
+func TestRingBuffer_CompressionPending(t *testing.T) {
+	rb := newCompressBuffer(t, 1024, 1024)
+
+	_ = rb.WriteRecord([]byte("r000"))
+	if rb.IsEmpty() || rb.Length() != 0 {
+		t.Fatalf("expect a pending record outside of the buffer")
+	}
+	if stats := rb.Stats(); stats.CompressionRatio() != 1 {
+		t.Fatalf("expect ratio 1 before compressing but got %f", stats.CompressionRatio())
+	}
+
+	// a pending record can be read before its batch is complete
+	if p, err := rb.ReadRecord(); err != nil || string(p) != "r000" {
+		t.Fatalf("expect r000 but got %q, %v", p, err)
+	}
+
+	_ = rb.WriteRecord([]byte("r001"))
+	rb.Reset()
+	if !rb.IsEmpty() || rb.RecordCount() != 0 {
+		t.Fatalf("expect an empty buffer after reset")
+	}
+}
+
+func TestRingBuffer_CompressionOverwrite(t *testing.T) {
+	rb := newCompressBuffer(t, 256, 256)
+
+	for i := 0; i < 200; i++ {
+		_ = rb.WriteRecord([]byte(fmt.Sprintf("r%03d", i)))
+	}
+
+	// whole batches are overwritten, the newest records are kept in order
+	count := rb.RecordCount()
+	if count%4 != 0 || count < 8 || count > 196 {
+		t.Fatalf("expect a whole number of batches but got %d records", count)
+	}
+	for i := 200 - count; i < 200; i++ {
+		p, err := rb.ReadRecord()
+		if expected := fmt.Sprintf("r%03d", i); err != nil || string(p) != expected {
+			t.Fatalf("expect %q but got %q, %v", expected, p, err)
+		}
+	}
+}
+
+func TestRingBuffer_CompressionSpill(t *testing.T) {
+	dir, err := ioutil.TempDir("", "compress_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rb := newCompressBuffer(t, 256, 256)
+	if err := rb.SetSpill(dir, 1<<20); err != nil {
+		t.Fatalf("expect no error but got %v", err)
+	}
+
+	// a few batches fit in memory, the older ones are spilled
+	for i := 0; i < 20; i++ {
+		_ = rb.WriteRecord(jsonRecord(i))
+	}
+	if records, _ := rb.Spilled(); records == 0 {
+		t.Fatalf("expect spilled batches")
+	}
+	for i := 0; i < 20; i++ {
+		p, err := rb.ReadRecord()
+		if err != nil || string(p) != string(jsonRecord(i)) {
+			t.Fatalf("expect %s but got %q, %v", jsonRecord(i), p, err)
+		}
+	}
+}
+
+func TestRingBuffer_CompressionInvalid(t *testing.T) {
+	rb, _ := NewRingBuffer(64, 64, 0)
+	if err := rb.SetCompression(42, 4); err == nil {
+		t.Fatalf("expect an error for an invalid level")
+	}
+
+	// disabled compression stores records as they come
+	_ = rb.SetCompression(flate.BestSpeed, 0)
+	_ = rb.WriteRecord([]byte("abc"))
+	if !strings.HasSuffix(string(rb.Bytes()), "abc") {
+		t.Fatalf("expect an uncompressed record but got %q", rb.Bytes())
+	}
+}
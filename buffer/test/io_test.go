@@ -0,0 +1,209 @@
+package buffer_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	. "gitlab-smartgaia.sercomm.com/s1util/logger/buffer"
+)
+
+var (
+	_ io.ReadWriter      = (*RingBuffer)(nil)
+	_ io.ByteScanner     = (*RingBuffer)(nil)
+	_ io.ByteWriter      = (*RingBuffer)(nil)
+	_ io.StringWriter    = (*RingBuffer)(nil)
+	_ io.WriterTo        = (*RingBuffer)(nil)
+	_ io.ReaderFrom      = (*RingBuffer)(nil)
+	_ io.ReadCloser      = (*MPSCBuffer)(nil)
+	_ io.WriteCloser     = (*MPSCBuffer)(nil)
+	_ io.ReadWriteCloser = LogBuffer(nil)
+)
+
+// newWrappedBuffer returns a buffer of 16 bytes holding "0123456789", wrapping around the end of its single block.
+func newWrappedBuffer() *RingBuffer {
+	rb, _ := NewRingBuffer(16, 16, 0)
+	_, _ = rb.WriteString("abcdefghij")
+	_, _ = rb.Read(make([]byte, 10))
+	_, _ = rb.WriteString("0123456789")
+	return rb
+}
+
+func TestIO_EOF(t *testing.T) {
+	rb, _ := NewRingBuffer(16, 16, 0)
+	if n, err := rb.Read(make([]byte, 4)); n != 0 || err != io.EOF {
+		t.Fatalf("expect io.EOF but got %d, %v", n, err)
+	}
+	if _, err := rb.ReadByte(); err != io.EOF {
+		t.Fatalf("expect io.EOF but got %v", err)
+	}
+
+	// a read of nothing is not an error
+	if n, err := rb.Read(nil); n != 0 || err != nil {
+		t.Fatalf("expect no error but got %d, %v", n, err)
+	}
+}
+
+func TestIO_WriteString(t *testing.T) {
+	rb, _ := NewRingBuffer(16, 64, 16)
+	if n, err := io.WriteString(rb, "hello, world"); n != 12 || err != nil {
+		t.Fatalf("expect 12 bytes written but got %d, %v", n, err)
+	}
+	if string(rb.Bytes()) != "hello, world" {
+		t.Fatalf("expect hello, world but got %q", rb.Bytes())
+	}
+}
+
+func TestIO_UnreadByte(t *testing.T) {
+	rb := newWrappedBuffer()
+
+	if err := rb.UnreadByte(); err != ErrInvalidUnreadByte {
+		t.Fatalf("expect ErrInvalidUnreadByte but got %v", err)
+	}
+
+	// unread across the end of the buffer
+	_, _ = rb.Read(make([]byte, 6))
+	b, _ := rb.ReadByte()
+	if err := rb.UnreadByte(); err != nil || b != '6' {
+		t.Fatalf("expect 6 to be unread but got %q, %v", b, err)
+	}
+	if err := rb.UnreadByte(); err != ErrInvalidUnreadByte {
+		t.Fatalf("expect ErrInvalidUnreadByte but got %v", err)
+	}
+	if string(rb.Bytes()) != "6789" {
+		t.Fatalf("expect 6789 but got %q", rb.Bytes())
+	}
+
+	// the last byte makes the buffer empty, unreading it fills it again
+	_, _ = rb.Read(make([]byte, 3))
+	b, _ = rb.ReadByte()
+	if err := rb.UnreadByte(); err != nil || b != '9' || rb.IsEmpty() {
+		t.Fatalf("expect 9 to be unread but got %q, %v", b, err)
+	}
+
+	// any other operation in between forbids it
+	b, _ = rb.ReadByte()
+	_ = rb.WriteByte('x')
+	if err := rb.UnreadByte(); err != ErrInvalidUnreadByte {
+		t.Fatalf("expect ErrInvalidUnreadByte but got %v", err)
+	}
+}
+
+func TestIO_Peek(t *testing.T) {
+	rb := newWrappedBuffer()
+
+	p, err := rb.Peek(8)
+	if err != nil || string(p) != "01234567" {
+		t.Fatalf("expect 01234567 but got %q, %v", p, err)
+	}
+	p, err = rb.Peek(12)
+	if err != io.EOF || string(p) != "0123456789" {
+		t.Fatalf("expect 0123456789 and io.EOF but got %q, %v", p, err)
+	}
+	if _, err := rb.Peek(-1); err != ErrNegativeCount {
+		t.Fatalf("expect ErrNegativeCount but got %v", err)
+	}
+	if rb.Length() != 10 {
+		t.Fatalf("expect nothing to be consumed but got length %d", rb.Length())
+	}
+}
+
+func TestIO_Discard(t *testing.T) {
+	rb := newWrappedBuffer()
+
+	if n, err := rb.Discard(7); n != 7 || err != nil {
+		t.Fatalf("expect 7 bytes discarded but got %d, %v", n, err)
+	}
+	if string(rb.Bytes()) != "789" {
+		t.Fatalf("expect 789 but got %q", rb.Bytes())
+	}
+	if n, err := rb.Discard(5); n != 3 || err != io.EOF || !rb.IsEmpty() {
+		t.Fatalf("expect 3 bytes discarded and io.EOF but got %d, %v", n, err)
+	}
+	if _, err := rb.Discard(-1); err != ErrNegativeCount {
+		t.Fatalf("expect ErrNegativeCount but got %v", err)
+	}
+}
+
+func TestIO_WriteTo(t *testing.T) {
+	rb, _ := NewRingBuffer(4, 4096, 4)
+	data := strings.Repeat("0123456789", 100)
+	_, _ = rb.WriteString(data)
+	_, _ = rb.Read(make([]byte, 10))
+	_, _ = rb.WriteString("abcdefghij")
+
+	// the data spans several blocks
+	var out bytes.Buffer
+	if n, err := rb.WriteTo(&out); n != int64(len(data)) || err != nil {
+		t.Fatalf("expect %d bytes written but got %d, %v", len(data), n, err)
+	}
+	if out.String() != data[10:]+"abcdefghij" || !rb.IsEmpty() {
+		t.Fatalf("expect the whole content to be written and consumed")
+	}
+
+	// what was written is consumed even if w fails
+	_, _ = rb.WriteString(data)
+	w := &limitedWriter{n: 15}
+	if n, err := rb.WriteTo(w); n != 15 || err != errLimited {
+		t.Fatalf("expect 15 bytes written but got %d, %v", n, err)
+	}
+	if rb.Length() != len(data)-15 {
+		t.Fatalf("expect %d bytes left but got %d", len(data)-15, rb.Length())
+	}
+}
+
+func TestIO_ReadFrom(t *testing.T) {
+	data := strings.Repeat("0123456789", 1000)
+	readers := map[string]io.Reader{
+		"plain":    strings.NewReader(data),
+		"one byte": iotest.OneByteReader(strings.NewReader(data)),
+		"half":     iotest.HalfReader(strings.NewReader(data)),
+		"data err": iotest.DataErrReader(strings.NewReader(data)),
+	}
+	for name, r := range readers {
+		rb, _ := NewRingBuffer(16, 1<<20, 1024)
+		if n, err := io.Copy(rb, r); n != int64(len(data)) || err != nil {
+			t.Fatalf("%s: expect %d bytes copied but got %d, %v", name, len(data), n, err)
+		}
+		if string(rb.Bytes()) != data {
+			t.Fatalf("%s: expect the whole content to be read", name)
+		}
+	}
+
+	// errors other than io.EOF are returned
+	rb, _ := NewRingBuffer(16, 1<<20, 1024)
+	r := io.MultiReader(strings.NewReader("abc"), iotest.TimeoutReader(strings.NewReader("def")))
+	if n, err := rb.ReadFrom(iotest.OneByteReader(r)); n != 4 || err != iotest.ErrTimeout {
+		t.Fatalf("expect iotest.ErrTimeout after 4 bytes but got %d, %v", n, err)
+	}
+}
+
+func TestIO_ReadAll(t *testing.T) {
+	rb := newWrappedBuffer()
+
+	// readers reading up to io.EOF work as is
+	var out bytes.Buffer
+	if _, err := io.Copy(&out, iotest.OneByteReader(rb)); err != nil || out.String() != "0123456789" {
+		t.Fatalf("expect 0123456789 but got %q, %v", out.String(), err)
+	}
+}
+
+var errLimited = errors.New("limit reached")
+
+// limitedWriter accepts n bytes, then fails.
+type limitedWriter struct {
+	n int
+}
+
+func (w *limitedWriter) Write(p []byte) (int, error) {
+	if len(p) > w.n {
+		n := w.n
+		w.n = 0
+		return n, errLimited
+	}
+	w.n -= len(p)
+	return len(p), nil
+}
@@ -0,0 +1,35 @@
+//go:build go1.16
+// +build go1.16
+
+package buffer_test
+
+import (
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	. "gitlab-smartgaia.sercomm.com/s1util/logger/buffer"
+)
+
+func TestIO_Conformance(t *testing.T) {
+	data := strings.Repeat("0123456789", 500)
+
+	for _, size := range []int{16, 4096, 8192} {
+		// the content wraps around the end of the buffer unless it is large enough
+		rb, _ := NewRingBuffer(size, 1<<20, 1024)
+		_, _ = rb.WriteString(strings.Repeat("x", size/2))
+		_, _ = rb.Read(make([]byte, size/2))
+		_, _ = rb.WriteString(data)
+
+		if err := iotest.TestReader(rb, []byte(data)); err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+	}
+}
+
+func TestIO_ReadFromError(t *testing.T) {
+	rb, _ := NewRingBuffer(16, 64, 16)
+	if n, err := rb.ReadFrom(iotest.ErrReader(iotest.ErrTimeout)); n != 0 || err != iotest.ErrTimeout {
+		t.Fatalf("expect iotest.ErrTimeout but got %d, %v", n, err)
+	}
+}
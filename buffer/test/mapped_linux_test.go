@@ -0,0 +1,211 @@
+package buffer_test
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	. "gitlab-smartgaia.sercomm.com/s1util/logger/buffer"
+)
+
+// mappedFile returns the path of a buffer file in a new temporary directory, to be removed by the caller.
+func mappedFile(t *testing.T) (string, string) {
+	dir, err := ioutil.TempDir("", "mapped_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "buffer"), dir
+}
+
+// crashedCopy copies the file of a live buffer, as the file a crashed run leaves, and returns the path of the copy.
+func crashedCopy(t *testing.T, path string) string {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path+".crashed", data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path + ".crashed"
+}
+
+func writeRecords(rb *RingBuffer, from int, to int) {
+	for i := from; i < to; i++ {
+		_ = rb.WriteRecord([]byte(fmt.Sprintf("r%03d", i)))
+	}
+}
+
+func expectRecovered(t *testing.T, rec *Recovered, runID string, from int, to int) {
+	t.Helper()
+	if rec == nil {
+		t.Fatalf("expect records of run %s to be recovered", runID)
+	}
+	if rec.RunID != runID || len(rec.Records) != to-from {
+		t.Fatalf("expect %d records of run %s but got %d of run %s", to-from, runID, len(rec.Records), rec.RunID)
+	}
+	for i, p := range rec.Records {
+		if expected := fmt.Sprintf("r%03d", from+i); string(p) != expected {
+			t.Fatalf("expect %q but got %q", expected, p)
+		}
+	}
+}
+
+func TestMappedRingBuffer(t *testing.T) {
+	path, dir := mappedFile(t)
+	defer os.RemoveAll(dir)
+
+	rb, rec, err := OpenMappedRingBuffer(path, 256, "run1")
+	if err != nil || rec != nil {
+		t.Fatalf("expect a new buffer but got %v, %v", rec, err)
+	}
+	writeRecords(rb, 0, 10)
+	_, _ = rb.ReadRecord()
+
+	// opening the file left by a crash recovers the unread records
+	path = crashedCopy(t, path)
+	rb2, rec, err := OpenMappedRingBuffer(path, 256, "run2")
+	if err != nil {
+		t.Fatalf("expect no error but got %v", err)
+	}
+	expectRecovered(t, rec, "run1", 1, 10)
+	if !rb2.IsEmpty() {
+		t.Fatalf("expect the new buffer to start empty")
+	}
+
+	// a closed buffer has nothing to recover
+	writeRecords(rb2, 0, 5)
+	if err := rb2.Close(); err != nil {
+		t.Fatalf("expect no error but got %v", err)
+	}
+	rb3, rec, err := OpenMappedRingBuffer(path, 256, "run3")
+	if err != nil || rec != nil {
+		t.Fatalf("expect nothing to recover but got %v, %v", rec, err)
+	}
+
+	// the buffer keeps working in memory once closed
+	_ = rb3.Close()
+	writeRecords(rb3, 0, 1)
+	if p, err := rb3.ReadRecord(); err != nil || string(p) != "r000" {
+		t.Fatalf("expect r000 but got %q, %v", p, err)
+	}
+	_ = rb.Close()
+	_ = rb2.Close()
+}
+
+func TestMappedRingBuffer_Locked(t *testing.T) {
+	path, dir := mappedFile(t)
+	defer os.RemoveAll(dir)
+
+	rb, _, _ := OpenMappedRingBuffer(path, 256, "run1")
+	writeRecords(rb, 0, 3)
+
+	// the records of a live buffer are neither recovered nor overwritten by another
+	if _, rec, err := OpenMappedRingBuffer(path, 256, "run2"); !errors.Is(err, ErrLocked) || rec != nil {
+		t.Fatalf("expect ErrLocked but got %v, %v", rec, err)
+	}
+	if p, err := rb.ReadRecord(); err != nil || string(p) != "r000" {
+		t.Fatalf("expect r000 but got %q, %v", p, err)
+	}
+
+	// closing releases the lock
+	_ = rb.Close()
+	rb2, _, err := OpenMappedRingBuffer(path, 256, "run2")
+	if err != nil {
+		t.Fatalf("expect no error but got %v", err)
+	}
+	_ = rb2.Close()
+}
+
+func TestMappedRingBuffer_Overwrite(t *testing.T) {
+	path, dir := mappedFile(t)
+	defer os.RemoveAll(dir)
+
+	// every record takes 15 bytes, the newest 4 fit
+	rb, _, _ := OpenMappedRingBuffer(path, 60, "run1")
+	writeRecords(rb, 0, 23)
+
+	rb2, rec, err := OpenMappedRingBuffer(crashedCopy(t, path), 60, "run2")
+	if err != nil {
+		t.Fatalf("expect no error but got %v", err)
+	}
+	expectRecovered(t, rec, "run1", 19, 23)
+	_ = rb.Close()
+	_ = rb2.Close()
+}
+
+func TestMappedRingBuffer_TornRecord(t *testing.T) {
+	path, dir := mappedFile(t)
+	defer os.RemoveAll(dir)
+
+	rb, _, _ := OpenMappedRingBuffer(path, 256, "run1")
+	writeRecords(rb, 0, 3)
+
+	// corrupt the payload of the second record, as if the crash happened while writing it
+	pos := rb.GetR() + ChecksumHeaderSize + 4 + ChecksumHeaderSize
+	rb.SetByte(pos, 'x')
+
+	rb2, rec, err := OpenMappedRingBuffer(crashedCopy(t, path), 256, "run2")
+	if err != nil || rec == nil {
+		t.Fatalf("expect records to be recovered but got %v", err)
+	}
+	if len(rec.Records) != 2 || string(rec.Records[0]) != "r000" || string(rec.Records[1]) != "r002" {
+		t.Fatalf("expect r000 and r002 but got %q", rec.Records)
+	}
+	if rec.Skipped != ChecksumHeaderSize+4 {
+		t.Fatalf("expect %d skipped bytes but got %d", ChecksumHeaderSize+4, rec.Skipped)
+	}
+	_ = rb.Close()
+	_ = rb2.Close()
+}
+
+func TestMappedRingBuffer_NotABuffer(t *testing.T) {
+	path, dir := mappedFile(t)
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(path, make([]byte, 1024), 0600); err != nil {
+		t.Fatal(err)
+	}
+	rb, rec, err := OpenMappedRingBuffer(path, 256, "run1")
+	if err != nil || rec != nil {
+		t.Fatalf("expect a new buffer but got %v, %v", rec, err)
+	}
+	_ = rb.Close()
+}
+
+// Runs in a child process, which buffers records and gets killed.
+func TestMappedRingBuffer_CrashHelper(t *testing.T) {
+	path := os.Getenv("MAPPED_CRASH_FILE")
+	if path == "" {
+		t.Skip("only run by TestMappedRingBuffer_Crash")
+	}
+
+	rb, _, err := OpenMappedRingBuffer(path, 4096, "crashed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeRecords(rb, 0, 100)
+	_ = syscall.Kill(os.Getpid(), syscall.SIGKILL)
+}
+
+func TestMappedRingBuffer_Crash(t *testing.T) {
+	path, dir := mappedFile(t)
+	defer os.RemoveAll(dir)
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestMappedRingBuffer_CrashHelper$")
+	cmd.Env = append(os.Environ(), "MAPPED_CRASH_FILE="+path)
+	err := cmd.Run()
+	if status, ok := err.(*exec.ExitError); !ok || status.Sys().(syscall.WaitStatus).Signal() != syscall.SIGKILL {
+		t.Fatalf("expect the child process to be killed but got %v", err)
+	}
+
+	_, rec, err := OpenMappedRingBuffer(path, 4096, "next")
+	if err != nil {
+		t.Fatalf("expect no error but got %v", err)
+	}
+	expectRecovered(t, rec, "crashed", 0, 100)
+}
@@ -0,0 +1,176 @@
+package buffer_test
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+
+	. "gitlab-smartgaia.sercomm.com/s1util/logger/buffer"
+)
+
+func TestMPSCBuffer_interface(t *testing.T) {
+	var _ LogBuffer = NewMPSCBuffer(1, 1)
+}
+
+func TestMPSCBuffer_WriteRead(t *testing.T) {
+	mb := NewMPSCBuffer(4, 64)
+
+	if !mb.IsEmpty() || mb.Length() != 0 || mb.Capacity() != 64 {
+		t.Fatalf("expect empty buffer of 64 bytes but got %s", mb)
+	}
+
+	buf := make([]byte, 64)
+	if _, err := mb.Read(buf); err != io.EOF {
+		t.Fatalf("expect io.EOF but got %v", err)
+	}
+
+	n, err := mb.Write([]byte("abcd"))
+	if n != 4 || err != nil {
+		t.Fatalf("write failed: %d, %v", n, err)
+	}
+	n, err = mb.WriteBatch([]byte("ef"), []byte("gh"))
+	if n != 4 || err != nil {
+		t.Fatalf("write failed: %d, %v", n, err)
+	}
+	if mb.Length() != 8 {
+		t.Fatalf("expect len 8 bytes but got %d", mb.Length())
+	}
+
+	// reads continue across records
+	n, err = mb.Read(buf[:6])
+	if n != 6 || err != nil || string(buf[:6]) != "abcdef" {
+		t.Fatalf("expect abcdef but got %q, %v", buf[:n], err)
+	}
+	if mb.Length() != 2 {
+		t.Fatalf("expect len 2 bytes but got %d", mb.Length())
+	}
+	n, err = mb.Read(buf)
+	if n != 2 || err != nil || string(buf[:2]) != "gh" {
+		t.Fatalf("expect gh but got %q, %v", buf[:n], err)
+	}
+	if !mb.IsEmpty() {
+		t.Fatalf("expect IsEmpty is true but got false")
+	}
+}
+
+func TestMPSCBuffer_OverwriteOldest(t *testing.T) {
+	// limited by bytes
+	mb := NewMPSCBuffer(64, 40)
+	for c := byte('a'); c <= 'j'; c++ {
+		_, _ = mb.Write(bytes.Repeat([]byte{c}, 10))
+	}
+	if !mb.IsFull() || mb.Length() != 40 {
+		t.Fatalf("expect len 40 bytes but got %d", mb.Length())
+	}
+	buf := make([]byte, 64)
+	n, _ := mb.Read(buf)
+	if expect := "gggggggggghhhhhhhhhhiiiiiiiiiijjjjjjjjjj"; string(buf[:n]) != expect {
+		t.Fatalf("expect %s but got %s", expect, buf[:n])
+	}
+
+	// limited by slots
+	mb = NewMPSCBuffer(4, 1024)
+	for c := byte('a'); c <= 'j'; c++ {
+		_, _ = mb.Write([]byte{c})
+	}
+	n, _ = mb.Read(buf)
+	if string(buf[:n]) != "ghij" {
+		t.Fatalf("expect ghij but got %s", buf[:n])
+	}
+
+	// a partially read record is not dropped
+	mb = NewMPSCBuffer(4, 8)
+	_, _ = mb.Write([]byte("abcd"))
+	_, _ = mb.Read(buf[:2])
+	_, _ = mb.Write([]byte("efgh"))
+	_, _ = mb.Write([]byte("ijkl"))
+	n, _ = mb.Read(buf)
+	if string(buf[:n]) != "cdijkl" {
+		t.Fatalf("expect cdijkl but got %s", buf[:n])
+	}
+}
+
+func TestMPSCBuffer_TooLarge(t *testing.T) {
+	mb := NewMPSCBuffer(4, 8)
+	if _, err := mb.Write([]byte(strings.Repeat("a", 9))); err != ErrTooLarge {
+		t.Fatalf("expect ErrTooLarge but got %v", err)
+	}
+	if !mb.IsEmpty() {
+		t.Fatalf("expect IsEmpty is true but got false")
+	}
+}
+
+func TestMPSCBuffer_Reset(t *testing.T) {
+	mb := NewMPSCBuffer(4, 64)
+	_, _ = mb.Write([]byte("abcd"))
+	_, _ = mb.Write([]byte("efgh"))
+	_, _ = mb.Read(make([]byte, 2))
+	mb.Reset()
+	if !mb.IsEmpty() || mb.Length() != 0 {
+		t.Fatalf("expect IsEmpty is true but got %s", mb)
+	}
+}
+
+func TestMPSCBuffer_ConcurrentProducers(t *testing.T) {
+	const (
+		writers = 8
+		records = 500
+	)
+
+	mb := NewMPSCBuffer(16, 256)
+
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(c byte) {
+			defer wg.Done()
+			for j := 0; j < records; j++ {
+				if _, err := mb.WriteBatch(makeRecord(c, 1+j%24)...); err != nil {
+					t.Errorf("write failed: %v", err)
+					return
+				}
+			}
+		}(byte('a' + i))
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	for finished := false; !finished; {
+		select {
+		case <-done:
+			finished = true
+		default:
+		}
+
+		data, err := readRecord(mb)
+		if err == io.EOF {
+			continue
+		}
+		if err != nil {
+			t.Fatalf("read failed: %v", err)
+		}
+		if len(data) == 0 || !bytes.Equal(data, bytes.Repeat(data[:1], len(data))) {
+			t.Fatalf("expect a whole log but got %q", data)
+		}
+	}
+}
+
+func BenchmarkMPSCBuffer_WriteParallel(b *testing.B) {
+	mb := NewMPSCBuffer(512, 64*1024)
+
+	record := makeRecord('a', 128)
+	b.SetBytes(int64(4 + 128))
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			_, _ = mb.WriteBatch(record...)
+		}
+	})
+}
@@ -0,0 +1,234 @@
+package buffer_test
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	. "gitlab-smartgaia.sercomm.com/s1util/logger/buffer"
+)
+
+// newFullBuffer returns a buffer of 18 bytes at maximum size, holding the records r000 and r001.
+func newFullBuffer(t *testing.T, policy OverflowPolicy, timeout time.Duration) *RingBuffer {
+	rb, _ := NewRingBuffer(18, 18, 0)
+	rb.SetOverflowPolicy(policy, timeout)
+	for i := 0; i < 2; i++ {
+		if err := rb.WriteRecord([]byte(fmt.Sprintf("r%03d", i))); err != nil {
+			t.Fatalf("expect no error but got %v", err)
+		}
+	}
+	if !rb.IsFull() {
+		t.Fatalf("expect a full buffer")
+	}
+	return rb
+}
+
+func expectOldest(t *testing.T, rb *RingBuffer, expected string) {
+	t.Helper()
+	if p, err := rb.PeekRecord(); err != nil || string(p) != expected {
+		t.Fatalf("expect %q but got %q, %v", expected, p, err)
+	}
+}
+
+func TestOverflow_DropOldest(t *testing.T) {
+	rb := newFullBuffer(t, OverflowDropOldest, 0)
+
+	if err := rb.WriteRecord([]byte("r002")); err != nil {
+		t.Fatalf("expect no error but got %v", err)
+	}
+	expectOldest(t, rb, "r001")
+	if rb.Stats().Dropped != 0 {
+		t.Fatalf("expect no dropped write but got %d", rb.Stats().Dropped)
+	}
+}
+
+func TestOverflow_DropNewest(t *testing.T) {
+	rb := newFullBuffer(t, OverflowDropNewest, 0)
+
+	if err := rb.WriteRecord([]byte("r002")); err != nil {
+		t.Fatalf("expect no error but got %v", err)
+	}
+	if n, err := rb.Write([]byte("abc")); n != 3 || err != nil {
+		t.Fatalf("expect the write to be reported as done but got %d, %v", n, err)
+	}
+	if err := rb.WriteByte('a'); err != nil {
+		t.Fatalf("expect no error but got %v", err)
+	}
+
+	expectOldest(t, rb, "r000")
+	if rb.RecordCount() != 2 || rb.Stats().Dropped != 3 {
+		t.Fatalf("expect 2 records and 3 dropped writes but got %d and %d", rb.RecordCount(), rb.Stats().Dropped)
+	}
+
+	// room made by a reader is used again
+	_, _ = rb.ReadRecord()
+	_ = rb.WriteRecord([]byte("r003"))
+	expectOldest(t, rb, "r001")
+	if rb.RecordCount() != 2 {
+		t.Fatalf("expect 2 records but got %d", rb.RecordCount())
+	}
+}
+
+func TestOverflow_Error(t *testing.T) {
+	rb := newFullBuffer(t, OverflowError, 0)
+
+	if err := rb.WriteRecord([]byte("r002")); err != ErrFull {
+		t.Fatalf("expect ErrFull but got %v", err)
+	}
+	if n, err := rb.Write([]byte("abc")); n != 0 || err != ErrFull {
+		t.Fatalf("expect ErrFull but got %d, %v", n, err)
+	}
+	expectOldest(t, rb, "r000")
+	if rb.Stats().Dropped != 2 {
+		t.Fatalf("expect 2 failed writes but got %d", rb.Stats().Dropped)
+	}
+
+	// data larger than the buffer is still too large
+	if err := rb.WriteRecord(make([]byte, 32)); err != ErrTooLarge {
+		t.Fatalf("expect ErrTooLarge but got %v", err)
+	}
+}
+
+func TestOverflow_BlockTimeout(t *testing.T) {
+	rb := newFullBuffer(t, OverflowBlock, 20*time.Millisecond)
+
+	start := time.Now()
+	if err := rb.WriteRecord([]byte("r002")); err != ErrFull {
+		t.Fatalf("expect ErrFull but got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Fatalf("expect the write to wait for the timeout but it took %v", elapsed)
+	}
+	expectOldest(t, rb, "r000")
+	if rb.Stats().Dropped != 1 {
+		t.Fatalf("expect 1 failed write but got %d", rb.Stats().Dropped)
+	}
+}
+
+func TestOverflow_BlockUntilRead(t *testing.T) {
+	rb := newFullBuffer(t, OverflowBlock, 5*time.Second)
+
+	done := make(chan error)
+	go func() {
+		done <- rb.WriteRecord([]byte("r002"))
+	}()
+
+	// the writer waits while nobody reads
+	select {
+	case err := <-done:
+		t.Fatalf("expect the write to wait but got %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	if p, err := rb.ReadRecord(); err != nil || string(p) != "r000" {
+		t.Fatalf("expect r000 but got %q, %v", p, err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("expect no error but got %v", err)
+	}
+	expectOldest(t, rb, "r001")
+	if rb.RecordCount() != 2 {
+		t.Fatalf("expect 2 records but got %d", rb.RecordCount())
+	}
+}
+
+func TestOverflow_BlockConcurrent(t *testing.T) {
+	rb, _ := NewRingBuffer(64, 64, 0)
+	rb.SetOverflowPolicy(OverflowBlock, 5*time.Second)
+
+	// nothing is lost while a reader keeps up
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				_ = rb.WriteRecord([]byte(fmt.Sprintf("w%d-%03d", w, i)))
+			}
+		}(w)
+	}
+
+	read := 0
+	for read < 400 {
+		if _, err := rb.ReadRecord(); err == nil {
+			read++
+		} else {
+			runtime.Gosched()
+		}
+	}
+	wg.Wait()
+	if dropped := rb.Stats().Dropped; dropped != 0 {
+		t.Fatalf("expect no dropped write but got %d", dropped)
+	}
+}
+
+func TestOverflow_BlockReset(t *testing.T) {
+	rb := newFullBuffer(t, OverflowBlock, 5*time.Second)
+
+	done := make(chan error)
+	go func() {
+		done <- rb.WriteRecord([]byte("r002"))
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	rb.Reset()
+	if err := <-done; err != nil {
+		t.Fatalf("expect no error but got %v", err)
+	}
+	expectOldest(t, rb, "r002")
+}
+
+func TestOverflow_Freed(t *testing.T) {
+	rb := newFullBuffer(t, OverflowError, 0)
+	if err := rb.WriteRecord([]byte("r002")); err != ErrFull {
+		t.Fatalf("expect ErrFull but got %v", err)
+	}
+
+	// the channel is closed by the next read, and renewed for the next wait
+	freed := rb.Freed()
+	select {
+	case <-freed:
+		t.Fatalf("expect no room before a read")
+	default:
+	}
+	_, _ = rb.ReadRecord()
+	select {
+	case <-freed:
+	default:
+		t.Fatalf("expect room after a read")
+	}
+	if err := rb.WriteRecord([]byte("r002")); err != nil {
+		t.Fatalf("expect no error but got %v", err)
+	}
+	if rb.Freed() == freed {
+		t.Fatalf("expect a new channel")
+	}
+}
+
+func TestOverflow_Growing(t *testing.T) {
+	// the policy only applies once the maximum size is reached
+	rb, _ := NewRingBuffer(18, 72, 18)
+	rb.SetOverflowPolicy(OverflowError, 0)
+	for i := 0; i < 8; i++ {
+		if err := rb.WriteRecord([]byte(fmt.Sprintf("r%03d", i))); err != nil {
+			t.Fatalf("expect no error but got %v", err)
+		}
+	}
+	if err := rb.WriteRecord([]byte("r008")); err != ErrFull {
+		t.Fatalf("expect ErrFull but got %v", err)
+	}
+}
+
+func TestParseOverflowPolicy(t *testing.T) {
+	for _, policy := range []OverflowPolicy{OverflowDropOldest, OverflowDropNewest, OverflowBlock, OverflowError} {
+		if p, err := ParseOverflowPolicy(policy.String()); err != nil || p != policy {
+			t.Fatalf("expect %v but got %v, %v", policy, p, err)
+		}
+	}
+	if _, err := ParseOverflowPolicy("drop-all"); !errors.Is(err, ErrUnknownPolicy) {
+		t.Fatalf("expect ErrUnknownPolicy but got %v", err)
+	}
+}
@@ -0,0 +1,151 @@
+package buffer_test
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+
+	. "gitlab-smartgaia.sercomm.com/s1util/logger/buffer"
+)
+
+const (
+	levelWarn  Level = 4
+	levelDebug Level = 6
+	levelTrace Level = 7
+)
+
+// newPriorityBuffer returns a buffer of 72 bytes at maximum size evicting the least severe records first.
+func newPriorityBuffer(framing Framing) *RingBuffer {
+	rb, _ := NewRingBuffer(72, 72, 0)
+	return rb.SetFraming(framing).SetOverflowPolicy(OverflowDropLowest, 0)
+}
+
+func readAll(rb *RingBuffer) []string {
+	var records []string
+	for {
+		p, err := rb.ReadRecord()
+		if err == ErrIsEmpty {
+			return records
+		}
+		if err == nil {
+			records = append(records, string(p))
+		}
+	}
+}
+
+func TestDropLowest(t *testing.T) {
+	rb := newPriorityBuffer(FramingLength)
+
+	// every record takes 9 bytes, 8 of them fit
+	levels := []Level{levelWarn, levelTrace, levelDebug, levelTrace, levelWarn, levelDebug, levelTrace, levelWarn}
+	for i, level := range levels {
+		_ = rb.WriteRecordLevel([]byte(fmt.Sprintf("r%03d", i)), level)
+	}
+	if !rb.IsFull() {
+		t.Fatalf("expect a full buffer")
+	}
+
+	// the oldest trace record makes room for a warning
+	_ = rb.WriteRecordLevel([]byte("r008"), levelWarn)
+	if records := fmt.Sprint(rb.RecordCount(), " ", readAll(rb)); records != "8 [r000 r002 r003 r004 r005 r006 r007 r008]" {
+		t.Fatalf("expect r001 to be evicted but got %s", records)
+	}
+}
+
+func TestDropLowest_LevelAfterLevel(t *testing.T) {
+	rb := newPriorityBuffer(FramingLength)
+
+	levels := []Level{levelTrace, levelWarn, levelDebug, levelWarn, levelTrace, levelWarn, levelDebug, LevelNone}
+	for i, level := range levels {
+		_ = rb.WriteRecordLevel([]byte(fmt.Sprintf("r%03d", i)), level)
+	}
+
+	// a record of 32 bytes needs 5 records to go: both traces, both debugs, then the oldest warning
+	_ = rb.WriteRecordLevel([]byte(fmt.Sprintf("%032d", 8)), levelWarn)
+	records := readAll(rb)
+	if fmt.Sprint(records[:3]) != "[r003 r005 r007]" || len(records) != 4 {
+		t.Fatalf("expect r003, r005, r007 and the new record but got %v", records)
+	}
+}
+
+func TestDropLowest_SameLevel(t *testing.T) {
+	rb := newPriorityBuffer(FramingLength)
+
+	// with a single level, the oldest records are evicted
+	for i := 0; i < 20; i++ {
+		_ = rb.WriteRecordLevel([]byte(fmt.Sprintf("r%03d", i)), levelDebug)
+	}
+	if records := fmt.Sprint(readAll(rb)); records != "[r012 r013 r014 r015 r016 r017 r018 r019]" {
+		t.Fatalf("expect the newest 8 records but got %s", records)
+	}
+}
+
+func TestDropLowest_Checksum(t *testing.T) {
+	rb := newPriorityBuffer(FramingChecksum)
+
+	// every record takes 15 bytes, 4 of them fit
+	levels := []Level{levelWarn, levelTrace, levelWarn, levelTrace}
+	for i, level := range levels {
+		_ = rb.WriteRecordLevel([]byte(fmt.Sprintf("r%03d", i)), level)
+	}
+
+	// corrupt the first warning, dropping it leaves enough room
+	rb.SetByte(rb.GetR()+ChecksumHeaderSize, 'x')
+	_ = rb.WriteRecordLevel([]byte("r004"), levelWarn)
+	if records := fmt.Sprint(readAll(rb)); records != "[r001 r002 r003 r004]" {
+		t.Fatalf("expect r001 to r004 but got %s", records)
+	}
+	if rb.SkippedBytes() != ChecksumHeaderSize+4 {
+		t.Fatalf("expect %d skipped bytes but got %d", ChecksumHeaderSize+4, rb.SkippedBytes())
+	}
+}
+
+func TestDropLowest_Order(t *testing.T) {
+	rb, _ := NewRingBuffer(256, 256, 0)
+	rb.SetOverflowPolicy(OverflowDropLowest, 0)
+	r := rand.New(rand.NewSource(1))
+
+	// warnings are rare enough to be all kept, the other records keep their order
+	var warnings []string
+	for i := 0; i < 1000; i++ {
+		p := fmt.Sprintf("%d-%s", i, make([]byte, r.Intn(8)))
+		level := levelTrace - Level(r.Intn(2))
+		if i%25 == 0 {
+			level = levelWarn
+			warnings = append(warnings, p)
+		}
+		_ = rb.WriteRecordLevel([]byte(p), level)
+	}
+
+	last := -1
+	var kept []string
+	for _, p := range readAll(rb) {
+		var i int
+		fmt.Sscanf(p, "%d-", &i)
+		if i <= last {
+			t.Fatalf("expect records in order but got %d after %d", i, last)
+		}
+		last = i
+		if i%25 == 0 {
+			kept = append(kept, p)
+		}
+	}
+	if len(kept) < 10 || fmt.Sprint(kept) != fmt.Sprint(warnings[len(warnings)-len(kept):]) {
+		t.Fatalf("expect the newest warnings to be kept but got %d of them", len(kept))
+	}
+}
+
+func TestDropLowest_Levels(t *testing.T) {
+	// the level does not show in the payload
+	mb := NewMPSCBuffer(4, 64)
+	_ = mb.WriteRecordLevel([]byte("abc"), levelTrace)
+	if p, err := mb.ReadRecord(); err != nil || string(p) != "abc" {
+		t.Fatalf("expect abc but got %q, %v", p, err)
+	}
+
+	rb := newPriorityBuffer(FramingChecksum)
+	_ = rb.WriteRecordLevel([]byte("abc"), levelTrace)
+	if p, err := rb.ReadRecord(); err != nil || string(p) != "abc" {
+		t.Fatalf("expect abc but got %q, %v", p, err)
+	}
+}
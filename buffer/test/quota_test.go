@@ -0,0 +1,138 @@
+package buffer_test
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	. "gitlab-smartgaia.sercomm.com/s1util/logger/buffer"
+)
+
+// newQuotaBuffer returns a buffer of 72 bytes at maximum size with given quotas, every record taking 9 bytes.
+func newQuotaBuffer(t *testing.T, policy OverflowPolicy, quotas ...Quota) *RingBuffer {
+	rb, _ := NewRingBuffer(72, 72, 0)
+	rb.SetOverflowPolicy(policy, 0)
+	if err := rb.SetQuotas(quotas...); err != nil {
+		t.Fatalf("expect no error but got %v", err)
+	}
+	return rb
+}
+
+func writeTagged(rb *RingBuffer, i int, level Level, category string) {
+	_ = rb.WriteRecordCategory([]byte(fmt.Sprintf("r%03d", i)), level, category)
+}
+
+func TestQuota_LevelMinimum(t *testing.T) {
+	rb := newQuotaBuffer(t, OverflowDropOldest, Quota{Level: levelWarn, Min: 0.25})
+
+	writeTagged(rb, 0, levelWarn, "")
+	writeTagged(rb, 1, levelWarn, "")
+	for i := 2; i < 22; i++ {
+		writeTagged(rb, i, levelDebug, "")
+	}
+
+	// the warnings hold 25% of the buffer, the oldest debug records go instead
+	if records := fmt.Sprint(readAll(rb)); records != "[r000 r001 r016 r017 r018 r019 r020 r021]" {
+		t.Fatalf("expect both warnings and the newest debug records but got %s", records)
+	}
+}
+
+func TestQuota_LevelMinimumExceeded(t *testing.T) {
+	rb := newQuotaBuffer(t, OverflowDropOldest, Quota{Level: levelWarn, Min: 0.25})
+
+	// beyond their minimum, warnings are evicted oldest first as usual
+	for i := 0; i < 8; i++ {
+		writeTagged(rb, i, levelWarn, "")
+	}
+	writeTagged(rb, 8, levelDebug, "")
+	if records := fmt.Sprint(readAll(rb)); records != "[r001 r002 r003 r004 r005 r006 r007 r008]" {
+		t.Fatalf("expect the oldest warning to be evicted but got %s", records)
+	}
+}
+
+func TestQuota_CategoryMaximum(t *testing.T) {
+	rb := newQuotaBuffer(t, OverflowDropOldest, Quota{Category: "db", Max: 0.25})
+
+	writeTagged(rb, 0, levelDebug, "")
+	for i := 1; i < 8; i++ {
+		writeTagged(rb, i, levelDebug, "db")
+	}
+
+	// the chatty category is cut back to 25% of the buffer, older records of other categories stay
+	writeTagged(rb, 8, levelDebug, "api")
+	if records := fmt.Sprint(readAll(rb)); records != "[r000 r006 r007 r008]" {
+		t.Fatalf("expect r000, r006, r007 and r008 but got %s", records)
+	}
+}
+
+func TestQuota_CategoryMaximumIncoming(t *testing.T) {
+	rb := newQuotaBuffer(t, OverflowDropOldest, Quota{Category: "db", Max: 0.25})
+
+	for i := 0; i < 8; i++ {
+		writeTagged(rb, i, levelDebug, "")
+	}
+
+	// the incoming record counts against its quota
+	writeTagged(rb, 8, levelDebug, "db")
+	writeTagged(rb, 9, levelDebug, "db")
+	writeTagged(rb, 10, levelDebug, "db")
+	records := readAll(rb)
+	if fmt.Sprint(records) != "[r002 r003 r004 r005 r006 r007 r009 r010]" {
+		t.Fatalf("expect r008 to be evicted but got %v", records)
+	}
+}
+
+func TestQuota_DropLowest(t *testing.T) {
+	rb := newQuotaBuffer(t, OverflowDropLowest, Quota{Level: levelTrace, Min: 0.25})
+
+	for i := 0; i < 3; i++ {
+		writeTagged(rb, i, levelTrace, "")
+	}
+	for i := 3; i < 10; i++ {
+		writeTagged(rb, i, levelDebug, "")
+	}
+
+	// trace records go first, down to their minimum, then debug records
+	if records := fmt.Sprint(readAll(rb)); records != "[r001 r002 r004 r005 r006 r007 r008 r009]" {
+		t.Fatalf("expect r000 and r003 to be evicted but got %s", records)
+	}
+}
+
+func TestQuota_Stats(t *testing.T) {
+	rb := newQuotaBuffer(t, OverflowDropOldest, Quota{Level: levelWarn, Min: 0.3}, Quota{Category: "db", Max: 0.5})
+
+	writeTagged(rb, 0, levelWarn, "db")
+	writeTagged(rb, 1, levelDebug, "db")
+	writeTagged(rb, 2, levelWarn, "")
+
+	usage := rb.Stats().Quotas
+	if len(usage) != 2 {
+		t.Fatalf("expect the usage of 2 quotas but got %d", len(usage))
+	}
+	if usage[0].Level != levelWarn || usage[0].Bytes != 18 || usage[0].Share != 0.25 {
+		t.Fatalf("expect warnings to hold 18 bytes but got %+v", usage[0])
+	}
+	if usage[1].Category != "db" || usage[1].Bytes != 18 || usage[1].Share != 0.25 {
+		t.Fatalf("expect db to hold 18 bytes but got %+v", usage[1])
+	}
+}
+
+func TestQuota_Invalid(t *testing.T) {
+	rb, _ := NewRingBuffer(64, 64, 0)
+	invalid := [][]Quota{
+		{{Level: levelWarn, Min: 1.5}},
+		{{Level: levelWarn, Min: 0.5, Max: 0.25}},
+		{{Level: levelWarn, Min: 0.6}, {Level: levelDebug, Min: 0.6}},
+		{{Level: MaxLevel + 1}},
+	}
+	for i := 0; i < 16; i++ {
+		invalid[3] = append(invalid[3], Quota{Category: fmt.Sprint(i)})
+	}
+	invalid = append(invalid, invalid[3][1:])
+
+	for _, quotas := range invalid {
+		if err := rb.SetQuotas(quotas...); !errors.Is(err, ErrInvalidQuota) {
+			t.Fatalf("expect ErrInvalidQuota for %+v but got %v", quotas, err)
+		}
+	}
+}
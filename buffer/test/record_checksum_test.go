@@ -0,0 +1,177 @@
+package buffer_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"testing"
+
+	. "gitlab-smartgaia.sercomm.com/s1util/logger/buffer"
+)
+
+func newChecksumBuffer(size int) *RingBuffer {
+	rb, _ := NewRingBuffer(size, size, 1024)
+	return rb.SetFraming(FramingChecksum)
+}
+
+// expectRecords reads records until the buffer is empty and compares them with expected.
+func expectRecords(t *testing.T, rb *RingBuffer, expected ...string) {
+	t.Helper()
+	for _, e := range expected {
+		p, err := rb.ReadRecord()
+		if err != nil || string(p) != e {
+			t.Fatalf("expect %q but got %q, %v", e, p, err)
+		}
+	}
+	if _, err := rb.ReadRecord(); err != ErrIsEmpty {
+		t.Fatalf("expect ErrIsEmpty but got %v", err)
+	}
+}
+
+func TestRingBuffer_ChecksumRecord(t *testing.T) {
+	rb := newChecksumBuffer(64)
+
+	_ = rb.WriteRecord([]byte("abc"))
+	_ = rb.WriteRecord([]byte("defg"))
+
+	data := rb.Bytes()
+	if len(data) != 2*ChecksumHeaderSize+7 || data[0] != RecordMagic || data[1] != RecordVersion {
+		t.Fatalf("expect checksummed records but got %v", data)
+	}
+	if l := binary.LittleEndian.Uint32(data[3:7]); l != 3 || data[2] != 0 {
+		t.Fatalf("expect length 3 and no tag but got %d, %d", l, data[2])
+	}
+	if rb.RecordCount() != 2 {
+		t.Fatalf("expect 2 records but got %d", rb.RecordCount())
+	}
+
+	expectRecords(t, rb, "abc", "defg")
+	if rb.SkippedBytes() != 0 {
+		t.Fatalf("expect no skipped bytes but got %d", rb.SkippedBytes())
+	}
+}
+
+func TestRingBuffer_ChecksumVersion1(t *testing.T) {
+	rb := newChecksumBuffer(64)
+
+	// a record of version 1, written before the tag had a byte of its own
+	old := []byte{RecordMagic, 1, 3, 0, 0, 0, 0, 0, 0, 0}
+	binary.LittleEndian.PutUint32(old[6:10], crc32.Update(crc32.ChecksumIEEE(old[1:6]), crc32.IEEETable, []byte("old")))
+	_, _ = rb.Write(append(old, "old"...))
+	_ = rb.WriteRecordLevel([]byte("new"), levelTrace)
+
+	if rb.RecordCount() != 2 {
+		t.Fatalf("expect 2 records but got %d", rb.RecordCount())
+	}
+	expectRecords(t, rb, "old", "new")
+	if rb.SkippedBytes() != 0 {
+		t.Fatalf("expect no skipped bytes but got %d", rb.SkippedBytes())
+	}
+}
+
+func TestRingBuffer_ChecksumSkipsGarbage(t *testing.T) {
+	rb := newChecksumBuffer(128)
+
+	// garbage between records, including a magic byte and a header claiming a huge length
+	garbage := []byte{1, 2, RecordMagic, RecordVersion, 0xff, 0xff, 0xff, 0x7f, 3}
+	_ = rb.WriteRecord([]byte("abc"))
+	_, _ = rb.Write(garbage)
+	_ = rb.WriteRecord([]byte("defg"))
+
+	if rb.RecordCount() != 2 {
+		t.Fatalf("expect 2 records but got %d", rb.RecordCount())
+	}
+	expectRecords(t, rb, "abc", "defg")
+	if rb.SkippedBytes() != len(garbage) {
+		t.Fatalf("expect %d skipped bytes but got %d", len(garbage), rb.SkippedBytes())
+	}
+}
+
+func TestRingBuffer_ChecksumCorruptedRecord(t *testing.T) {
+	corruptions := map[string]int{
+		"magic":   0,
+		"version": 1,
+		"tag":     2,
+		"length":  3,
+		"crc":     7,
+		"payload": ChecksumHeaderSize + 1,
+	}
+
+	for name, offset := range corruptions {
+		rb := newChecksumBuffer(128)
+		_ = rb.WriteRecord([]byte("abc"))
+		_ = rb.WriteRecord([]byte("defg"))
+		_ = rb.WriteRecord([]byte("hij"))
+
+		// corrupt the second record
+		pos := rb.GetR() + ChecksumHeaderSize + 3 + offset
+		rb.SetByte(pos, rb.GetBuf()[pos]^0x10)
+
+		if rb.RecordCount() != 2 {
+			t.Fatalf("%s: expect 2 records but got %d", name, rb.RecordCount())
+		}
+		expectRecords(t, rb, "abc", "hij")
+		if rb.SkippedBytes() != ChecksumHeaderSize+4 {
+			t.Fatalf("%s: expect %d skipped bytes but got %d", name, ChecksumHeaderSize+4, rb.SkippedBytes())
+		}
+	}
+}
+
+func TestRingBuffer_ChecksumTrailingGarbage(t *testing.T) {
+	rb := newChecksumBuffer(64)
+
+	_ = rb.WriteRecord([]byte("abc"))
+	_, _ = rb.Write([]byte("garbage"))
+
+	p, err := rb.ReadRecord()
+	if err != nil || string(p) != "abc" {
+		t.Fatalf("expect abc but got %q, %v", p, err)
+	}
+	if _, err := rb.ReadRecord(); err != ErrBadRecord {
+		t.Fatalf("expect ErrBadRecord but got %v", err)
+	}
+	if !rb.IsEmpty() || rb.SkippedBytes() != 7 {
+		t.Fatalf("expect an empty buffer and 7 skipped bytes but got %d bytes and %d skipped", rb.Length(), rb.SkippedBytes())
+	}
+}
+
+func TestRingBuffer_ChecksumOverwrite(t *testing.T) {
+	rb := newChecksumBuffer(51)
+
+	// every record takes 17 bytes, the buffer is full after the first record and the garbage
+	_ = rb.WriteRecord([]byte("aaaaaa"))
+	_, _ = rb.Write(bytes.Repeat([]byte{RecordMagic}, 17))
+	_ = rb.WriteRecord([]byte("bbbbbb"))
+
+	// evicting the first record leaves the garbage at the read pointer, which is skipped
+	_ = rb.WriteRecord([]byte("cccccc"))
+	_ = rb.WriteRecord([]byte("dddddd"))
+
+	if rb.SkippedBytes() != 17 {
+		t.Fatalf("expect 17 skipped bytes but got %d", rb.SkippedBytes())
+	}
+	expectRecords(t, rb, "bbbbbb", "cccccc", "dddddd")
+}
+
+func TestRingBuffer_ChecksumWrapAround(t *testing.T) {
+	rb := newChecksumBuffer(32)
+
+	for i := 0; i < 100; i++ {
+		p := bytes.Repeat([]byte{byte('a' + i%26)}, i%12)
+		if err := rb.WriteRecord(p); err != nil {
+			t.Fatalf("record %d: expect no error but got %v", i, err)
+		}
+		got, err := rb.PeekRecord()
+		if err != nil {
+			t.Fatalf("record %d: expect no error but got %v", i, err)
+		}
+		if i%3 == 0 {
+			if r, err := rb.ReadRecord(); err != nil || !bytes.Equal(r, got) {
+				t.Fatalf("record %d: expect %q but got %q, %v", i, got, r, err)
+			}
+		}
+	}
+	if rb.SkippedBytes() != 0 {
+		t.Fatalf("expect no skipped bytes but got %d", rb.SkippedBytes())
+	}
+}
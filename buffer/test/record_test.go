@@ -0,0 +1,352 @@
+package buffer_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"testing"
+
+	. "gitlab-smartgaia.sercomm.com/s1util/logger/buffer"
+)
+
+func TestRingBuffer_Record(t *testing.T) {
+	rb, _ := NewRingBuffer(16, 64, 1024)
+
+	if _, err := rb.ReadRecord(); err != ErrIsEmpty {
+		t.Fatalf("expect ErrIsEmpty but got %v", err)
+	}
+	if _, err := rb.PeekRecord(); err != ErrIsEmpty {
+		t.Fatalf("expect ErrIsEmpty but got %v", err)
+	}
+
+	_ = rb.WriteRecord([]byte("abc"))
+	_ = rb.WriteRecord(nil)
+	_ = rb.WriteRecord([]byte("defg"))
+	if rb.Length() != 3*RecordHeaderSize+7 {
+		t.Fatalf("expect len %d bytes but got %d", 3*RecordHeaderSize+7, rb.Length())
+	}
+	if rb.RecordCount() != 3 {
+		t.Fatalf("expect 3 records but got %d", rb.RecordCount())
+	}
+
+	var ranged []string
+	rb.RangeRecords(func(p []byte) bool {
+		ranged = append(ranged, string(p))
+		return true
+	})
+	if fmt.Sprint(ranged) != "[abc  defg]" {
+		t.Fatalf("expect [abc  defg] but got %v", ranged)
+	}
+
+	p, err := rb.PeekRecord()
+	if err != nil || string(p) != "abc" {
+		t.Fatalf("expect abc but got %q, %v", p, err)
+	}
+	if rb.RecordCount() != 3 {
+		t.Fatalf("expect peek to keep 3 records but got %d", rb.RecordCount())
+	}
+
+	for _, expected := range []string{"abc", "", "defg"} {
+		p, err := rb.ReadRecord()
+		if err != nil || string(p) != expected {
+			t.Fatalf("expect %q but got %q, %v", expected, p, err)
+		}
+	}
+	if !rb.IsEmpty() || rb.RecordCount() != 0 {
+		t.Fatalf("expect buffer to be empty but got %d records", rb.RecordCount())
+	}
+}
+
+func TestRingBuffer_RecordWrapAround(t *testing.T) {
+	rb, _ := NewRingBuffer(16, 16, 1024)
+
+	// move the pointers so that the next records wrap around the end
+	_, _ = rb.Write(make([]byte, 10))
+	_, _ = rb.Read(make([]byte, 10))
+
+	_ = rb.WriteRecord([]byte("abcdef"))
+	if rb.GetW() >= rb.GetR() {
+		t.Fatalf("expect record to wrap around but got r=%d, w=%d", rb.GetR(), rb.GetW())
+	}
+	p, err := rb.ReadRecord()
+	if err != nil || string(p) != "abcdef" {
+		t.Fatalf("expect abcdef but got %q, %v", p, err)
+	}
+}
+
+func TestRingBuffer_RecordOverwrite(t *testing.T) {
+	rb, _ := NewRingBuffer(18, 18, 1024)
+
+	// every record takes 9 bytes, the third one evicts the first
+	_ = rb.WriteRecord([]byte("aaaa"))
+	_ = rb.WriteRecord([]byte("bbbb"))
+	_ = rb.WriteRecord([]byte("cccc"))
+
+	if rb.RecordCount() != 2 {
+		t.Fatalf("expect 2 records but got %d", rb.RecordCount())
+	}
+	for _, expected := range []string{"bbbb", "cccc"} {
+		p, err := rb.ReadRecord()
+		if err != nil || string(p) != expected {
+			t.Fatalf("expect %q but got %q, %v", expected, p, err)
+		}
+	}
+}
+
+func TestRingBuffer_RecordHeader(t *testing.T) {
+	rb, _ := NewRingBuffer(16, 16, 1024)
+
+	// the length prefix holds the whole length, the tag follows it
+	_ = rb.WriteRecordLevel([]byte("abc"), 7)
+	data := rb.Bytes()
+	if len(data) != RecordHeaderSize+3 || binary.LittleEndian.Uint32(data[:4]) != 3 || data[4] != 7 || string(data[5:]) != "abc" {
+		t.Fatalf("expect length 3, tag 7 and abc but got %v", data)
+	}
+}
+
+func TestRingBuffer_BadRecord(t *testing.T) {
+	rb, _ := NewRingBuffer(16, 16, 1024)
+
+	// a length prefix claiming more than what is buffered
+	h := make([]byte, RecordHeaderSize)
+	binary.LittleEndian.PutUint32(h, 100)
+	_, _ = rb.Write(append(h, "abc"...))
+
+	if rb.RecordCount() != 0 {
+		t.Fatalf("expect 0 records but got %d", rb.RecordCount())
+	}
+	if _, err := rb.PeekRecord(); err != ErrBadRecord {
+		t.Fatalf("expect ErrBadRecord but got %v", err)
+	}
+	if _, err := rb.ReadRecord(); err != ErrBadRecord {
+		t.Fatalf("expect ErrBadRecord but got %v", err)
+	}
+	if !rb.IsEmpty() {
+		t.Fatalf("expect malformed data to be dropped but got %d bytes", rb.Length())
+	}
+}
+
+func TestMPSCBuffer_Record(t *testing.T) {
+	mb := NewMPSCBuffer(4, 64)
+
+	_ = mb.WriteRecord([]byte("abc"))
+	_ = mb.WriteRecord([]byte("defg"))
+	if mb.Length() != 2*RecordHeaderSize+7 {
+		t.Fatalf("expect len %d bytes but got %d", 2*RecordHeaderSize+7, mb.Length())
+	}
+	if mb.RecordCount() != 2 {
+		t.Fatalf("expect 2 records but got %d", mb.RecordCount())
+	}
+
+	p, err := mb.PeekRecord()
+	if err != nil || string(p) != "abc" || mb.RecordCount() != 2 {
+		t.Fatalf("expect abc and 2 records but got %q, %v and %d records", p, err, mb.RecordCount())
+	}
+
+	// records are framed the same way as in RingBuffer
+	data := make([]byte, RecordHeaderSize+3)
+	if _, err := mb.Read(data); err != nil || !bytes.Equal(data[RecordHeaderSize:], []byte("abc")) {
+		t.Fatalf("expect framed abc but got %q, %v", data, err)
+	}
+
+	p, err = mb.ReadRecord()
+	if err != nil || string(p) != "defg" {
+		t.Fatalf("expect defg but got %q, %v", p, err)
+	}
+	if _, err := mb.ReadRecord(); err != ErrIsEmpty {
+		t.Fatalf("expect ErrIsEmpty but got %v", err)
+	}
+
+	// an unframed slot is dropped as a whole
+	_, _ = mb.Write([]byte("ab"))
+	_ = mb.WriteRecord([]byte("hi"))
+	if _, err := mb.ReadRecord(); err != ErrBadRecord {
+		t.Fatalf("expect ErrBadRecord but got %v", err)
+	}
+	p, err = mb.ReadRecord()
+	if err != nil || string(p) != "hi" || !mb.IsEmpty() {
+		t.Fatalf("expect hi and an empty buffer but got %q, %v and %d bytes", p, err, mb.Length())
+	}
+}
+
+// Fills a fixed size buffer with records of every length, starting at every offset, so that records end exactly
+// on the boundary of the buffer and overwriting has to evict records straddling it.
+func TestRingBuffer_RecordBoundary(t *testing.T) {
+	const size = 32
+
+	for offset := 0; offset < size; offset++ {
+		for l := 0; l <= size-RecordHeaderSize; l++ {
+			rb, _ := NewRingBuffer(size, size, 1024)
+			_, _ = rb.Write(make([]byte, offset))
+			_, _ = rb.Read(make([]byte, offset))
+
+			// enough records to wrap around the buffer several times
+			fit := size / (RecordHeaderSize + l)
+			var written [][]byte
+			for i := 0; i < 3*fit+3; i++ {
+				p := bytes.Repeat([]byte{byte('a' + i%26)}, l)
+				if err := rb.WriteRecord(p); err != nil {
+					t.Fatalf("offset %d, length %d: expect no error but got %v", offset, l, err)
+				}
+				written = append(written, p)
+
+				expected := written
+				if len(expected) > fit {
+					expected = expected[len(expected)-fit:]
+				}
+				if rb.RecordCount() != len(expected) || rb.Length() != len(expected)*(RecordHeaderSize+l) {
+					t.Fatalf("offset %d, length %d, record %d: expect %d records but got %d in %d bytes",
+						offset, l, i, len(expected), rb.RecordCount(), rb.Length())
+				}
+
+				j := 0
+				rb.RangeRecords(func(p []byte) bool {
+					if !bytes.Equal(p, expected[j]) {
+						t.Fatalf("offset %d, length %d, record %d: expect %q but got %q", offset, l, i, expected[j], p)
+					}
+					j++
+					return true
+				})
+			}
+		}
+	}
+}
+
+// A record as large as the whole buffer evicts everything, including a record ending right before it.
+func TestRingBuffer_RecordFillsBuffer(t *testing.T) {
+	rb, _ := NewRingBuffer(16, 16, 1024)
+
+	_ = rb.WriteRecord([]byte("ab"))
+	if err := rb.WriteRecord(bytes.Repeat([]byte("c"), 16-RecordHeaderSize)); err != nil {
+		t.Fatalf("expect no error but got %v", err)
+	}
+	if !rb.IsFull() || rb.RecordCount() != 1 {
+		t.Fatalf("expect a full buffer with 1 record but got %d records", rb.RecordCount())
+	}
+
+	p, err := rb.ReadRecord()
+	if err != nil || string(p) != "ccccccccccc" {
+		t.Fatalf("expect ccccccccccc but got %q, %v", p, err)
+	}
+}
+
+func TestRingBuffer_RecordTooLarge(t *testing.T) {
+	rb, _ := NewRingBuffer(16, 16, 1024)
+
+	_ = rb.WriteRecord([]byte("ab"))
+	if err := rb.WriteRecord(bytes.Repeat([]byte("c"), 16-RecordHeaderSize+1)); err != ErrTooLarge {
+		t.Fatalf("expect ErrTooLarge but got %v", err)
+	}
+
+	// the buffer is left untouched
+	p, err := rb.ReadRecord()
+	if err != nil || string(p) != "ab" || !rb.IsEmpty() {
+		t.Fatalf("expect ab and an empty buffer but got %q, %v", p, err)
+	}
+
+	// a buffer able to grow does not grow beyond its maximum size for a single record
+	rb, _ = NewRingBuffer(8, 16, 1024)
+	if err := rb.WriteRecord(bytes.Repeat([]byte("c"), 16)); err != ErrTooLarge {
+		t.Fatalf("expect ErrTooLarge but got %v", err)
+	}
+	if rb.Capacity() != 8 {
+		t.Fatalf("expect capacity 8 but got %d", rb.Capacity())
+	}
+}
+
+// Writes records of random lengths and checks the buffer always keeps the newest records that fit.
+func TestRingBuffer_RecordMixedLengths(t *testing.T) {
+	const size = 64
+	rnd := rand.New(rand.NewSource(1))
+	rb, _ := NewRingBuffer(size, size, 1024)
+
+	var written [][]byte
+	for i := 0; i < 5000; i++ {
+		p := bytes.Repeat([]byte{byte('a' + i%26)}, rnd.Intn(size-RecordHeaderSize+1))
+		if err := rb.WriteRecord(p); err != nil {
+			t.Fatalf("record %d: expect no error but got %v", i, err)
+		}
+		written = append(written, p)
+
+		// drain now and then, so records start at every offset
+		if rnd.Intn(10) == 0 {
+			for rb.RecordCount() > 0 {
+				_, _ = rb.ReadRecord()
+			}
+			written = written[:0]
+			continue
+		}
+
+		total, k := 0, len(written)
+		for k > 0 && total+RecordHeaderSize+len(written[k-1]) <= size {
+			k--
+			total += RecordHeaderSize + len(written[k])
+		}
+		expected := written[k:]
+
+		j := 0
+		rb.RangeRecords(func(p []byte) bool {
+			if j >= len(expected) || !bytes.Equal(p, expected[j]) {
+				t.Fatalf("record %d: unexpected record %d %q", i, j, p)
+			}
+			j++
+			return true
+		})
+		if j != len(expected) || rb.Length() != total {
+			t.Fatalf("record %d: expect %d records in %d bytes but got %d in %d", i, len(expected), total, j, rb.Length())
+		}
+	}
+}
+
+func TestRingBuffer_DropRecords(t *testing.T) {
+	below := func(limit string) func(p []byte) bool {
+		return func(p []byte) bool { return string(p) < limit }
+	}
+
+	rb, _ := NewRingBuffer(16, 64, 1024)
+	if n := rb.DropRecords(below("z")); n != 0 {
+		t.Fatalf("expect 0 records dropped but got %d", n)
+	}
+
+	for _, p := range []string{"a", "b", "c", "a"} {
+		_ = rb.WriteRecord([]byte(p))
+	}
+
+	// dropping stops at the first record kept, the newer "a" stays
+	if n := rb.DropRecords(below("c")); n != 2 {
+		t.Fatalf("expect 2 records dropped but got %d", n)
+	}
+	if rb.RecordCount() != 2 {
+		t.Fatalf("expect 2 records but got %d", rb.RecordCount())
+	}
+	if p, err := rb.ReadRecord(); err != nil || string(p) != "c" {
+		t.Fatalf("expect c but got %q, %v", p, err)
+	}
+
+	// with compression, pending records are dropped as well
+	rb = newCompressBuffer(t, 1024, 1024)
+	for i := 0; i < 6; i++ {
+		_ = rb.WriteRecord(jsonRecord(i))
+	}
+	if n := rb.DropRecords(func(p []byte) bool { return string(p) < string(jsonRecord(5)) }); n != 5 {
+		t.Fatalf("expect 5 records dropped but got %d", n)
+	}
+	if p, err := rb.ReadRecord(); err != nil || string(p) != string(jsonRecord(5)) || !rb.IsEmpty() {
+		t.Fatalf("expect the last record only but got %q, %v", p, err)
+	}
+}
+
+func TestMPSCBuffer_DropRecords(t *testing.T) {
+	mb := NewMPSCBuffer(4, 64)
+	for _, p := range []string{"a", "b", "c"} {
+		_ = mb.WriteRecord([]byte(p))
+	}
+
+	if n := mb.DropRecords(func(p []byte) bool { return string(p) != "c" }); n != 2 {
+		t.Fatalf("expect 2 records dropped but got %d", n)
+	}
+	if p, err := mb.ReadRecord(); err != nil || string(p) != "c" || !mb.IsEmpty() {
+		t.Fatalf("expect c and an empty buffer but got %q, %v and %d bytes", p, err, mb.Length())
+	}
+}
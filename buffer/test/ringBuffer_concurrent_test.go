@@ -0,0 +1,142 @@
+package buffer_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"sync"
+	"testing"
+
+	. "gitlab-smartgaia.sercomm.com/s1util/logger/buffer"
+)
+
+// Concurrency tests are meant to be run with the race detector, see `make test-race`.
+
+// makeRecord returns a log made of a single repeated character behind its record header, with no tag.
+func makeRecord(c byte, l int) [][]byte {
+	prefix := make([]byte, RecordHeaderSize)
+	binary.LittleEndian.PutUint32(prefix, uint32(l))
+	return [][]byte{prefix, bytes.Repeat([]byte{c}, l)}
+}
+
+// readRecord reads one log and its record header as a single unit.
+func readRecord(rb LogBuffer) (data []byte, err error) {
+	err = rb.ReadBatch(func(r io.Reader) error {
+		prefix := make([]byte, RecordHeaderSize)
+		if _, err := r.Read(prefix); err != nil {
+			return err
+		}
+		data = make([]byte, binary.LittleEndian.Uint32(prefix))
+		_, err := r.Read(data)
+		return err
+	})
+	return data, err
+}
+
+func TestRingBuffer_ConcurrentWriters(t *testing.T) {
+	const (
+		writers = 8
+		records = 200
+	)
+
+	rb := &RingBuffer{}
+	rb.Init(64, 512, 1024)
+
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(c byte) {
+			defer wg.Done()
+			for j := 0; j < records; j++ {
+				if _, err := rb.WriteBatch(makeRecord(c, 1+j%24)...); err != nil {
+					t.Errorf("write failed: %v", err)
+					return
+				}
+			}
+		}(byte('a' + i))
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	// single drainer, racing with the writers until they are done
+	check := func(data []byte) {
+		if len(data) == 0 || !bytes.Equal(data, bytes.Repeat(data[:1], len(data))) {
+			t.Fatalf("expect a whole log but got %q", data)
+		}
+	}
+	for {
+		select {
+		case <-done:
+			for !rb.IsEmpty() {
+				data, err := readRecord(rb)
+				if err != nil {
+					t.Fatalf("read failed: %v", err)
+				}
+				check(data)
+			}
+			return
+		default:
+			data, err := readRecord(rb)
+			if err == io.EOF {
+				continue
+			}
+			if err != nil {
+				t.Fatalf("read failed: %v", err)
+			}
+			check(data)
+		}
+	}
+}
+
+func benchmarkWrite(b *testing.B, rb *RingBuffer) {
+	record := makeRecord('a', 128)
+	b.SetBytes(int64(RecordHeaderSize + 128))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, _ = rb.WriteBatch(record...)
+	}
+}
+
+// See BenchmarkRingBuffer_WriteUnsynchronized in the buffer package for the baseline without locking.
+func BenchmarkRingBuffer_Write(b *testing.B) {
+	rb := &RingBuffer{}
+	rb.Init(4096, 64*1024, 1024)
+	benchmarkWrite(b, rb)
+}
+
+func BenchmarkRingBuffer_WriteParallel(b *testing.B) {
+	rb := &RingBuffer{}
+	rb.Init(4096, 64*1024, 1024)
+
+	record := makeRecord('a', 128)
+	b.SetBytes(int64(RecordHeaderSize + 128))
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			_, _ = rb.WriteBatch(record...)
+		}
+	})
+}
+
+/*
+A burst of logs growing the buffer from its default to its maximum size, without any flush in between.
+See BenchmarkRingBuffer_BurstCopyOnGrow in the buffer package for the baseline copying the buffer as it grows.
+*/
+func BenchmarkRingBuffer_Burst(b *testing.B) {
+	record := makeRecord('a', 256)
+	b.SetBytes(int64(4 * 1024 * 1024))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		rb := &RingBuffer{}
+		rb.Init(4*1024, 4*1024*1024, 1024*1024)
+		for rb.Length() < 4*1024*1024-256-RecordHeaderSize {
+			_, _ = rb.WriteBatch(record...)
+		}
+	}
+}
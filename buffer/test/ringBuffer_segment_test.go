@@ -0,0 +1,96 @@
+package buffer_test
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	. "gitlab-smartgaia.sercomm.com/s1util/logger/buffer"
+)
+
+func TestRingBuffer_GrowWrapped(t *testing.T) {
+	rb, _ := NewRingBuffer(8, 64, 1024)
+
+	// wrap around with the write pointer in the middle of the only block
+	_, _ = rb.Write([]byte("abcdef"))
+	_, _ = rb.Read(make([]byte, 4))
+	_, _ = rb.Write([]byte("ghijkl"))
+	if !rb.IsFull() || rb.GetR() != 4 || rb.GetW() != 4 {
+		t.Fatalf("expect full buffer but got r.w=%d, r.r=%d", rb.GetW(), rb.GetR())
+	}
+
+	_, _ = rb.Write([]byte("mno"))
+	if rb.Capacity() != 16 || rb.GetBlocks() != 2 {
+		t.Fatalf("expect 2 blocks but got %d", rb.GetBlocks())
+	}
+	if !bytes.Equal(rb.Bytes(), []byte("efghijklmno")) {
+		t.Fatalf("expect efghijklmno but got %s", rb.Bytes())
+	}
+
+	// wrap around again with the write pointer at the boundary of a block
+	_, _ = rb.Read(make([]byte, 3))
+	_, _ = rb.Write([]byte("pqrst"))
+	_, _ = rb.Write([]byte("uvw"))
+	if !bytes.Equal(rb.Bytes(), []byte("hijklmnopqrstuvw")) {
+		t.Fatalf("expect hijklmnopqrstuvw but got %s", rb.Bytes())
+	}
+	_, _ = rb.Write([]byte("xyz"))
+	if !bytes.Equal(rb.Bytes(), []byte("hijklmnopqrstuvwxyz")) {
+		t.Fatalf("expect hijklmnopqrstuvwxyz but got %s", rb.Bytes())
+	}
+}
+
+// Compares the buffer with a plain slice under random writes, reads and virtual reads.
+func TestRingBuffer_SegmentModel(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+
+	rb, _ := NewRingBuffer(16, 1<<20, 64)
+
+	var model []byte
+	virtual := 0 // bytes read virtually but not refreshed yet
+	next := byte(0)
+	for i := 0; i < 10000; i++ {
+		switch op := rnd.Intn(10); {
+		case op < 4:
+			p := make([]byte, rnd.Intn(40))
+			for j := range p {
+				p[j] = next
+				next++
+			}
+			_, _ = rb.Write(p)
+			model = append(model, p...)
+		case op < 7:
+			p := make([]byte, rnd.Intn(40))
+			n, _ := rb.Read(p)
+			if !bytes.Equal(p[:n], model[:n]) {
+				t.Fatalf("step %d: expect %v but got %v", i, model[:n], p[:n])
+			}
+			if n > 0 {
+				model = model[n:]
+				virtual = 0
+			}
+		case op < 9:
+			// stop short of the write pointer, where the virtual read pointer is ambiguous
+			l := rnd.Intn(8)
+			if l > len(model)-virtual-1 {
+				continue
+			}
+			p := make([]byte, l)
+			n, _ := rb.VirtualRead(p)
+			if !bytes.Equal(p[:n], model[virtual:virtual+n]) {
+				t.Fatalf("step %d: expect %v but got %v", i, model[virtual:virtual+n], p[:n])
+			}
+			virtual += n
+		default:
+			rb.VirtualRevert()
+			virtual = 0
+		}
+
+		if !bytes.Equal(rb.Bytes(), model) && !(rb.Bytes() == nil && len(model) == 0) {
+			t.Fatalf("step %d: expect %v but got %v", i, model, rb.Bytes())
+		}
+		if rb.Length() != len(model) || rb.Free() != rb.Capacity()-len(model) {
+			t.Fatalf("step %d: expect len %d but got %d", i, len(model), rb.Length())
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package buffer_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	. "gitlab-smartgaia.sercomm.com/s1util/logger/buffer"
+)
+
+// burst grows the buffer with 100 bytes, then drains all but the last 4.
+func burst(t *testing.T, rb *RingBuffer) {
+	_, _ = rb.Write([]byte(strings.Repeat("abcd", 25)))
+	if rb.Capacity() <= 16 {
+		t.Fatalf("expect buffer to grow but got capacity %d", rb.Capacity())
+	}
+	_, _ = rb.Read(make([]byte, 96))
+}
+
+func TestRingBuffer_ShrinkAfterWrites(t *testing.T) {
+	rb, _ := NewRingBuffer(16, 1024, 1024)
+	rb.SetShrinkPolicy(ShrinkPolicy{LowWater: 8, Writes: 3})
+
+	burst(t, rb)
+
+	// going above the low-water mark restarts the idle period
+	_, _ = rb.Write([]byte("efghijkl"))
+	_, _ = rb.Read(make([]byte, 8))
+	_, _ = rb.Write([]byte("e"))
+	_, _ = rb.Write([]byte("f"))
+	if rb.Capacity() == 16 {
+		t.Fatalf("expect no shrink before 3 writes below the low-water mark")
+	}
+
+	_, _ = rb.Write([]byte("g"))
+	if rb.Capacity() != 16 || rb.GetBlocks() != 1 {
+		t.Fatalf("expect capacity 16 bytes but got %d", rb.Capacity())
+	}
+	if !bytes.Equal(rb.Bytes(), []byte("ijklefg")) {
+		t.Fatalf("expect ijklefg but got %s", rb.Bytes())
+	}
+
+	// buffer keeps working after shrinking
+	_, _ = rb.Write([]byte(strings.Repeat("h", 20)))
+	if !bytes.Equal(rb.Bytes(), []byte("ijklefg"+strings.Repeat("h", 20))) {
+		t.Fatalf("expect ijklefg followed by 20 h but got %s", rb.Bytes())
+	}
+}
+
+func TestRingBuffer_ShrinkAfterDuration(t *testing.T) {
+	rb, _ := NewRingBuffer(16, 1024, 1024)
+	rb.SetShrinkPolicy(ShrinkPolicy{LowWater: 8, After: time.Minute})
+
+	burst(t, rb)
+	_, _ = rb.Write([]byte("e"))
+	if rb.Capacity() == 16 {
+		t.Fatalf("expect no shrink before a minute below the low-water mark")
+	}
+
+	rb.SetLowSince(time.Now().Add(-time.Minute))
+	_, _ = rb.Write([]byte("f"))
+	if rb.Capacity() != 16 {
+		t.Fatalf("expect capacity 16 bytes but got %d", rb.Capacity())
+	}
+	if !bytes.Equal(rb.Bytes(), []byte("abcdef")) {
+		t.Fatalf("expect abcdef but got %s", rb.Bytes())
+	}
+}
+
+func TestRingBuffer_ShrinkKeepsUnreadData(t *testing.T) {
+	rb, _ := NewRingBuffer(16, 1024, 1024)
+	rb.SetShrinkPolicy(ShrinkPolicy{LowWater: 40, Writes: 1})
+
+	_, _ = rb.Write([]byte(strings.Repeat("abcd", 25)))
+	_, _ = rb.Read(make([]byte, 70))
+	_, _ = rb.VirtualRead(make([]byte, 2))
+	_, _ = rb.Write([]byte("e"))
+
+	// 31 bytes left, shrunk to 2 blocks instead of 1
+	if rb.Capacity() != 32 {
+		t.Fatalf("expect capacity 32 bytes but got %d", rb.Capacity())
+	}
+	if !bytes.Equal(rb.Bytes(), []byte("cd"+strings.Repeat("abcd", 7)+"e")) {
+		t.Fatalf("expect unread data but got %s", rb.Bytes())
+	}
+	if rb.VirtualLength() != 29 {
+		t.Fatalf("expect virtual len 29 bytes but got %d", rb.VirtualLength())
+	}
+}
+
+func TestRingBuffer_NoShrinkPolicy(t *testing.T) {
+	rb, _ := NewRingBuffer(16, 1024, 1024)
+
+	burst(t, rb)
+	for i := 0; i < 100; i++ {
+		_, _ = rb.Write([]byte("e"))
+		_, _ = rb.Read(make([]byte, 1))
+	}
+	if rb.Capacity() == 16 {
+		t.Fatalf("expect no shrink without a policy")
+	}
+}
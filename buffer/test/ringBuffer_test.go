@@ -3,6 +3,7 @@ package buffer_test
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"strings"
@@ -203,8 +204,8 @@ func TestRingBuffer_Read(t *testing.T) {
 	if err == nil {
 		t.Fatalf("expect an error but got nil")
 	}
-	if err != ErrIsEmpty {
-		t.Fatalf("expect ErrIsEmpty but got nil")
+	if err != io.EOF {
+		t.Fatalf("expect io.EOF but got %v", err)
 	}
 	if n != 0 {
 		t.Fatalf("expect read 0 bytes but got %d", n)
@@ -411,8 +412,8 @@ func TestRingBuffer_ByteInterface(t *testing.T) {
 
 	// read four, error
 	_, err = rb.ReadByte()
-	if err == nil {
-		t.Fatalf("expect ErrIsEmpty but got nil")
+	if err != io.EOF {
+		t.Fatalf("expect io.EOF but got %v", err)
 	}
 	if rb.Length() != 0 {
 		t.Fatalf("expect len 0 byte but got %d. r.w=%d, r.r=%d", rb.Length(), rb.GetW(), rb.GetR())
@@ -549,10 +550,10 @@ func TestRingBuffer_WriteLog(t *testing.T) {
 	for _, log := range logs {
 		fmt.Println("-----------------------------")
 		l := len(log)
-		bn := make([]byte, 4)
+		bn := make([]byte, RecordHeaderSize)
 		binary.LittleEndian.PutUint32(bn, uint32(l))
 		n, err = rb.Write(bn)
-		if n != 4 || err != nil {
+		if n != RecordHeaderSize || err != nil {
 			t.Fatal()
 		}
 
@@ -561,9 +562,9 @@ func TestRingBuffer_WriteLog(t *testing.T) {
 			t.Fatal()
 		}
 
-		data = make([]byte, 4)
+		data = make([]byte, RecordHeaderSize)
 		n, err = rb.VirtualRead(data)
-		if n != 4 || err != nil {
+		if n != RecordHeaderSize || err != nil {
 			t.Fatal()
 		}
 
@@ -608,10 +609,10 @@ func TestRingBuffer_WriteLogOverflow(t *testing.T) {
 	for _, log := range logs {
 		fmt.Println("-----------------------------")
 		l := len(log)
-		bn := make([]byte, 4)
+		bn := make([]byte, RecordHeaderSize)
 		binary.LittleEndian.PutUint32(bn, uint32(l))
 		n, err = rb.Write(bn)
-		if n != 4 || err != nil {
+		if n != RecordHeaderSize || err != nil {
 			t.Fatal()
 		}
 		fmt.Println("cur W: ", rb.GetW())
@@ -628,9 +629,9 @@ func TestRingBuffer_WriteLogOverflow(t *testing.T) {
 	}
 
 	fmt.Println("-----------------------------")
-	data = make([]byte, 4)
+	data = make([]byte, RecordHeaderSize)
 	n, err = rb.VirtualRead(data)
-	if n != 4 || err != nil {
+	if n != RecordHeaderSize || err != nil {
 		t.Fatal()
 	}
 
@@ -646,3 +647,56 @@ func TestRingBuffer_WriteLogOverflow(t *testing.T) {
 	fmt.Println("cur capacity: ", rb.Capacity())
 	fmt.Println("cur length: ", rb.Length())
 }
+
+func TestNewRingBuffer(t *testing.T) {
+	invalid := []struct {
+		defaultSize, maxSize, extCoef int
+		err                           error
+	}{
+		{0, 16, 1024, ErrInvalidSize},
+		{-1, 16, 1024, ErrInvalidSize},
+		{32, 16, 1024, ErrInvalidSize},
+		{16, 32, -1, ErrInvalidCoefficient},
+	}
+	for _, c := range invalid {
+		rb, err := NewRingBuffer(c.defaultSize, c.maxSize, c.extCoef)
+		if !errors.Is(err, c.err) || rb != nil {
+			t.Fatalf("expect %v for NewRingBuffer(%d, %d, %d) but got %v", c.err, c.defaultSize, c.maxSize, c.extCoef, err)
+		}
+	}
+
+	// every buffer is independent
+	rb1, err := NewRingBuffer(16, 64, 1024)
+	if err != nil {
+		t.Fatalf("expect no error but got %v", err)
+	}
+	rb2, err := NewRingBuffer(8, 8, 1024)
+	if err != nil {
+		t.Fatalf("expect no error but got %v", err)
+	}
+	if rb1.Capacity() != 16 || rb2.Capacity() != 8 {
+		t.Fatalf("expect capacity 16 and 8 but got %d and %d", rb1.Capacity(), rb2.Capacity())
+	}
+
+	_, _ = rb1.Write([]byte("abcd"))
+	_, _ = rb2.Write([]byte("efgh"))
+	if string(rb1.Bytes()) != "abcd" || string(rb2.Bytes()) != "efgh" {
+		t.Fatalf("expect abcd and efgh but got %q and %q", rb1.Bytes(), rb2.Bytes())
+	}
+}
+
+func TestRingBuffer_InitInvalid(t *testing.T) {
+	rb, err := NewRingBuffer(16, 64, 1024)
+	if err != nil {
+		t.Fatalf("expect no error but got %v", err)
+	}
+	_, _ = rb.Write([]byte("abcd"))
+
+	// a default size of 0 leaves no room for a block
+	if _, err := rb.Init(0, 64, 1024); !errors.Is(err, ErrInvalidSize) {
+		t.Fatalf("expect %v but got %v", ErrInvalidSize, err)
+	}
+	if string(rb.Bytes()) != "abcd" || rb.Capacity() != 16 {
+		t.Fatalf("expect the buffer untouched but got %q of capacity %d", rb.Bytes(), rb.Capacity())
+	}
+}
@@ -0,0 +1,206 @@
+package buffer_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "gitlab-smartgaia.sercomm.com/s1util/logger/buffer"
+)
+
+// newSpillBuffer returns a buffer of 36 bytes spilling into a new temporary directory, to be removed by the caller.
+func newSpillBuffer(t *testing.T, maxSize int) (*RingBuffer, string) {
+	dir, err := ioutil.TempDir("", "spill_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rb, _ := NewRingBuffer(36, 36, 1024)
+	if err := rb.SetSpill(dir, maxSize); err != nil {
+		t.Fatalf("expect no error but got %v", err)
+	}
+	return rb, dir
+}
+
+// spillFiles returns the segment files of the spill in dir.
+func spillFiles(t *testing.T, dir string) []string {
+	files, err := filepath.Glob(filepath.Join(dir, "*", "*.seg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestRingBuffer_Spill(t *testing.T) {
+	rb, dir := newSpillBuffer(t, 1024)
+	defer os.RemoveAll(dir)
+
+	// every record takes 9 bytes, 4 of them fit in memory
+	for i := 0; i < 10; i++ {
+		_ = rb.WriteRecord([]byte(fmt.Sprintf("r%03d", i)))
+	}
+
+	if records, dropped := rb.Spilled(); records != 6 || dropped != 0 {
+		t.Fatalf("expect 6 spilled and 0 dropped records but got %d and %d", records, dropped)
+	}
+	if rb.RecordCount() != 10 {
+		t.Fatalf("expect 10 records but got %d", rb.RecordCount())
+	}
+	if len(spillFiles(t, dir)) == 0 {
+		t.Fatalf("expect spill files in %s", dir)
+	}
+
+	var ranged []string
+	rb.RangeRecords(func(p []byte) bool {
+		ranged = append(ranged, string(p))
+		return true
+	})
+	if fmt.Sprint(ranged) != "[r000 r001 r002 r003 r004 r005 r006 r007 r008 r009]" {
+		t.Fatalf("expect all records in order but got %v", ranged)
+	}
+
+	// spilled records come back first, then the records in memory
+	p, err := rb.PeekRecord()
+	if err != nil || string(p) != "r000" {
+		t.Fatalf("expect r000 but got %q, %v", p, err)
+	}
+	for i := 0; i < 10; i++ {
+		p, err := rb.ReadRecord()
+		if expected := fmt.Sprintf("r%03d", i); err != nil || string(p) != expected {
+			t.Fatalf("expect %q but got %q, %v", expected, p, err)
+		}
+	}
+	if _, err := rb.ReadRecord(); err != ErrIsEmpty || !rb.IsEmpty() {
+		t.Fatalf("expect ErrIsEmpty but got %v", err)
+	}
+
+	// fully read segments are removed
+	if files := spillFiles(t, dir); len(files) != 0 {
+		t.Fatalf("expect no spill file but got %v", files)
+	}
+}
+
+func TestRingBuffer_SpillLevel(t *testing.T) {
+	rb, dir := newSpillBuffer(t, 1024)
+	defer os.RemoveAll(dir)
+
+	for i := 0; i < 10; i++ {
+		_ = rb.WriteRecordLevel([]byte(fmt.Sprintf("r%03d", i)), Level(i%7+1))
+	}
+	if records, _ := rb.Spilled(); records != 6 {
+		t.Fatalf("expect 6 spilled records but got %d", records)
+	}
+
+	// spilled records keep their level when read back, as the records in memory
+	for i := 0; i < 10; i++ {
+		level, err := rb.GetRecordLevel()
+		if err != nil || level != Level(i%7+1) {
+			t.Fatalf("expect level %d for record %d but got %d, %v", i%7+1, i, level, err)
+		}
+		if _, err := rb.ReadRecord(); err != nil {
+			t.Fatalf("expect no error but got %v", err)
+		}
+	}
+}
+
+func TestRingBuffer_SpillDiskCap(t *testing.T) {
+	// every spilled record takes 15 bytes, segments hold 10 bytes, hence a single record
+	rb, dir := newSpillBuffer(t, 80)
+	defer os.RemoveAll(dir)
+
+	for i := 0; i < 20; i++ {
+		_ = rb.WriteRecord([]byte(fmt.Sprintf("r%03d", i)))
+	}
+
+	// 16 records were spilled, only the newest 5 fit the disk cap
+	records, dropped := rb.Spilled()
+	if records != 5 || dropped != 11 {
+		t.Fatalf("expect 5 spilled and 11 dropped records but got %d and %d", records, dropped)
+	}
+	for i := 11; i < 20; i++ {
+		p, err := rb.ReadRecord()
+		if expected := fmt.Sprintf("r%03d", i); err != nil || string(p) != expected {
+			t.Fatalf("expect %q but got %q, %v", expected, p, err)
+		}
+	}
+}
+
+func TestRingBuffer_SpillResetAndClose(t *testing.T) {
+	rb, dir := newSpillBuffer(t, 1024)
+	defer os.RemoveAll(dir)
+
+	for i := 0; i < 10; i++ {
+		_ = rb.WriteRecord([]byte(fmt.Sprintf("r%03d", i)))
+	}
+	rb.Reset()
+	if records, _ := rb.Spilled(); records != 0 || !rb.IsEmpty() {
+		t.Fatalf("expect an empty buffer but got %d spilled records", records)
+	}
+	if files := spillFiles(t, dir); len(files) != 0 {
+		t.Fatalf("expect no spill file but got %v", files)
+	}
+
+	// spilling goes on after a reset
+	for i := 0; i < 10; i++ {
+		_ = rb.WriteRecord([]byte(fmt.Sprintf("r%03d", i)))
+	}
+	if records, _ := rb.Spilled(); records != 6 {
+		t.Fatalf("expect 6 spilled records but got %d", records)
+	}
+
+	if err := rb.Close(); err != nil {
+		t.Fatalf("expect no error but got %v", err)
+	}
+	if entries, _ := ioutil.ReadDir(dir); len(entries) != 0 {
+		t.Fatalf("expect the spill directory to be removed but got %d entries", len(entries))
+	}
+	if !rb.IsEmpty() {
+		t.Fatalf("expect an empty buffer after close")
+	}
+}
+
+func TestRingBuffer_SpillCorruptedSegment(t *testing.T) {
+	rb, dir := newSpillBuffer(t, 1024)
+	defer os.RemoveAll(dir)
+
+	for i := 0; i < 10; i++ {
+		_ = rb.WriteRecord([]byte(fmt.Sprintf("r%03d", i)))
+	}
+
+	// corrupt the first segment on disk
+	files := spillFiles(t, dir)
+	f, err := os.OpenFile(files[0], os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = f.WriteAt([]byte{0}, 0)
+	f.Close()
+
+	if _, err := rb.ReadRecord(); err != ErrBadRecord {
+		t.Fatalf("expect ErrBadRecord but got %v", err)
+	}
+
+	// the records in memory are still there
+	count := 0
+	for {
+		if _, err := rb.ReadRecord(); err == ErrIsEmpty {
+			break
+		}
+		count++
+	}
+	if count < 4 {
+		t.Fatalf("expect at least the 4 records in memory but got %d", count)
+	}
+}
+
+func TestRingBuffer_SpillInvalid(t *testing.T) {
+	rb, _ := NewRingBuffer(32, 32, 1024)
+	if err := rb.SetSpill(filepath.Join(os.TempDir(), "does", "not", "exist"), 1024); err == nil {
+		t.Fatalf("expect an error for a missing directory")
+	}
+	if err := rb.SetSpill("", 0); err == nil {
+		t.Fatalf("expect an error for a zero disk cap")
+	}
+}
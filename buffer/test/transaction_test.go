@@ -0,0 +1,262 @@
+package buffer_test
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"testing"
+
+	. "gitlab-smartgaia.sercomm.com/s1util/logger/buffer"
+)
+
+// readTx reads n records through tx and returns them.
+func readTx(t *testing.T, tx *ReadTx, n int) []string {
+	t.Helper()
+	var records []string
+	for i := 0; i < n; i++ {
+		p, err := tx.ReadRecord()
+		if err != nil {
+			t.Fatalf("expect record %d but got %v", i, err)
+		}
+		records = append(records, string(p))
+	}
+	return records
+}
+
+func TestReadTx(t *testing.T) {
+	rb, _ := NewRingBuffer(16, 64, 1024)
+	for _, p := range []string{"a", "b", "c"} {
+		_ = rb.WriteRecord([]byte(p))
+	}
+
+	// rolled back records are read again
+	tx := rb.BeginRead()
+	if records := readTx(t, tx, 2); fmt.Sprint(records) != "[a b]" {
+		t.Fatalf("expect [a b] but got %v", records)
+	}
+	if rb.RecordCount() != 3 {
+		t.Fatalf("expect 3 records but got %d", rb.RecordCount())
+	}
+	tx.Rollback()
+
+	tx = rb.BeginRead()
+	if records := readTx(t, tx, 2); fmt.Sprint(records) != "[a b]" {
+		t.Fatalf("expect [a b] but got %v", records)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("expect no error but got %v", err)
+	}
+	if _, err := tx.ReadRecord(); err != ErrTxClosed {
+		t.Fatalf("expect ErrTxClosed but got %v", err)
+	}
+	if err := tx.Commit(); err != ErrTxClosed {
+		t.Fatalf("expect ErrTxClosed but got %v", err)
+	}
+
+	// records written meanwhile are read by the same transaction
+	tx = rb.BeginRead()
+	readTx(t, tx, 1)
+	if _, err := tx.ReadRecord(); err != ErrIsEmpty {
+		t.Fatalf("expect ErrIsEmpty but got %v", err)
+	}
+	_ = rb.WriteRecord([]byte("d"))
+	if records := readTx(t, tx, 1); records[0] != "d" {
+		t.Fatalf("expect d but got %v", records)
+	}
+	if err := tx.Commit(); err != nil || !rb.IsEmpty() {
+		t.Fatalf("expect an empty buffer but got %v and %d bytes", err, rb.Length())
+	}
+}
+
+func TestReadTx_Aborted(t *testing.T) {
+	// every record takes 6 bytes, 3 of them fit
+	rb, _ := NewRingBuffer(18, 18, 1024)
+	for _, p := range []string{"a", "b"} {
+		_ = rb.WriteRecord([]byte(p))
+	}
+
+	// another read aborts the transaction
+	tx := rb.BeginRead()
+	readTx(t, tx, 1)
+	_, _ = rb.ReadRecord()
+	if _, err := tx.ReadRecord(); err != ErrTxAborted {
+		t.Fatalf("expect ErrTxAborted but got %v", err)
+	}
+	if err := tx.Commit(); err != ErrTxAborted {
+		t.Fatalf("expect ErrTxAborted but got %v", err)
+	}
+
+	// so does overwriting the oldest record at maximum size, or a new transaction
+	tx = rb.BeginRead()
+	readTx(t, tx, 1)
+	for _, p := range []string{"c", "d", "e"} {
+		_ = rb.WriteRecord([]byte(p))
+	}
+	if err := tx.Commit(); err != ErrTxAborted {
+		t.Fatalf("expect ErrTxAborted but got %v", err)
+	}
+	tx = rb.BeginRead()
+	rb.BeginRead()
+	if _, err := tx.ReadRecord(); err != ErrTxAborted {
+		t.Fatalf("expect ErrTxAborted but got %v", err)
+	}
+
+	// nothing was consumed by the aborted transactions
+	if rb.RecordCount() != 3 {
+		t.Fatalf("expect 3 records but got %d", rb.RecordCount())
+	}
+}
+
+func TestReadTx_Full(t *testing.T) {
+	// every record takes 9 bytes, 2 of them fill the buffer
+	rb, _ := NewRingBuffer(18, 18, 1024)
+	_ = rb.WriteRecord([]byte("abcd"))
+	_ = rb.WriteRecord([]byte("efgh"))
+	if !rb.IsFull() {
+		t.Fatalf("expect a full buffer")
+	}
+
+	tx := rb.BeginRead()
+	readTx(t, tx, 2)
+	if _, err := tx.ReadRecord(); err != ErrIsEmpty {
+		t.Fatalf("expect ErrIsEmpty but got %v", err)
+	}
+	if err := tx.Commit(); err != nil || !rb.IsEmpty() {
+		t.Fatalf("expect an empty buffer but got %v and %d bytes", err, rb.Length())
+	}
+}
+
+func TestReadTx_Checksum(t *testing.T) {
+	rb, _ := NewRingBuffer(64, 64, 1024)
+	rb.SetFraming(FramingChecksum)
+	for _, p := range []string{"r000", "r001", "r002"} {
+		_ = rb.WriteRecord([]byte(p))
+	}
+	rb.SetByte(rb.GetR()+ChecksumHeaderSize, 'x')
+
+	// the corrupt record is skipped, and only counted once committed
+	tx := rb.BeginRead()
+	if records := readTx(t, tx, 2); fmt.Sprint(records) != "[r001 r002]" {
+		t.Fatalf("expect [r001 r002] but got %v", records)
+	}
+	if rb.SkippedBytes() != 0 {
+		t.Fatalf("expect no skipped bytes but got %d", rb.SkippedBytes())
+	}
+	_ = tx.Commit()
+	if rb.SkippedBytes() != ChecksumHeaderSize+4 || !rb.IsEmpty() {
+		t.Fatalf("expect %d skipped bytes and an empty buffer but got %d", ChecksumHeaderSize+4, rb.SkippedBytes())
+	}
+}
+
+func TestReadTx_Compression(t *testing.T) {
+	rb := newCompressBuffer(t, 1024, 1024)
+	for i := 0; i < 10; i++ {
+		_ = rb.WriteRecord(jsonRecord(i))
+	}
+
+	// 3 records of the first batch wait out of the buffer, the transaction reads them first
+	_, _ = rb.ReadRecord()
+	tx := rb.BeginRead()
+	for i := 1; i < 6; i++ {
+		if p, err := tx.ReadRecord(); err != nil || string(p) != string(jsonRecord(i)) {
+			t.Fatalf("expect record %d but got %q, %v", i, p, err)
+		}
+	}
+	_ = tx.Commit()
+
+	// the rest of the second batch is read next, the pending records last
+	for i := 6; i < 10; i++ {
+		if p, err := rb.ReadRecord(); err != nil || string(p) != string(jsonRecord(i)) {
+			t.Fatalf("expect record %d but got %q, %v", i, p, err)
+		}
+	}
+	if !rb.IsEmpty() {
+		t.Fatalf("expect an empty buffer but got %d records", rb.RecordCount())
+	}
+}
+
+func TestReadTx_CompressionPeek(t *testing.T) {
+	rb := newCompressBuffer(t, 1024, 1024)
+	for i := 0; i < 10; i++ {
+		_ = rb.WriteRecord(jsonRecord(i))
+	}
+
+	// peeking leaves the batches in the buffer, the transaction goes on
+	tx := rb.BeginRead()
+	readTx(t, tx, 2)
+	if p, err := rb.PeekRecord(); err != nil || string(p) != string(jsonRecord(0)) {
+		t.Fatalf("expect record 0 but got %q, %v", p, err)
+	}
+	for i := 2; i < 6; i++ {
+		if p, err := tx.ReadRecord(); err != nil || string(p) != string(jsonRecord(i)) {
+			t.Fatalf("expect record %d but got %q, %v", i, p, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("expect no error but got %v", err)
+	}
+
+	if p, err := rb.PeekRecord(); err != nil || string(p) != string(jsonRecord(6)) {
+		t.Fatalf("expect record 6 but got %q, %v", p, err)
+	}
+	if p, err := rb.ReadRecord(); err != nil || string(p) != string(jsonRecord(6)) {
+		t.Fatalf("expect record 6 but got %q, %v", p, err)
+	}
+}
+
+func TestReadTx_Spill(t *testing.T) {
+	rb, dir := newSpillBuffer(t, 1024)
+	defer os.RemoveAll(dir)
+
+	// every record takes 8 bytes, 4 of them fit in memory and 6 are spilled
+	for i := 0; i < 10; i++ {
+		_ = rb.WriteRecord([]byte(fmt.Sprintf("r%03d", i)))
+	}
+
+	tx := rb.BeginRead()
+	readTx(t, tx, 8)
+	tx.Rollback()
+
+	tx = rb.BeginRead()
+	records := readTx(t, tx, 8)
+	if records[0] != "r000" || records[7] != "r007" {
+		t.Fatalf("expect r000 to r007 but got %v", records)
+	}
+	_ = tx.Commit()
+
+	if spilled, _ := rb.Spilled(); spilled != 0 || rb.RecordCount() != 2 {
+		t.Fatalf("expect 0 spilled and 2 records but got %d and %d", spilled, rb.RecordCount())
+	}
+	if p, err := rb.ReadRecord(); err != nil || string(p) != "r008" {
+		t.Fatalf("expect r008 but got %q, %v", p, err)
+	}
+}
+
+func TestRingBuffer_VirtualReadAll(t *testing.T) {
+	rb, _ := NewRingBuffer(8, 8, 1024)
+
+	// wrapped around and full
+	_, _ = rb.Write([]byte("abcd"))
+	_, _ = rb.Read(make([]byte, 2))
+	_, _ = rb.Write([]byte("efghij"))
+	if !rb.IsFull() {
+		t.Fatalf("expect a full buffer")
+	}
+
+	buf := make([]byte, 16)
+	if n, err := rb.VirtualRead(buf); n != 8 || err != nil || string(buf[:n]) != "cdefghij" {
+		t.Fatalf("expect cdefghij but got %q, %v", buf[:n], err)
+	}
+	if _, err := rb.VirtualRead(buf); err != io.EOF || rb.VirtualLength() != 0 {
+		t.Fatalf("expect io.EOF and no virtual length but got %v and %d", err, rb.VirtualLength())
+	}
+
+	// virtual reads consume nothing until refreshed
+	if rb.IsEmpty() || rb.Length() != 8 {
+		t.Fatalf("expect 8 bytes but got %d", rb.Length())
+	}
+	rb.VirtualRefresh()
+	if !rb.IsEmpty() {
+		t.Fatalf("expect an empty buffer but got %d bytes", rb.Length())
+	}
+}
@@ -0,0 +1,226 @@
+package buffer
+
+import "errors"
+
+/*
+*************************************************************
+
+	VARIABLE
+
+*************************************************************
+*/
+
+var (
+	ErrTxAborted = errors.New("read transaction aborted")
+	ErrTxClosed  = errors.New("read transaction already committed or rolled back")
+)
+
+/*
+*************************************************************
+
+	STRUCT DEFINITION
+
+*************************************************************
+*/
+
+/*
+ReadTx reads records without consuming them, until Commit consumes all of them at once, see BeginRead.
+A transaction is aborted, its reads failing with ErrTxAborted, once records are consumed by other means, such as
+ReadRecord, Reset, an overwrite at maximum size, or another transaction beginning.
+*/
+type ReadTx struct {
+	rb   *RingBuffer
+	seq  int  // read sequence of the buffer when the transaction began
+	done bool // committed or rolled back
+
+	spillDropped int   // spilled records dropped when the transaction began
+	spillSeg     int   // index of the segment being read
+	spillOff     int64 // offset in the segment being read
+	spillRead    int   // spilled records read
+
+	outRead   int      // records read from the batch the buffer was reading, with compression
+	batch     [][]byte // records of the batch being read, with compression
+	batchRead int      // records read from batch
+
+	skipped int // malformed bytes skipped by the transaction
+}
+
+/*
+*************************************************************
+
+	READ TRANSACTION
+
+*************************************************************
+*/
+
+/*
+Begins a transaction reading records from the virtual read pointer, so a shipper can read a batch, send it,
+and commit only once the sink acknowledged it. Aborts the transaction open, if any.
+Note: With compression, records waiting for their batch to be complete are not read by transactions.
+*/
+func (rb *RingBuffer) BeginRead() *ReadTx {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	rb.syncVirtual()
+	tx := &ReadTx{rb: rb, seq: rb.readSeq}
+	if rb.spill != nil {
+		tx.spillDropped = rb.spill.dropped
+		if len(rb.spill.segments) > 0 {
+			tx.spillOff = rb.spill.segments[0].off
+		}
+	}
+	return tx
+}
+
+/*
+Reads the next record of the transaction and returns its payload, or ErrIsEmpty if there is none.
+Malformed data is skipped as with RingBuffer.ReadRecord, and only dropped on Commit.
+Returns ErrTxAborted if the transaction was aborted, and ErrTxClosed once it is committed or rolled back.
+*/
+func (tx *ReadTx) ReadRecord() ([]byte, error) {
+	rb := tx.rb
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	if err := tx.check(); err != nil {
+		return nil, err
+	}
+	if rb.compress == nil {
+		return tx.readStored()
+	}
+
+	if c := rb.compress; tx.outRead < len(c.out) {
+		tx.outRead++
+		return c.out[tx.outRead-1], nil
+	}
+	for tx.batchRead == len(tx.batch) {
+		batch, err := tx.readStored()
+		if err != nil {
+			return nil, err
+		}
+		if tx.batch, err = decodeBatch(batch); err != nil {
+			tx.batch = nil
+			return nil, err
+		}
+		tx.batchRead = 0
+	}
+	tx.batchRead++
+	return tx.batch[tx.batchRead-1], nil
+}
+
+/*
+Consumes the records read by the transaction, and ends it.
+Returns ErrTxAborted if the transaction was aborted, in which case nothing is consumed, and ErrTxClosed if it already ended.
+*/
+func (tx *ReadTx) Commit() error {
+	rb := tx.rb
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	if err := tx.check(); err != nil {
+		return err
+	}
+	defer rb.afterUpdate(false)
+	tx.done = true
+
+	for i := 0; i < tx.spillRead; i++ {
+		_, _, _ = rb.spill.read(true)
+	}
+
+	rb.skipped += tx.skipped
+	rb.r = rb.vr
+	rb.isEmpty = rb.isEmpty || rb.vempty
+
+	if c := rb.compress; c != nil {
+		// the records left in the batch being read are read next
+		c.out = append(c.out[tx.outRead:], tx.batch[tx.batchRead:]...)
+	}
+
+	rb.syncVirtual()
+	return nil
+}
+
+// Ends the transaction without consuming anything, the records it read are read again. Does nothing if it already ended.
+func (tx *ReadTx) Rollback() {
+	rb := tx.rb
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	if tx.check() == nil {
+		rb.syncVirtual()
+	}
+	tx.done = true
+}
+
+// Tells if the transaction can go on.
+func (tx *ReadTx) check() error {
+	if tx.done {
+		return ErrTxClosed
+	}
+	if tx.seq != tx.rb.readSeq || (tx.rb.spill != nil && tx.rb.spill.dropped != tx.spillDropped) {
+		return ErrTxAborted
+	}
+	return nil
+}
+
+// Reads the next record as stored, spilled records first, moving the cursor of the transaction past it.
+func (tx *ReadTx) readStored() ([]byte, error) {
+	rb := tx.rb
+	if s := rb.spill; s != nil {
+		for tx.spillSeg < len(s.segments) {
+			seg := s.segments[tx.spillSeg]
+			if tx.spillOff >= seg.size {
+				tx.spillSeg++
+				tx.spillOff = 0
+				continue
+			}
+
+			p, _, n, err := seg.readAt(tx.spillOff)
+			if err != nil {
+				// RingBuffer.ReadRecord drops the rest of the segment, the transaction stops there
+				return nil, ErrBadRecord
+			}
+			tx.spillOff += n
+			tx.spillRead++
+			return p, nil
+		}
+	}
+
+	if rb.isEmpty || rb.vempty {
+		return nil, ErrIsEmpty
+	}
+
+	size, err := rb.recordSize(rb.vr, rb.virtualLength())
+	if err == ErrBadRecord && tx.resync() {
+		size, err = rb.recordSize(rb.vr, rb.virtualLength())
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	hs := rb.headerSizeAt(rb.vr)
+	p := make([]byte, size-hs)
+	rb.copyOut(p, (rb.vr+hs)%rb.size)
+	rb.advanceVirtual(size)
+	return p, nil
+}
+
+// Skips malformed data at the virtual read pointer up to the next valid record, as RingBuffer.resync does.
+func (tx *ReadTx) resync() bool {
+	rb := tx.rb
+	length := rb.virtualLength()
+	if rb.framing == FramingChecksum {
+		for n := 1; n < length; n++ {
+			if _, err := rb.recordSize((rb.vr+n)%rb.size, length-n); err == nil {
+				tx.skipped += n
+				rb.advanceVirtual(n)
+				return true
+			}
+		}
+	}
+
+	tx.skipped += length
+	rb.advanceVirtual(length)
+	return false
+}
@@ -16,6 +16,9 @@ var (
 
 func ParseUnit(bufSize string) (int, error) {
 	s := strings.Split(bufSize, " ")
+	if len(s) != 2 {
+		return -1, ErrUnitUndefined
+	}
 	quantity, _ := strconv.Atoi(s[0])
 	unit := strings.ToUpper(s[1])
 
@@ -2,16 +2,20 @@ package logger
 
 import (
 	"bytes"
-	"encoding/binary"
+	"compress/flate"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"math/rand"
 	"os"
+	"path/filepath"
 	"runtime"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -28,18 +32,37 @@ const (
 	OPT_DEFAULT           LogOptions = 0x0003
 	OPT_HAS_REPORT_CALLER LogOptions = 0x0001
 	OPT_HAS_SHORT_CALLER  LogOptions = 0x0002
+	OPT_RESOURCE_OBJECT   LogOptions = 0x0004
+	OPT_LOCK_FREE_BUFFER  LogOptions = 0x0008
+	OPT_CHECKSUM_RECORDS  LogOptions = 0x0010
+	OPT_DISK_SPILL        LogOptions = 0x0020
+	OPT_MAPPED_BUFFER     LogOptions = 0x0040
+	OPT_COMPRESS_RECORDS  LogOptions = 0x0080
 
 	FILE     string = "file"
 	FUNCTION string = "func"
 	RESOURCE string = "res"
 	CATEGORY string = "cat"
 
-	BUFFER_MODE string = "BUFFER_MODE"
-	PLAIN_MODE  string = "PLAIN_MODE"
+	RUN_ID       string = "runId"
+	PREVIOUS_RUN string = "prevRun"
+
+	BUFFER_MODE  string = "BUFFER_MODE"
+	PLAIN_MODE   string = "PLAIN_MODE"
+	CAPTURE_MODE string = "CAPTURE_MODE"
+
+	MAX_RESOURCE_IDS       int = 16
+	DEFAULT_SLOTS          int = 8192
+	DEFAULT_COMPRESS_BATCH int = 16
+
+	DEFAULT_SHRINK_AFTER     time.Duration = time.Minute
+	DEFAULT_OVERFLOW_TIMEOUT time.Duration = 100 * time.Millisecond
 )
 
 // Logger struct
 type Logger struct {
+	bufferDropped int64 // logs the buffer had no room for, updated atomically, first so it is 64-bit aligned on 32-bit platforms
+
 	logrus.Logger
 
 	Options LogOptions
@@ -48,9 +71,37 @@ type Logger struct {
 		ResourcesString string
 	*/
 	Resources *Resources
-	Category  string
-	Buffer    *RingBuffer
-	Mode      string
+	Buffer    LogBuffer
+
+	out *output // output of logrus, see SetOutput
+
+	runID     string // ID of the run, see RunID
+	logsRunID bool   // logs hold the run ID as RUN_ID, with a memory-mapped buffer
+
+	overflowWait time.Duration // maximum time a log waits for room with BUFFER_OVERFLOW=block, 0 for none
+
+	mu       sync.RWMutex // guards category, mode and the transitions of the buffer
+	category string
+	mode     string
+
+	ttl             time.Duration // maximum age of buffered logs, 0 for none
+	janitorInterval time.Duration // interval of the janitor dropping expired logs
+	janitor         chan struct{} // closed to stop the janitor, nil without janitor
+	janitorRunning  int32         // 1 while the janitor runs, see startJanitor
+
+	flushWindow    time.Duration // age of the oldest log flushed, relative to the error, 0 for all
+	flushLast      int           // maximum number of logs flushed, the newest, 0 for all
+	flushDiscarded int           // number of buffered logs a flush discarded
+
+	captureRecords  int           // number of logs printed in CAPTURE_MODE after an error, 0 for no limit
+	captureDuration time.Duration // time spent in CAPTURE_MODE after an error, 0 for no limit
+	captureLeft     int           // number of logs left to print in CAPTURE_MODE
+	captureUntil    time.Time     // end of CAPTURE_MODE, zero for none
+
+	shipper *Shipper // ships flushed and plain logs to a sink, nil to print them to standard output
+
+	metricNamespace string          // namespace of the metrics published by Metric
+	metricResources map[string]bool // resource types which are dimensions of the metrics published by Metric
 }
 
 // Log struct
@@ -60,12 +111,28 @@ type Log struct {
 	Level    logrus.Level `json:"level"`
 	Message  string       `json:"msg"`
 	Resource interface{}  `json:"res"`
+	Category string       `json:"cat,omitempty"`
+	RunID    string       `json:"runId,omitempty"`
 	Time     time.Time    `json:"time"`
 }
 
+// output is the output of logrus, which writes to it without locking, see newAlways.
+type output struct {
+	mu sync.RWMutex // guards w, so it can be switched while logging
+	w  io.Writer
+}
+
+// Resources is safe for concurrent use. Writers publish a new immutable snapshot on every change.
 type Resources struct {
-	typeMap    map[string]string // resource type map
+	mu       sync.Mutex   // serializes writers
+	snapshot atomic.Value // *resourceSnapshot
+}
+
+// resourceSnapshot must not be modified once stored.
+type resourceSnapshot struct {
+	typeMap    map[string][]string // resource type map
 	printedStr string
+	limit      int // maximum number of ids per resource type
 }
 
 // LoggerHook ...
@@ -135,16 +202,23 @@ func new(_options LogOptions) *Logger {
 }
 
 func newAlways(_options LogOptions) *Logger {
+	out := &output{w: os.Stderr}
 	_logger := &Logger{
 		Logger: logrus.Logger{
-			Out:          os.Stderr,
+			Out:          out,
 			Hooks:        make(logrus.LevelHooks),
 			Level:        logrus.InfoLevel,
 			ExitFunc:     os.Exit,
 			ReportCaller: false,
 		},
 		Options: _options,
+		out:     out,
 	}
+	/*
+		Hooks fire concurrently, guarding the state of the logger themselves, so a log waiting for room in the buffer
+		does not keep an error from flushing it. The output of logrus is switched by SetOutput only, under a lock of its own.
+	*/
+	_logger.SetNoLock()
 	// Set json format.
 	_logger.SetFormatter(&logrus.JSONFormatter{
 		CallerPrettyfier: _logger.callerPrettyfier,
@@ -174,9 +248,9 @@ func newAlways(_options LogOptions) *Logger {
 	instance.WithFields(logrus.Fields{"logId": logId})
 	*/
 
-	// initialize buffer
-	_logger.Buffer = &RingBuffer{}
+	_logger.runID = GenerateRunId()
 
+	// initialize buffer
 	dbs, err := ParseUnit(os.Getenv("DEFAULT_BUFFER_SIZE"))
 	if err != nil {
 		dbs, _ = ParseUnit("1 MB")
@@ -192,12 +266,150 @@ func newAlways(_options LogOptions) *Logger {
 		extCoef, _ = ParseUnit("2 MB")
 	}
 
-	_logger.Buffer.Init(dbs, mbs, extCoef)
+	if _logger.Options&OPT_LOCK_FREE_BUFFER > 0 {
+		slots, err := strconv.Atoi(os.Getenv("BUFFER_SLOTS"))
+		if err != nil || slots <= 0 {
+			slots = DEFAULT_SLOTS
+		}
+		_logger.Buffer = NewMPSCBuffer(slots, mbs)
+	} else {
+		lowWater, err := ParseUnit(os.Getenv("BUFFER_LOW_WATER"))
+		if err != nil {
+			lowWater = dbs / 4
+		}
+
+		shrinkAfter, err := time.ParseDuration(os.Getenv("BUFFER_SHRINK_AFTER"))
+		if err != nil {
+			shrinkAfter = DEFAULT_SHRINK_AFTER
+		}
+
+		shrinkWrites, _ := strconv.Atoi(os.Getenv("BUFFER_SHRINK_WRITES"))
 
-	// set initial logger mode
-	if _logger.Mode != BUFFER_MODE {
-		_logger.Mode = BUFFER_MODE
+		overflow, err := ParseOverflowPolicy(os.Getenv("BUFFER_OVERFLOW"))
+		if err != nil {
+			overflow = OverflowDropOldest
+		}
+
+		overflowTimeout, err := time.ParseDuration(os.Getenv("BUFFER_OVERFLOW_TIMEOUT"))
+		if err != nil {
+			overflowTimeout = DEFAULT_OVERFLOW_TIMEOUT
+		}
+
+		// a log waiting for room must not hold mu, which the flush making room takes, so the hook waits instead of the buffer
+		if overflow == OverflowBlock {
+			_logger.overflowWait = overflowTimeout
+			overflow = OverflowError
+		}
+
+		rb, err := NewRingBuffer(dbs, mbs, extCoef)
+		if err != nil {
+			// inconsistent sizes in the environment, fall back to the defaults
+			dbs, _ = ParseUnit("1 MB")
+			mbs, _ = ParseUnit("5 MB")
+			extCoef, _ = ParseUnit("2 MB")
+			rb, _ = NewRingBuffer(dbs, mbs, extCoef)
+		}
+
+		mapped := false
+		if _logger.Options&OPT_MAPPED_BUFFER > 0 {
+			mmapFile := os.Getenv("BUFFER_MMAP_FILE")
+			if mmapFile == "" {
+				mmapFile = filepath.Join(os.TempDir(), filepath.Base(os.Args[0])+".s1buf")
+			}
+
+			// where memory mapping is not available, or another logger has the file, logs are buffered in memory as usual
+			if mrb, recovered, err := OpenMappedRingBuffer(mmapFile, mbs, _logger.runID); err == nil {
+				rb = mrb
+				mapped = true
+				emitRecovered(recovered)
+
+				// so the logs the next run recovers, tagged with PREVIOUS_RUN, can be matched with those of this run
+				_logger.logsRunID = true
+			}
+		}
+
+		if _logger.Options&OPT_CHECKSUM_RECORDS > 0 {
+			rb.SetFraming(FramingChecksum)
+		}
+
+		if _logger.Options&OPT_DISK_SPILL > 0 {
+			spillDir := os.Getenv("BUFFER_SPILL_DIR")
+			if spillDir == "" {
+				spillDir = os.TempDir()
+			}
+
+			spillSize, err := ParseUnit(os.Getenv("BUFFER_SPILL_SIZE"))
+			if err != nil {
+				spillSize, _ = ParseUnit("100 MB")
+			}
+
+			// without a usable directory, overwritten logs are dropped as usual
+			_ = rb.SetSpill(spillDir, spillSize)
+		}
+
+		// logs waiting for their batch would not survive a crash, a memory-mapped buffer stores them as they come
+		if _logger.Options&OPT_COMPRESS_RECORDS > 0 && !mapped {
+			batch, err := strconv.Atoi(os.Getenv("BUFFER_COMPRESS_BATCH"))
+			if err != nil || batch <= 0 {
+				batch = DEFAULT_COMPRESS_BATCH
+			}
+			_ = rb.SetCompression(flate.BestSpeed, batch)
+		}
+
+		// invalid quotas are ignored, logs are evicted by the overflow policy alone
+		quotas := append(parseQuotas(os.Getenv("BUFFER_LEVEL_QUOTAS"), true), parseQuotas(os.Getenv("BUFFER_CATEGORY_QUOTAS"), false)...)
+		_ = rb.SetQuotas(quotas...)
+
+		_logger.Buffer = rb.SetShrinkPolicy(ShrinkPolicy{
+			LowWater: lowWater,
+			After:    shrinkAfter,
+			Writes:   shrinkWrites,
+		}).SetOverflowPolicy(overflow, overflowTimeout)
+	}
+
+	// logs older than the time to live are dropped by the janitor in the background, started by the first buffered log
+	if ttl, err := time.ParseDuration(os.Getenv("BUFFER_TTL")); err == nil && ttl > 0 {
+		_logger.ttl = ttl
+
+		interval, err := time.ParseDuration(os.Getenv("BUFFER_TTL_JANITOR"))
+		if err != nil {
+			interval = ttl / 2
+		}
+		if interval > 0 {
+			_logger.janitorInterval = interval
+			_logger.janitor = make(chan struct{})
+		}
+	}
+
+	// a flush may only emit the logs just before the error, invalid values flush every log
+	if window, err := time.ParseDuration(os.Getenv("FLUSH_WINDOW")); err == nil && window > 0 {
+		_logger.flushWindow = window
+	}
+	if last, err := strconv.Atoi(os.Getenv("FLUSH_LAST_RECORDS")); err == nil && last > 0 {
+		_logger.flushLast = last
+	}
+
+	// after a flush, logs are printed for a while before buffering again, rather than for good
+	if records, err := strconv.Atoi(os.Getenv("CAPTURE_RECORDS")); err == nil && records > 0 {
+		_logger.captureRecords = records
 	}
+	if duration, err := time.ParseDuration(os.Getenv("CAPTURE_DURATION")); err == nil && duration > 0 {
+		_logger.captureDuration = duration
+	}
+
+	_logger.metricNamespace = os.Getenv("METRIC_NAMESPACE")
+	if _logger.metricNamespace == "" {
+		_logger.metricNamespace = DEFAULT_METRIC_NAMESPACE
+	}
+	_logger.metricResources = make(map[string]bool)
+	for _, t := range strings.Split(os.Getenv("METRIC_RESOURCE_DIMENSIONS"), ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			_logger.metricResources[t] = true
+		}
+	}
+
+	// set initial logger mode
+	_logger.mode = BUFFER_MODE
 
 	// disable logrus ability by default
 	_logger.disable()
@@ -205,6 +417,68 @@ func newAlways(_options LogOptions) *Logger {
 	return _logger
 }
 
+/*
+Returns the quotas of a comma separated list of name=min:max entries, shares in percent, e.g. "warn=30:100,debug=0:50".
+Names are levels if byLevel is set, categories otherwise. A maximum of 0 or 100 means no maximum. Invalid entries are skipped.
+*/
+func parseQuotas(value string, byLevel bool) []Quota {
+	var quotas []Quota
+	for _, entry := range strings.Split(value, ",") {
+		kv := strings.SplitN(strings.TrimSpace(entry), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		shares := strings.SplitN(kv[1], ":", 2)
+		if len(shares) != 2 {
+			continue
+		}
+		min, err1 := strconv.ParseFloat(shares[0], 64)
+		max, err2 := strconv.ParseFloat(shares[1], 64)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+
+		q := Quota{Category: kv[0], Min: min / 100, Max: max / 100}
+		if byLevel {
+			level, err := logrus.ParseLevel(kv[0])
+			if err != nil {
+				continue
+			}
+			q = Quota{Level: Level(level) + 1, Min: min / 100, Max: max / 100}
+		}
+		if q.Max == 1 {
+			q.Max = 0
+		}
+		quotas = append(quotas, q)
+	}
+	return quotas
+}
+
+// Prints the logs a previous run left in a memory-mapped buffer, tagged with the ID of that run.
+func emitRecovered(recovered *Recovered) {
+	if recovered == nil {
+		return
+	}
+
+	runId, _ := json.Marshal(recovered.RunID)
+	for _, log := range recovered.Records {
+		fmt.Println(tagLog(log, PREVIOUS_RUN, runId))
+	}
+}
+
+// Returns a JSON log with an additional field, put first so the other fields keep their order.
+func tagLog(log []byte, key string, value []byte) string {
+	if len(log) < 2 || log[0] != '{' {
+		return string(log)
+	}
+
+	field := fmt.Sprintf("%q:%s", key, value)
+	if rest := bytes.TrimSpace(log[1:]); len(rest) > 0 && rest[0] == '}' {
+		return "{" + field + "}"
+	}
+	return "{" + field + "," + string(log[1:])
+}
+
 // GenerateRunId ...
 func GenerateRunId() string {
 	rand.Seed(time.Now().UnixNano())
@@ -221,9 +495,9 @@ func GenerateRunId() string {
 // //////////////////////////////////////////////////////////////////////////////
 // Clear clear all resource types.
 func (r *Resources) Clear() *Resources {
-	r.typeMap = make(map[string]string)
-	r.printedStr = ""
-	return r
+	return r.update(func(s *resourceSnapshot) {
+		s.typeMap = make(map[string][]string)
+	})
 }
 
 // parseResource parse resource
@@ -237,7 +511,8 @@ func (r *Resources) parseResource(resource string) (string, string) {
 }
 
 // createKeyValuePairs convert map to string and separated by ','.
-func (r *Resources) createKeyValuePairs(m map[string]string) string {
+// A type carrying several ids is rendered as a list, e.g. D:[id1,id2].
+func (r *Resources) createKeyValuePairs(m map[string][]string) string {
 	keys := make([]string, 0, len(m))
 	for k := range m {
 		keys = append(keys, k)
@@ -249,28 +524,120 @@ func (r *Resources) createKeyValuePairs(m map[string]string) string {
 		if b.Len() > 0 {
 			fmt.Fprintf(b, ", ")
 		}
-		fmt.Fprintf(b, "%s:%s", k, m[k])
+		if ids := m[k]; len(ids) == 1 {
+			fmt.Fprintf(b, "%s:%s", k, ids[0])
+		} else {
+			fmt.Fprintf(b, "%s:[%s]", k, strings.Join(ids, ","))
+		}
 	}
 	return b.String()
 }
 
-// Set set resource type.
+// load returns the current snapshot.
+func (r *Resources) load() *resourceSnapshot {
+	if s, ok := r.snapshot.Load().(*resourceSnapshot); ok {
+		return s
+	}
+	return &resourceSnapshot{typeMap: map[string][]string{}, limit: MAX_RESOURCE_IDS}
+}
+
+// update applies fn to a copy of the current snapshot and publishes the copy.
+func (r *Resources) update(fn func(s *resourceSnapshot)) *Resources {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	cur := r.load()
+	next := &resourceSnapshot{typeMap: cur.object(), limit: cur.limit}
+	fn(next)
+	next.printedStr = r.createKeyValuePairs(next.typeMap)
+	r.snapshot.Store(next)
+	return r
+}
+
+// Set set resource type, replacing every id already held by the type.
 func (r *Resources) Set(resource string) *Resources {
 	t, id := r.parseResource(resource)
-	r.typeMap[t] = id
-	r.printedStr = r.createKeyValuePairs(r.typeMap)
-	return r
+	return r.update(func(s *resourceSnapshot) {
+		s.typeMap[t] = []string{id}
+	})
+}
+
+// Add add an id to the resource type. Ids beyond the limit are ignored.
+func (r *Resources) Add(resource string) *Resources {
+	t, id := r.parseResource(resource)
+	return r.update(func(s *resourceSnapshot) {
+		ids := s.typeMap[t]
+		if len(ids) < s.limit && indexOf(ids, id) < 0 {
+			s.typeMap[t] = append(ids, id)
+		}
+	})
+}
+
+// Remove remove a single id from the resource type.
+func (r *Resources) Remove(resource string) *Resources {
+	t, id := r.parseResource(resource)
+	return r.update(func(s *resourceSnapshot) {
+		ids := s.typeMap[t]
+		i := indexOf(ids, id)
+		if i < 0 {
+			return
+		}
+		if len(ids) == 1 {
+			delete(s.typeMap, t)
+		} else {
+			s.typeMap[t] = append(ids[:i], ids[i+1:]...)
+		}
+	})
 }
 
 // Unset unset specific resource type.
 func (r *Resources) Unset(resourceType string) *Resources {
-	delete(r.typeMap, resourceType)
-	r.printedStr = r.createKeyValuePairs(r.typeMap)
-	return r
+	return r.update(func(s *resourceSnapshot) {
+		delete(s.typeMap, resourceType)
+	})
+}
+
+// SetLimit set the maximum number of ids per resource type, trimming the newest ids of types over the limit.
+func (r *Resources) SetLimit(limit int) *Resources {
+	if limit <= 0 {
+		limit = MAX_RESOURCE_IDS
+	}
+	return r.update(func(s *resourceSnapshot) {
+		s.limit = limit
+		for t, ids := range s.typeMap {
+			if len(ids) > limit {
+				s.typeMap[t] = ids[:limit]
+			}
+		}
+	})
+}
+
+// Object returns a copy of the resources as a map of resource type to ids.
+func (r *Resources) Object() map[string][]string {
+	return r.load().object()
 }
 
 func (r *Resources) String() string {
-	return r.printedStr
+	return r.load().printedStr
+}
+
+// object returns a deep copy of the type map.
+func (s *resourceSnapshot) object() map[string][]string {
+	m := make(map[string][]string, len(s.typeMap))
+	for t, ids := range s.typeMap {
+		m[t] = append([]string(nil), ids...)
+	}
+	return m
+}
+
+// Check the position of an id in a list of ids
+func indexOf(ids []string, id string) int {
+	for i, v := range ids {
+		if v == id {
+			return i
+		}
+	}
+	return -1
 }
 
 ////////////////////////////////////////////////////////////////////////////////
@@ -301,7 +668,19 @@ func (l *Logger) SetResource(resource string) *Logger {
 	return l
 }
 
-// UnsetResource set resource.
+// AddResource add one more id to a resource type.
+func (l *Logger) AddResource(resource string) *Logger {
+	l.Resources.Add(resource)
+	return l
+}
+
+// RemoveResource remove a single id from a resource type.
+func (l *Logger) RemoveResource(resource string) *Logger {
+	l.Resources.Remove(resource)
+	return l
+}
+
+// UnsetResource unset all ids of a resource type.
 func (l *Logger) UnsetResource(resourceType string) *Logger {
 	l.Resources.Unset(resourceType)
 	return l
@@ -315,46 +694,284 @@ func (l *Logger) ClearResource() *Logger {
 
 // SetCategory set category.
 func (l *Logger) SetCategory(category string) *Logger {
-	l.Category = category
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.category = category
 	return l
 }
 
 // ClearCategory clear category.
 func (l *Logger) ClearCategory() *Logger {
-	l.Category = ""
+	return l.SetCategory("")
+}
+
+/*
+RunID returns the ID of the run, generated by NewAlways. With a memory-mapped buffer, logs hold it as RUN_ID,
+and the next run tags the logs it recovers with it as PREVIOUS_RUN.
+*/
+func (l *Logger) RunID() string {
+	return l.runID
+}
+
+// Category returns the current category.
+func (l *Logger) Category() string {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.category
+}
+
+// SetMode switch the logger between BUFFER_MODE, PLAIN_MODE and CAPTURE_MODE.
+func (l *Logger) SetMode(mode string) *Logger {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.mode = mode
 	return l
 }
 
+// Mode returns the current mode.
+func (l *Logger) Mode() string {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.mode
+}
+
 // ClearAll clear all extra fields and clears buffered logs.
 func (l *Logger) ClearAll() *Logger {
 	l.ClearResource()
-	l.ClearCategory()
-	l.Mode = BUFFER_MODE
+
+	l.mu.Lock()
+	l.category = ""
+	l.mode = BUFFER_MODE
 	l.Buffer.Reset()
+	l.mu.Unlock()
+
 	l.recover()
 	return l
 }
 
-// Disable logrus.
-func (l *Logger) disable() {
-	if l.Out == io.Discard {
+// Enters CAPTURE_MODE for the logs following an error at a given time. The caller must hold the write lock.
+func (l *Logger) startCapture(at time.Time) {
+	l.mode = CAPTURE_MODE
+	l.captureLeft = l.captureRecords
+	l.captureUntil = time.Time{}
+	if l.captureDuration > 0 {
+		l.captureUntil = at.Add(l.captureDuration)
+	}
+}
+
+// Goes back to BUFFER_MODE once the capture duration has passed at a given time.
+func (l *Logger) endCapture(at time.Time) {
+	if l.Mode() != CAPTURE_MODE {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.mode == CAPTURE_MODE && !l.captureUntil.IsZero() && !at.Before(l.captureUntil) {
+		l.mode = BUFFER_MODE
+	}
+}
+
+// Counts a log printed in CAPTURE_MODE, and goes back to BUFFER_MODE after the last one.
+func (l *Logger) countCapture() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.mode == CAPTURE_MODE && l.captureRecords > 0 {
+		if l.captureLeft--; l.captureLeft <= 0 {
+			l.mode = BUFFER_MODE
+		}
+	}
+}
+
+/*
+SetSink ships flushed and plain logs to sink from a background goroutine, instead of printing them to standard output,
+see Shipper. The shipper is configured by the SHIP_* environment variables. A previous shipper is closed, nil restores printing.
+*/
+func (l *Logger) SetSink(sink Sink) *Logger {
+	var shipper *Shipper
+	if sink != nil {
+		shipper = NewShipper(sink, shipperOptions())
+	}
+
+	l.mu.Lock()
+	previous := l.shipper
+	l.shipper = shipper
+	l.mu.Unlock()
+
+	if previous != nil {
+		_ = previous.Close()
+	}
+	return l
+}
+
+// RingBuffer returns the buffer as a *RingBuffer, for its methods out of LogBuffer. Returns nil with OPT_LOCK_FREE_BUFFER.
+func (l *Logger) RingBuffer() *RingBuffer {
+	rb, _ := l.Buffer.(*RingBuffer)
+	return rb
+}
+
+// Shipper returns the shipper set by SetSink, nil if there is none.
+func (l *Logger) Shipper() *Shipper {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.shipper
+}
+
+// Returns the options of a shipper from the environment, invalid values standing for the defaults.
+func shipperOptions() ShipperOptions {
+	var options ShipperOptions
+	options.QueueSize, _ = strconv.Atoi(os.Getenv("SHIP_QUEUE_SIZE"))
+	options.BatchSize, _ = strconv.Atoi(os.Getenv("SHIP_BATCH_SIZE"))
+	options.MaxRetries, _ = strconv.Atoi(os.Getenv("SHIP_MAX_RETRIES"))
+	options.Interval, _ = time.ParseDuration(os.Getenv("SHIP_INTERVAL"))
+	options.MinBackoff, _ = time.ParseDuration(os.Getenv("SHIP_MIN_BACKOFF"))
+	options.MaxBackoff, _ = time.ParseDuration(os.Getenv("SHIP_MAX_BACKOFF"))
+	options.CloseTimeout, _ = time.ParseDuration(os.Getenv("SHIP_CLOSE_TIMEOUT"))
+	return options
+}
+
+// Prints a log, such as a flushed log or a metric, to standard output, or queues it to the shipper if there is one.
+func emit(shipper *Shipper, log []byte) {
+	if shipper != nil {
+		// a full queue drops the log, counted by the shipper
+		_ = shipper.Ship(log)
 		return
 	}
+	fmt.Println(string(log))
+}
+
+// FlushDiscarded returns the number of buffered logs flushes discarded, out of FLUSH_WINDOW, FLUSH_LAST_RECORDS or BUFFER_TTL.
+func (l *Logger) FlushDiscarded() int {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.flushDiscarded
+}
+
+// BufferDropped returns the number of logs the buffer had no room for, with BUFFER_OVERFLOW set to block or error.
+func (l *Logger) BufferDropped() int {
+	return int(atomic.LoadInt64(&l.bufferDropped))
+}
+
+/*
+Close drops buffered logs, stops the janitor and releases the resources of the buffer, such as the temporary files of a disk spill.
+The logs queued to the shipper are shipped, up to SHIP_CLOSE_TIMEOUT.
+*/
+func (l *Logger) Close() error {
+	l.mu.Lock()
+	if l.janitor != nil {
+		close(l.janitor)
+		l.janitor = nil
+	}
+	err := l.Buffer.Close()
+	shipper := l.shipper
+	l.shipper = nil
+	l.mu.Unlock()
+
+	// logging goes on while the shipper drains
+	if shipper != nil {
+		if e := shipper.Close(); err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+/*
+Starts the janitor, unless it runs already or there is none. Called with mu held,
+so the janitor cannot stop between the write of a log and the check.
+*/
+func (l *Logger) startJanitor() {
+	if l.janitor != nil && atomic.CompareAndSwapInt32(&l.janitorRunning, 0, 1) {
+		go l.runJanitor(l.janitorInterval, l.janitor)
+	}
+}
+
+/*
+Drops the buffered logs older than the time to live every interval, until stop is closed, the buffer is empty
+or the logger leaves BUFFER_MODE. The next buffered log starts it again, so the janitor of a logger nobody uses
+stops once its logs expired, and does not keep the logger from being garbage collected.
+*/
+func (l *Logger) runJanitor(interval time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			l.mu.Lock()
+			if l.mode == BUFFER_MODE {
+				l.Buffer.DropRecords(expiredBefore(now.Add(-l.ttl)))
+			}
+			idle := l.mode != BUFFER_MODE || l.Buffer.IsEmpty()
+			if idle {
+				atomic.StoreInt32(&l.janitorRunning, 0)
+			}
+			l.mu.Unlock()
+
+			if idle {
+				return
+			}
+		}
+	}
+}
+
+// Returns the time before which buffered logs are not flushed for an error at a given time, zero if there is none.
+func (l *Logger) flushDeadline(at time.Time) time.Time {
+	var deadline time.Time
+	if l.ttl > 0 {
+		deadline = at.Add(-l.ttl)
+	}
+	if l.flushWindow > 0 && (deadline.IsZero() || at.Add(-l.flushWindow).After(deadline)) {
+		deadline = at.Add(-l.flushWindow)
+	}
+	return deadline
+}
+
+// Returns a function telling if a buffered log was recorded before deadline. Logs without a readable time are kept.
+func expiredBefore(deadline time.Time) func(p []byte) bool {
+	return func(p []byte) bool {
+		var log struct {
+			Time time.Time `json:"time"`
+		}
+		return json.Unmarshal(p, &log) == nil && !log.Time.IsZero() && log.Time.Before(deadline)
+	}
+}
+
+// Write writes p to the current output.
+func (o *output) Write(p []byte) (int, error) {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	return o.w.Write(p)
+}
+
+// SetOutput sets the output of logrus. Unlike logrus.Logger.SetOutput, it may be called while logging.
+func (l *Logger) SetOutput(out io.Writer) {
+	l.out.mu.Lock()
+	defer l.out.mu.Unlock()
+	l.out.w = out
+}
+
+// Disable logrus.
+func (l *Logger) disable() {
 	l.SetOutput(io.Discard)
 }
 
 // Restore logrus.
 func (l *Logger) recover() {
-	if l.Out == os.Stderr {
-		return
-	}
 	l.SetOutput(os.Stderr)
 }
 
 // Wrap and construct ringlog given logrus entry
 func (l *Logger) logWrapper(entry *logrus.Entry) *Log {
 	function, file := l.callerPrettyfier(entry.Caller)
+	category, _ := entry.Data[CATEGORY].(string)
 
+	var runID string
+	if l.logsRunID {
+		runID = l.runID
+	}
 	return &Log{
 		Message:  entry.Message,
 		Level:    entry.Level,
@@ -362,6 +979,8 @@ func (l *Logger) logWrapper(entry *logrus.Entry) *Log {
 		Function: function,
 		File:     file,
 		Resource: entry.Data[RESOURCE],
+		Category: category,
+		RunID:    runID,
 	}
 }
 
@@ -423,11 +1042,19 @@ func (h LoggerHook) Levels() []logrus.Level {
 func (h LoggerHook) Fire(entry *logrus.Entry) error {
 	// fmt.Println("[logrus hook]: enter LoggerHook")
 
-	if len(h.Logger.Resources.String()) > 0 {
-		entry.Data[RESOURCE] = h.Logger.Resources.String()
+	// the log following the capture window is buffered again
+	h.Logger.endCapture(entry.Time)
+
+	res := h.Logger.Resources.load()
+	if len(res.printedStr) > 0 {
+		if h.Logger.Options&OPT_RESOURCE_OBJECT > 0 {
+			entry.Data[RESOURCE] = res.object()
+		} else {
+			entry.Data[RESOURCE] = res.printedStr
+		}
 	}
-	if len(h.Logger.Category) > 0 {
-		entry.Data[CATEGORY] = h.Logger.Category
+	if category := h.Logger.Category(); len(category) > 0 {
+		entry.Data[CATEGORY] = category
 	}
 	return nil
 }
@@ -447,8 +1074,40 @@ func (hBuffer LoggerHookBuffer) Levels() []logrus.Level {
 // Fire to buffer logs
 func (hBuffer LoggerHookBuffer) Fire(entry *logrus.Entry) error {
 
-	if hBuffer.Logger.Mode != BUFFER_MODE {
-		return nil
+	var deadline time.Time
+	for {
+		freed, err := hBuffer.write(entry)
+		if freed == nil {
+			return err
+		}
+
+		// wait for a flush or the janitor to make room, without the lock they take
+		if deadline.IsZero() {
+			deadline = time.Now().Add(hBuffer.Logger.overflowWait)
+		}
+		timer := time.NewTimer(time.Until(deadline))
+		select {
+		case <-freed:
+			timer.Stop()
+		case <-timer.C:
+			atomic.AddInt64(&hBuffer.Logger.bufferDropped, 1)
+			return nil
+		}
+	}
+}
+
+/*
+Buffers a log in BUFFER_MODE. A log the buffer has no room for is dropped and counted, unless it may wait for room,
+in which case a channel closed once there is room is returned, to be waited on without the lock before writing again.
+*/
+func (hBuffer LoggerHookBuffer) write(entry *logrus.Entry) (<-chan struct{}, error) {
+
+	hBuffer.Logger.mu.RLock()
+	defer hBuffer.Logger.mu.RUnlock()
+
+	// a flush may have happened while waiting for room, the log is then printed by LoggerHookPlain
+	if hBuffer.Logger.mode != BUFFER_MODE {
+		return nil, nil
 	}
 
 	// fmt.Println("[logrus hook]: enter LoggerHookBuffer")
@@ -457,27 +1116,23 @@ func (hBuffer LoggerHookBuffer) Fire(entry *logrus.Entry) error {
 	log := hBuffer.Logger.logWrapper(entry)
 	jLog, err := json.Marshal(log)
 	if err != nil {
-		return err
-	}
-
-	// buffer length of log to be written in little endian
-	sLog := string(jLog)
-	l := len(sLog)
-	buf := make([]byte, 4)
-	binary.LittleEndian.PutUint32(buf, uint32(l))
-
-	n, err := hBuffer.Logger.Buffer.Write(buf)
-	if n != 4 || err != nil {
-		return err
+		return nil, err
 	}
 
-	// buffer actual log
-	n, err = hBuffer.Logger.Buffer.Write([]byte(sLog))
-	if n != l || err != nil {
-		return err
+	// buffer log as a single record, tagged with its level and category for eviction
+	err = hBuffer.Logger.Buffer.WriteRecordCategory(jLog, Level(entry.Level)+1, hBuffer.Logger.category)
+	if errors.Is(err, ErrFull) {
+		// the channel is taken before the lock is released, so the room made by a flush in between is not missed
+		if rb := hBuffer.Logger.RingBuffer(); rb != nil && hBuffer.Logger.overflowWait > 0 {
+			return rb.Freed(), nil
+		}
+		atomic.AddInt64(&hBuffer.Logger.bufferDropped, 1)
+		err = nil
 	}
 
-	return nil
+	// expired logs are left to the janitor, and skipped by the flush
+	hBuffer.Logger.startJanitor()
+	return nil, err
 }
 
 // Levels for LoggerHookFlush ...
@@ -494,34 +1149,73 @@ func (hFlush LoggerHookFlush) Levels() []logrus.Level {
 // Fire to flush out logs
 func (hFlush LoggerHookFlush) Fire(entry *logrus.Entry) error {
 
-	if hFlush.Logger.Mode != BUFFER_MODE {
+	logs, shipper := hFlush.drain(entry)
+
+	// emitted once the lock is released, so a slow output does not stall every goroutine logging
+	if shipper != nil {
+		// queued as a single entry, so a flush does not overflow the queue, nor waits for room in it
+		_ = shipper.ShipBatch(logs)
 		return nil
 	}
+	for _, stdLog := range logs {
+		emit(nil, stdLog)
+	}
+	return nil
+}
+
+// Takes the logs to flush out of the buffer and leaves BUFFER_MODE, returning the logs and the shipper to emit them to.
+func (hFlush LoggerHookFlush) drain(entry *logrus.Entry) ([][]byte, *Shipper) {
+
+	// hold the lock while draining, so no log is buffered after the drain or lost in between
+	hFlush.Logger.mu.Lock()
+	defer hFlush.Logger.mu.Unlock()
+
+	// another error restarts the capture window, there is nothing buffered to flush
+	if hFlush.Logger.mode == CAPTURE_MODE {
+		hFlush.Logger.startCapture(entry.Time)
+		return nil, nil
+	}
+	if hFlush.Logger.mode != BUFFER_MODE {
+		return nil, nil
+	}
 
 	// fmt.Println("[logrus hook]: enter LoggerHookFlush")
 
-	// flush all logs from buffer
-	for !hFlush.Logger.Buffer.IsEmpty() {
-		buf := make([]byte, 4)
-		n, err := hFlush.Logger.Buffer.Read(buf)
-		if n != 4 || err != nil {
-			return err
+	// flush all logs from buffer, but those out of the flush window or older than the time to live
+	var expired func(p []byte) bool
+	if deadline := hFlush.Logger.flushDeadline(entry.Time); !deadline.IsZero() {
+		expired = expiredBefore(deadline)
+	}
+	var logs [][]byte
+	for {
+		stdLog, err := hFlush.Logger.Buffer.ReadRecord()
+		if errors.Is(err, ErrBadRecord) {
+			// malformed data has been dropped, keep flushing the rest
+			continue
 		}
-
-		l := int(binary.LittleEndian.Uint32(buf))
-		buf = make([]byte, l)
-		n, err = hFlush.Logger.Buffer.Read(buf)
-		if n != l || err != nil {
-			return err
+		if err != nil {
+			// empty, or nothing was consumed and reading again would fail the same way
+			break
+		}
+		if expired != nil && expired(stdLog) {
+			hFlush.Logger.flushDiscarded++
+			continue
 		}
+		logs = append(logs, stdLog)
+	}
 
-		stdLog := bytes.NewBuffer(buf).String()
-		fmt.Println(stdLog)
+	if last := hFlush.Logger.flushLast; last > 0 && len(logs) > last {
+		hFlush.Logger.flushDiscarded += len(logs) - last
+		logs = logs[len(logs)-last:]
 	}
 
-	hFlush.Logger.Mode = PLAIN_MODE
+	if hFlush.Logger.captureRecords > 0 || hFlush.Logger.captureDuration > 0 {
+		hFlush.Logger.startCapture(entry.Time)
+	} else {
+		hFlush.Logger.mode = PLAIN_MODE
+	}
 
-	return nil
+	return logs, hFlush.Logger.shipper
 }
 
 // Levels for LoggerHookPlain ...
@@ -542,7 +1236,8 @@ func (hPlain LoggerHookPlain) Levels() []logrus.Level {
 // Fire to console log to standard output
 func (hPlain LoggerHookPlain) Fire(entry *logrus.Entry) error {
 
-	if hPlain.Logger.Mode != PLAIN_MODE {
+	mode := hPlain.Logger.Mode()
+	if mode != PLAIN_MODE && mode != CAPTURE_MODE {
 		return nil
 	}
 
@@ -553,6 +1248,11 @@ func (hPlain LoggerHookPlain) Fire(entry *logrus.Entry) error {
 	if err != nil {
 		return err
 	}
-	fmt.Println(string(jLog))
+	emit(hPlain.Logger.Shipper(), jLog)
+
+	// errors restart the capture window rather than count in it
+	if mode == CAPTURE_MODE && entry.Level > logrus.ErrorLevel {
+		hPlain.Logger.countCapture()
+	}
 	return nil
 }
@@ -0,0 +1,77 @@
+package logger_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	s1logger "gitlab-smartgaia.sercomm.com/s1util/logger"
+	. "gitlab-smartgaia.sercomm.com/s1util/logger/buffer"
+)
+
+func TestMappedBuffer_Recover(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logger_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Setenv("BUFFER_MMAP_FILE", filepath.Join(dir, "buffer"))
+	defer os.Unsetenv("BUFFER_MMAP_FILE")
+
+	// a run buffering logs without flushing them, then killed
+	l := s1logger.NewAlways(s1logger.OPT_DEFAULT | s1logger.OPT_MAPPED_BUFFER)
+	for i := 0; i < 3; i++ {
+		l.Debug(makeMsg(strconv.Itoa(i)))
+	}
+	assert.Equal(t, 3, l.Buffer.(*RingBuffer).RecordCount())
+
+	// another logger of the file buffers in memory, leaving the records of the live one alone
+	lines := captureStdout(t, func() {
+		other := s1logger.NewAlways(s1logger.OPT_DEFAULT | s1logger.OPT_MAPPED_BUFFER)
+		other.Debug(makeMsg("OTHER"))
+		assert.Equal(t, 1, other.Buffer.(*RingBuffer).RecordCount())
+	})
+	assert.Empty(t, lines)
+	assert.Equal(t, 3, l.Buffer.(*RingBuffer).RecordCount())
+
+	// the next run, given the file as the killed run left it, emits them first, tagged with the ID of the killed run,
+	// which its logs held as well
+	data, err := ioutil.ReadFile(filepath.Join(dir, "buffer"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "crashed"), data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("BUFFER_MMAP_FILE", filepath.Join(dir, "crashed"))
+
+	var next *s1logger.Logger
+	lines = captureStdout(t, func() {
+		next = s1logger.NewAlways(s1logger.OPT_DEFAULT | s1logger.OPT_MAPPED_BUFFER)
+	})
+	if assert.Len(t, lines, 3) {
+		for i, line := range lines {
+			log := map[string]interface{}{}
+			assert.NoError(t, json.Unmarshal([]byte(line), &log))
+			assert.Equal(t, l.RunID(), log[s1logger.PREVIOUS_RUN])
+			assert.Equal(t, l.RunID(), log[s1logger.RUN_ID])
+			assert.Equal(t, makeMsg(strconv.Itoa(i)), log["msg"])
+		}
+	}
+	assert.True(t, next.Buffer.IsEmpty())
+	assert.Len(t, next.RunID(), 10)
+	assert.NotEqual(t, l.RunID(), next.RunID())
+
+	// a closed logger leaves nothing behind
+	next.Debug(makeMsg("DEBUG"))
+	assert.NoError(t, next.Close())
+	lines = captureStdout(t, func() {
+		s1logger.NewAlways(s1logger.OPT_DEFAULT | s1logger.OPT_MAPPED_BUFFER).Close()
+	})
+	assert.Empty(t, lines)
+	assert.NoError(t, l.Close())
+}
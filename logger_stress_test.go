@@ -0,0 +1,164 @@
+package logger_test
+
+import (
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	s1logger "gitlab-smartgaia.sercomm.com/s1util/logger"
+	. "gitlab-smartgaia.sercomm.com/s1util/logger/buffer"
+)
+
+// Stress tests are meant to be run with the race detector, see `make test-race`.
+
+const (
+	stressWorkers    = 8
+	stressIterations = 500
+)
+
+// silenceStdout discards flushed logs for the duration of a stress test.
+func silenceStdout(t *testing.T) func() {
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatalf("open %s failed: %v", os.DevNull, err)
+	}
+	stdout := os.Stdout
+	os.Stdout = devNull
+	return func() {
+		os.Stdout = stdout
+		devNull.Close()
+	}
+}
+
+// restoreState puts the shared logger back to the state prepared by setup.
+func restoreState() {
+	logger.ClearAll()
+	logger.SetOutput(io.Discard)
+	logger.SetResource(UserResource).SetResource(DeviceResource).SetCategory(Category)
+}
+
+func TestStress_Resources(t *testing.T) {
+	r := (&s1logger.Resources{}).Clear().SetLimit(4)
+
+	var wg sync.WaitGroup
+	for i := 0; i < stressWorkers; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < stressIterations; j++ {
+				id := "D:" + strconv.Itoa(j%8)
+				switch j % 5 {
+				case 0:
+					r.Set(id)
+				case 1, 2:
+					r.Add(id)
+				case 3:
+					r.Remove(id)
+				case 4:
+					r.Unset("D")
+				}
+			}
+		}(i)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < stressIterations; j++ {
+				assert.LessOrEqual(t, len(r.Object()["D"]), 4)
+				assert.LessOrEqual(t, strings.Count(r.String(), ","), 3)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestStress_Logger(t *testing.T) {
+	defer restoreState()
+	defer silenceStdout(t)()
+	resetMode()
+
+	var wg sync.WaitGroup
+	for i := 0; i < stressWorkers; i++ {
+		wg.Add(3)
+
+		// loggers
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < stressIterations; j++ {
+				switch j % 3 {
+				case 0:
+					logger.Debug(makeMsg("DEBUG" + strconv.Itoa(j)))
+				case 1:
+					logger.Info(makeMsg("INFO" + strconv.Itoa(j)))
+				case 2:
+					logger.Warn(makeMsg("WARN" + strconv.Itoa(j)))
+				}
+			}
+		}(i)
+
+		// state writers
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < stressIterations; j++ {
+				switch j % 4 {
+				case 0:
+					logger.SetResource(DeviceResource)
+				case 1:
+					logger.AddResource("D:" + strconv.Itoa(i))
+				case 2:
+					logger.RemoveResource("D:" + strconv.Itoa(i))
+				case 3:
+					logger.SetCategory(Category + strconv.Itoa(i))
+				}
+			}
+		}(i)
+
+		// flushers
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < stressIterations/50; j++ {
+				switch j % 3 {
+				case 0:
+					logger.Error(makeMsg("ERROR" + strconv.Itoa(j)))
+				case 1:
+					logger.SetMode(s1logger.BUFFER_MODE)
+				case 2:
+					logger.ClearAll()
+					logger.SetOutput(io.Discard)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// whatever the interleaving, the buffer holds whole logs only
+	countRecords(t, logger.Buffer.(*RingBuffer))
+}
+
+func TestStress_LockFreeLogger(t *testing.T) {
+	defer silenceStdout(t)()
+
+	l := s1logger.NewAlways(s1logger.OPT_DEFAULT | s1logger.OPT_LOCK_FREE_BUFFER)
+	l.SetResource(DeviceResource)
+
+	var wg sync.WaitGroup
+	for i := 0; i < stressWorkers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < stressIterations; j++ {
+				l.Debug(makeMsg("DEBUG" + strconv.Itoa(j)))
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	assert.False(t, l.Buffer.IsEmpty())
+	assert.LessOrEqual(t, l.Buffer.Length(), l.Buffer.Capacity())
+
+	l.Error(makeMsg("ERROR"))
+	assert.True(t, l.Buffer.IsEmpty())
+	assert.Equal(t, s1logger.PLAIN_MODE, l.Mode())
+}
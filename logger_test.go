@@ -1,12 +1,21 @@
 package logger_test
 
 import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"math"
 	"os"
+	"runtime"
 	"strconv"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 	s1logger "gitlab-smartgaia.sercomm.com/s1util/logger"
 	. "gitlab-smartgaia.sercomm.com/s1util/logger/buffer"
@@ -22,7 +31,7 @@ const (
 
 var (
 	logLevel          string = "error"
-	logger            s1logger.Logger
+	logger            *s1logger.Logger
 	expectedCategory  string = ""
 	expectedResources string = ""
 )
@@ -31,6 +40,56 @@ func makeMsg(logLevel string) string {
 	return fmt.Sprintf("log w/ resource, %s level", logLevel)
 }
 
+// countRecords walks the length prefixed logs held by the buffer and returns how many there are.
+// Every length prefix is followed by the tag of the log.
+func countRecords(t *testing.T, buf *RingBuffer) int {
+	data := buf.Bytes()
+	count := 0
+	for len(data) > 0 {
+		if !assert.GreaterOrEqual(t, len(data), RecordHeaderSize) {
+			return count
+		}
+		l := int(binary.LittleEndian.Uint32(data[:4]))
+		if !assert.GreaterOrEqual(t, len(data), RecordHeaderSize+l) {
+			return count
+		}
+		data = data[RecordHeaderSize+l:]
+		count++
+	}
+	return count
+}
+
+// captureStdout returns the lines fn prints to standard output, such as flushed logs.
+func captureStdout(t *testing.T, fn func()) []string {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("pipe failed: %v", err)
+	}
+	done := make(chan []byte)
+	go func() {
+		data, _ := ioutil.ReadAll(r)
+		done <- data
+	}()
+
+	stdout := os.Stdout
+	os.Stdout = w
+	fn()
+	os.Stdout = stdout
+	w.Close()
+
+	data := <-done
+	r.Close()
+	if len(data) == 0 {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+// resetMode puts the shared logger back into buffering, as a fresh session would be.
+func resetMode() {
+	logger.SetMode(s1logger.BUFFER_MODE)
+}
+
 func setup() {
 	fmt.Println("[logger_test]: enter setup")
 
@@ -41,7 +100,9 @@ func setup() {
 	os.Setenv("EXTEND_COEFFICIENT", "1 KB")
 
 	// Initialize s1 logger
-	logger = *s1logger.New()
+	logger = s1logger.New()
+	// Keep the test binary alive when fatal logs are emitted.
+	logger.ExitFunc = func(int) {}
 	// logger.SetLevel(logrus.DebugLevel)
 	logger.SetResource(RegionResource).SetResource(UserResource).SetResource(DeviceResource).SetCategory(Category)
 	logger.UnsetResource("R")
@@ -78,7 +139,7 @@ func TestMain(m *testing.M) {
 }
 
 func TestNew(t *testing.T) {
-	buf := logger.Buffer
+	buf := logger.Buffer.(*RingBuffer)
 
 	assert.False(t, buf.IsFull())
 	assert.True(t, buf.IsEmpty())
@@ -89,7 +150,7 @@ func TestNew(t *testing.T) {
 	data := make([]byte, 4)
 	n, err := buf.Read(data)
 	assert.Equal(t, 0, n)
-	assert.Error(t, ErrIsEmpty, err)
+	assert.Equal(t, io.EOF, err)
 }
 
 func TestTrace(t *testing.T) {
@@ -98,7 +159,7 @@ func TestTrace(t *testing.T) {
 	msg := makeMsg("TRACE")
 	logger.Trace(msg)
 
-	buf := logger.Buffer
+	buf := logger.Buffer.(*RingBuffer)
 
 	assert.False(t, buf.IsFull())
 	assert.True(t, buf.IsEmpty())
@@ -113,13 +174,13 @@ func TestDebug(t *testing.T) {
 	msg := makeMsg("DEBUG")
 	logger.Debug(msg)
 
-	buf := logger.Buffer
+	buf := logger.Buffer.(*RingBuffer)
 
 	assert.False(t, buf.IsFull())
 	assert.False(t, buf.IsEmpty())
 	assert.Equal(t, int(math.Round(KB)), buf.Capacity())
-	assert.Equal(t, 224, buf.Length())
-	assert.Equal(t, 224, buf.VirtualLength())
+	assert.Equal(t, 1, countRecords(t, buf))
+	assert.Equal(t, buf.Length(), buf.VirtualLength())
 }
 
 func TestFatal(t *testing.T) {
@@ -129,13 +190,14 @@ func TestFatal(t *testing.T) {
 
 	logger.Fatal(msgFatal)
 
-	buf := logger.Buffer
+	buf := logger.Buffer.(*RingBuffer)
 
 	assert.True(t, buf.IsEmpty())
 	assert.False(t, buf.IsFull())
 }
 
 func TestError(t *testing.T) {
+	resetMode()
 
 	// test ERROR level
 	msgError1 := makeMsg("ERROR1")
@@ -143,21 +205,21 @@ func TestError(t *testing.T) {
 	msgDebug2 := makeMsg("DEBUG2")
 	msgDebug3 := makeMsg("DEBUG3")
 
-	buf := logger.Buffer
+	buf := logger.Buffer.(*RingBuffer)
 
 	assert.True(t, buf.IsEmpty())
 
 	logger.Debug(msgDebug1)
-	assert.Equal(t, 225, buf.Length())
-	assert.Equal(t, 225, buf.VirtualLength())
+	assert.Equal(t, 1, countRecords(t, buf))
+	assert.Equal(t, buf.Length(), buf.VirtualLength())
 
 	logger.Debug(msgDebug2)
-	assert.Equal(t, 450, buf.Length())
-	assert.Equal(t, 450, buf.VirtualLength())
+	assert.Equal(t, 2, countRecords(t, buf))
+	assert.Equal(t, buf.Length(), buf.VirtualLength())
 
 	logger.Debug(msgDebug3)
-	assert.Equal(t, 675, buf.Length())
-	assert.Equal(t, 675, buf.VirtualLength())
+	assert.Equal(t, 3, countRecords(t, buf))
+	assert.Equal(t, buf.Length(), buf.VirtualLength())
 
 	assert.False(t, buf.IsEmpty())
 
@@ -169,6 +231,7 @@ func TestError(t *testing.T) {
 }
 
 func TestMultiError(t *testing.T) {
+	resetMode()
 
 	// test multi ERROR level
 	msgError1 := makeMsg("ERROR1")
@@ -179,7 +242,7 @@ func TestMultiError(t *testing.T) {
 	msgInfo1 := makeMsg("INFO1")
 	msgInfo2 := makeMsg("INFO2")
 
-	buf := logger.Buffer
+	buf := logger.Buffer.(*RingBuffer)
 
 	assert.True(t, buf.IsEmpty())
 
@@ -211,7 +274,7 @@ func TestEmptyError(t *testing.T) {
 	// test ERROR behavior when buffer is empty
 	msgError := makeMsg("ERROR")
 
-	buf := logger.Buffer
+	buf := logger.Buffer.(*RingBuffer)
 
 	assert.True(t, buf.IsEmpty())
 
@@ -223,7 +286,7 @@ func TestEmptyError(t *testing.T) {
 func TestFull_OverFlowBuffer(t *testing.T) {
 
 	// test ERROR behavior when buffer is full
-	buf := logger.Buffer
+	buf := logger.Buffer.(*RingBuffer)
 
 	for i := 1; i <= 20; i++ {
 		msgDebug := makeMsg(strconv.Itoa(i))
@@ -237,3 +300,543 @@ func TestFull_OverFlowBuffer(t *testing.T) {
 
 	logger.Info("After Error")
 }
+
+func TestNewAlways_IndependentBuffers(t *testing.T) {
+	l1 := s1logger.NewAlways(s1logger.OPT_DEFAULT)
+	l2 := s1logger.NewAlways(s1logger.OPT_DEFAULT)
+
+	l1.Debug(makeMsg("DEBUG"))
+	l2.Debug(makeMsg("DEBUG"))
+	l2.Debug(makeMsg("DEBUG"))
+
+	buf1, buf2 := l1.Buffer.(*RingBuffer), l2.Buffer.(*RingBuffer)
+	assert.NotSame(t, buf1, buf2)
+	assert.NotSame(t, logger.Buffer, buf1)
+	assert.Equal(t, 1, countRecords(t, buf1))
+	assert.Equal(t, 2, countRecords(t, buf2))
+
+	// inconsistent sizes fall back to the defaults
+	os.Setenv("MAXIMUM_BUFFER_SIZE", "512 B")
+	defer os.Setenv("MAXIMUM_BUFFER_SIZE", "2 KB")
+
+	l3 := s1logger.NewAlways(s1logger.OPT_DEFAULT)
+	l3.Debug(makeMsg("DEBUG"))
+	buf3 := l3.Buffer.(*RingBuffer)
+	assert.Equal(t, int(MB), buf3.Capacity())
+	assert.Equal(t, 1, countRecords(t, buf3))
+}
+
+// stuckBuffer fails every read without consuming anything.
+type stuckBuffer struct {
+	LogBuffer
+}
+
+func (stuckBuffer) ReadRecord() ([]byte, error) {
+	return nil, errors.New("device unavailable")
+}
+
+func TestFlush_ReadError(t *testing.T) {
+	l := s1logger.NewAlways(s1logger.OPT_DEFAULT)
+	l.Debug(makeMsg("DEBUG"))
+	l.Buffer = stuckBuffer{l.Buffer}
+
+	// the flush gives up rather than spinning with the lock held
+	done := make(chan struct{})
+	captureStdout(t, func() {
+		go func() {
+			l.Error(makeMsg("ERROR"))
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatalf("expect the flush to return")
+		}
+	})
+	assert.Equal(t, s1logger.PLAIN_MODE, l.Mode())
+}
+
+func TestRingBufferAccessor(t *testing.T) {
+	l := s1logger.NewAlways(s1logger.OPT_DEFAULT)
+	assert.Same(t, l.Buffer, l.RingBuffer())
+
+	// a lock-free buffer is no RingBuffer
+	l = s1logger.NewAlways(s1logger.OPT_DEFAULT | s1logger.OPT_LOCK_FREE_BUFFER)
+	assert.Nil(t, l.RingBuffer())
+}
+
+func TestChecksumRecords(t *testing.T) {
+	l := s1logger.NewAlways(s1logger.OPT_DEFAULT | s1logger.OPT_CHECKSUM_RECORDS)
+	l.ExitFunc = func(int) {}
+
+	l.Debug(makeMsg("DEBUG"))
+	l.Info(makeMsg("INFO"))
+
+	buf := l.Buffer.(*RingBuffer)
+	assert.Equal(t, 2, buf.RecordCount())
+	assert.Equal(t, RecordMagic, buf.Bytes()[0])
+
+	l.Error(makeMsg("ERROR"))
+	assert.True(t, buf.IsEmpty())
+	assert.Equal(t, 0, buf.SkippedBytes())
+}
+
+func TestDiskSpill(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logger_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Setenv("BUFFER_SPILL_DIR", dir)
+	defer os.Unsetenv("BUFFER_SPILL_DIR")
+
+	l := s1logger.NewAlways(s1logger.OPT_DEFAULT | s1logger.OPT_DISK_SPILL)
+
+	// far more than the maximum size of buffer
+	for i := 0; i < 100; i++ {
+		l.Debug(makeMsg(strconv.Itoa(i)))
+	}
+	spilled, dropped := l.Buffer.(*RingBuffer).Spilled()
+	assert.Greater(t, spilled, 0)
+	assert.Equal(t, 0, dropped)
+
+	// every log is flushed, spilled ones first
+	lines := captureStdout(t, func() { l.Error(makeMsg("ERROR")) })
+	if assert.Len(t, lines, 101) {
+		for i := 0; i < 100; i++ {
+			assert.Contains(t, lines[i], makeMsg(strconv.Itoa(i))+`"`)
+		}
+		assert.Contains(t, lines[100], makeMsg("ERROR"))
+	}
+
+	assert.NoError(t, l.Close())
+	entries, _ := ioutil.ReadDir(dir)
+	assert.Empty(t, entries)
+}
+
+func TestCompressRecords(t *testing.T) {
+	os.Setenv("BUFFER_COMPRESS_BATCH", "4")
+	defer os.Unsetenv("BUFFER_COMPRESS_BATCH")
+
+	l := s1logger.NewAlways(s1logger.OPT_DEFAULT | s1logger.OPT_COMPRESS_RECORDS)
+	defer l.Close()
+
+	// the last 2 logs wait for their batch
+	for i := 0; i < 10; i++ {
+		l.Debug(makeMsg(strconv.Itoa(i)))
+	}
+	stats := l.Buffer.(*RingBuffer).Stats()
+	assert.Equal(t, 10, stats.Records)
+	assert.Greater(t, stats.CompressionRatio(), 1.0)
+
+	// every log is decompressed on flush, in order
+	lines := captureStdout(t, func() { l.Error(makeMsg("ERROR")) })
+	if assert.Len(t, lines, 11) {
+		for i := 0; i < 10; i++ {
+			assert.Contains(t, lines[i], makeMsg(strconv.Itoa(i))+`"`)
+		}
+		assert.Contains(t, lines[10], makeMsg("ERROR"))
+	}
+}
+
+func TestOverflowPolicy(t *testing.T) {
+	os.Setenv("BUFFER_OVERFLOW", "drop-newest")
+	defer os.Unsetenv("BUFFER_OVERFLOW")
+
+	l := s1logger.NewAlways(s1logger.OPT_DEFAULT)
+	defer l.Close()
+
+	// far more than the maximum size of buffer, the newest logs are dropped
+	for i := 0; i < 100; i++ {
+		l.Debug(makeMsg(strconv.Itoa(i)))
+	}
+	stats := l.Buffer.(*RingBuffer).Stats()
+	assert.Greater(t, stats.Dropped, 0)
+
+	lines := captureStdout(t, func() { l.Error(makeMsg("ERROR")) })
+	if assert.Len(t, lines, 100-stats.Dropped+1) {
+		assert.Contains(t, lines[0], makeMsg("0")+`"`)
+		assert.Contains(t, lines[len(lines)-1], makeMsg("ERROR"))
+	}
+}
+
+func TestOverflowPolicy_DropLowest(t *testing.T) {
+	os.Setenv("BUFFER_OVERFLOW", "drop-lowest")
+	defer os.Unsetenv("BUFFER_OVERFLOW")
+
+	l := s1logger.NewAlways(s1logger.OPT_DEFAULT)
+	defer l.Close()
+
+	// a burst of debug logs does not push out the warning
+	l.Warn(makeMsg("WARN"))
+	for i := 0; i < 100; i++ {
+		l.Debug(makeMsg(strconv.Itoa(i)))
+	}
+
+	lines := captureStdout(t, func() { l.Error(makeMsg("ERROR")) })
+	if assert.Greater(t, len(lines), 2) {
+		assert.Contains(t, lines[0], makeMsg("WARN"))
+		assert.Contains(t, lines[len(lines)-2], makeMsg("99")+`"`)
+		assert.Less(t, len(lines), 102)
+	}
+}
+
+func TestOverflowPolicy_Block(t *testing.T) {
+	os.Setenv("BUFFER_OVERFLOW", "block")
+	os.Setenv("BUFFER_OVERFLOW_TIMEOUT", "5s")
+	defer os.Unsetenv("BUFFER_OVERFLOW")
+	defer os.Unsetenv("BUFFER_OVERFLOW_TIMEOUT")
+
+	l := s1logger.NewAlways(s1logger.OPT_DEFAULT)
+	sink := &testSink{}
+	l.SetSink(sink)
+
+	// far more than the maximum size of buffer, the writer waits for room
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			l.Debug(makeMsg(strconv.Itoa(i)))
+		}
+	}()
+	select {
+	case <-done:
+		t.Fatal("expect the writer to wait for room")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// an error flushes the buffer meanwhile, which releases the writer long before the timeout
+	l.Error(makeMsg("ERROR"))
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expect the flush to release the writer")
+	}
+	assert.Equal(t, 0, l.BufferDropped())
+	assert.NoError(t, l.Close())
+
+	// every log is flushed or printed once, the logs following the flush being printed
+	logs := sink.logs()
+	if assert.Len(t, logs, 101) {
+		for i := 0; i < 100; i++ {
+			count := 0
+			for _, log := range logs {
+				if strings.Contains(log, makeMsg(strconv.Itoa(i))+`"`) {
+					count++
+				}
+			}
+			assert.Equal(t, 1, count, "log %d", i)
+		}
+	}
+}
+
+func TestOverflowPolicy_Error(t *testing.T) {
+	os.Setenv("BUFFER_OVERFLOW", "error")
+	defer os.Unsetenv("BUFFER_OVERFLOW")
+
+	l := s1logger.NewAlways(s1logger.OPT_DEFAULT)
+	defer l.Close()
+
+	// logs the buffer has no room for are counted, rather than reported by logrus on every log
+	for i := 0; i < 100; i++ {
+		l.Debug(makeMsg(strconv.Itoa(i)))
+	}
+	assert.Greater(t, l.BufferDropped(), 0)
+	assert.Equal(t, l.RingBuffer().Stats().Dropped, l.BufferDropped())
+
+	lines := captureStdout(t, func() { l.Error(makeMsg("ERROR")) })
+	assert.Len(t, lines, 100-l.BufferDropped()+1)
+}
+
+func TestQuotas(t *testing.T) {
+	os.Setenv("BUFFER_LEVEL_QUOTAS", "warn=30:100, bogus=1:2")
+	os.Setenv("BUFFER_CATEGORY_QUOTAS", "db=0:20")
+	defer os.Unsetenv("BUFFER_LEVEL_QUOTAS")
+	defer os.Unsetenv("BUFFER_CATEGORY_QUOTAS")
+
+	l := s1logger.NewAlways(s1logger.OPT_DEFAULT)
+	defer l.Close()
+
+	l.Warn(makeMsg("WARN"))
+	l.SetCategory("db")
+	for i := 0; i < 100; i++ {
+		l.Debug(makeMsg(strconv.Itoa(i)))
+	}
+	l.ClearCategory()
+	for i := 100; i < 200; i++ {
+		l.Debug(makeMsg(strconv.Itoa(i)))
+	}
+
+	// the warning is kept, the chatty category was cut back to 20% of the buffer
+	usage := l.Buffer.(*RingBuffer).Stats().Quotas
+	if assert.Len(t, usage, 2) {
+		assert.Equal(t, Level(logrus.WarnLevel)+1, usage[0].Level)
+		assert.Greater(t, usage[0].Bytes, 0)
+		assert.Equal(t, "db", usage[1].Category)
+		assert.LessOrEqual(t, usage[1].Share, 0.2)
+	}
+
+	lines := captureStdout(t, func() { l.Error(makeMsg("ERROR")) })
+	if assert.Greater(t, len(lines), 2) {
+		assert.Contains(t, lines[0], makeMsg("WARN"))
+		assert.Contains(t, lines[len(lines)-2], makeMsg("199")+`"`)
+	}
+}
+
+func TestTTL(t *testing.T) {
+	os.Setenv("BUFFER_TTL", "1h")
+	os.Setenv("BUFFER_TTL_JANITOR", "0")
+	defer os.Unsetenv("BUFFER_TTL")
+	defer os.Unsetenv("BUFFER_TTL_JANITOR")
+
+	l := s1logger.NewAlways(s1logger.OPT_DEFAULT)
+	defer l.Close()
+
+	// without janitor, logs past their time to live are left in the buffer, but not flushed
+	old := time.Now().Add(-2 * time.Hour)
+	l.WithTime(old).Debug(makeMsg("OLD"))
+	l.Debug(makeMsg("NEW"))
+	l.WithTime(old).Debug(makeMsg("LATE"))
+	assert.Equal(t, 3, l.Buffer.RecordCount())
+
+	lines := captureStdout(t, func() { l.Error(makeMsg("ERROR")) })
+	if assert.Len(t, lines, 2) {
+		assert.Contains(t, lines[0], makeMsg("NEW"))
+		assert.Contains(t, lines[1], makeMsg("ERROR"))
+	}
+	assert.Equal(t, 2, l.FlushDiscarded())
+}
+
+func TestTTL_Janitor(t *testing.T) {
+	os.Setenv("BUFFER_TTL", "50ms")
+	os.Setenv("BUFFER_TTL_JANITOR", "10ms")
+	defer os.Unsetenv("BUFFER_TTL")
+	defer os.Unsetenv("BUFFER_TTL_JANITOR")
+
+	// the lock-free buffer is only drained by the janitor
+	for _, options := range []s1logger.LogOptions{s1logger.OPT_DEFAULT, s1logger.OPT_DEFAULT | s1logger.OPT_LOCK_FREE_BUFFER} {
+		l := s1logger.NewAlways(options)
+
+		l.Debug(makeMsg("DEBUG"))
+		assert.Equal(t, 1, l.Buffer.RecordCount())
+		assert.Eventually(t, func() bool { return l.Buffer.Length() == 0 }, time.Second, 10*time.Millisecond)
+
+		assert.NoError(t, l.Close())
+	}
+}
+
+func TestTTL_JanitorStops(t *testing.T) {
+	os.Setenv("BUFFER_TTL", "20ms")
+	os.Setenv("BUFFER_TTL_JANITOR", "10ms")
+	defer os.Unsetenv("BUFFER_TTL")
+	defer os.Unsetenv("BUFFER_TTL_JANITOR")
+
+	// the janitor stops once the logs expired, so a logger nobody closes does not leak it
+	janitorRunning := func() bool {
+		buf := make([]byte, 1<<20)
+		stacks := string(buf[:runtime.Stack(buf, true)])
+		return strings.Contains(stacks, "(*Logger).runJanitor") || strings.Contains(stacks, "(*Logger).startJanitor")
+	}
+	func() {
+		l := s1logger.NewAlways(s1logger.OPT_DEFAULT)
+		assert.False(t, janitorRunning())
+		l.Debug(makeMsg("DEBUG"))
+		assert.True(t, janitorRunning())
+	}()
+	assert.Eventually(t, func() bool { return !janitorRunning() }, time.Second, 10*time.Millisecond)
+
+	// the next log starts it again
+	l := s1logger.NewAlways(s1logger.OPT_DEFAULT)
+	defer l.Close()
+	l.Debug(makeMsg("DEBUG"))
+	assert.Eventually(t, func() bool { return l.Buffer.Length() == 0 }, time.Second, 10*time.Millisecond)
+	l.Debug(makeMsg("DEBUG"))
+	assert.Equal(t, 1, l.Buffer.RecordCount())
+	assert.Eventually(t, func() bool { return l.Buffer.Length() == 0 }, time.Second, 10*time.Millisecond)
+}
+
+func TestFlushWindow(t *testing.T) {
+	os.Setenv("FLUSH_WINDOW", "30s")
+	defer os.Unsetenv("FLUSH_WINDOW")
+
+	l := s1logger.NewAlways(s1logger.OPT_DEFAULT)
+	defer l.Close()
+
+	old := time.Now().Add(-time.Minute)
+	l.WithTime(old).Debug(makeMsg("OLD1"))
+	l.WithTime(old).Debug(makeMsg("OLD2"))
+	l.Debug(makeMsg("NEW1"))
+	l.Debug(makeMsg("NEW2"))
+
+	// only the logs of the last 30 seconds are flushed, the others are discarded
+	lines := captureStdout(t, func() { l.Error(makeMsg("ERROR")) })
+	if assert.Len(t, lines, 3) {
+		assert.Contains(t, lines[0], makeMsg("NEW1"))
+		assert.Contains(t, lines[1], makeMsg("NEW2"))
+		assert.Contains(t, lines[2], makeMsg("ERROR"))
+	}
+	assert.Equal(t, 2, l.FlushDiscarded())
+	assert.True(t, l.Buffer.IsEmpty())
+}
+
+func TestFlushLastRecords(t *testing.T) {
+	os.Setenv("FLUSH_LAST_RECORDS", "3")
+	defer os.Unsetenv("FLUSH_LAST_RECORDS")
+
+	l := s1logger.NewAlways(s1logger.OPT_DEFAULT)
+	defer l.Close()
+
+	for i := 0; i < 10; i++ {
+		l.Debug(makeMsg(strconv.Itoa(i)))
+	}
+
+	lines := captureStdout(t, func() { l.Error(makeMsg("ERROR")) })
+	if assert.Len(t, lines, 4) {
+		for i := 0; i < 3; i++ {
+			assert.Contains(t, lines[i], makeMsg(strconv.Itoa(7+i))+`"`)
+		}
+		assert.Contains(t, lines[3], makeMsg("ERROR"))
+	}
+	assert.Equal(t, 7, l.FlushDiscarded())
+}
+
+func TestCaptureRecords(t *testing.T) {
+	os.Setenv("CAPTURE_RECORDS", "2")
+	defer os.Unsetenv("CAPTURE_RECORDS")
+
+	l := s1logger.NewAlways(s1logger.OPT_DEFAULT)
+	defer l.Close()
+
+	l.Debug(makeMsg("BEFORE"))
+	lines := captureStdout(t, func() {
+		l.Error(makeMsg("ERROR"))
+		l.Debug(makeMsg("AFTER1"))
+		l.Debug(makeMsg("AFTER2"))
+		l.Debug(makeMsg("BUFFERED"))
+	})
+
+	// the 2 logs following the error are printed, then logs are buffered again
+	if assert.Len(t, lines, 4) {
+		assert.Contains(t, lines[0], makeMsg("BEFORE"))
+		assert.Contains(t, lines[1], makeMsg("ERROR"))
+		assert.Contains(t, lines[2], makeMsg("AFTER1"))
+		assert.Contains(t, lines[3], makeMsg("AFTER2"))
+	}
+	assert.Equal(t, s1logger.BUFFER_MODE, l.Mode())
+	assert.Equal(t, 1, l.Buffer.RecordCount())
+}
+
+func TestCaptureDuration(t *testing.T) {
+	os.Setenv("CAPTURE_DURATION", "1m")
+	defer os.Unsetenv("CAPTURE_DURATION")
+
+	l := s1logger.NewAlways(s1logger.OPT_DEFAULT)
+	defer l.Close()
+
+	now := time.Now()
+	lines := captureStdout(t, func() {
+		l.WithTime(now).Error(makeMsg("ERROR"))
+		l.WithTime(now.Add(30 * time.Second)).Debug(makeMsg("AFTER"))
+		assert.Equal(t, s1logger.CAPTURE_MODE, l.Mode())
+
+		// another error restarts the window
+		l.WithTime(now.Add(45 * time.Second)).Error(makeMsg("ERROR2"))
+		l.WithTime(now.Add(90 * time.Second)).Debug(makeMsg("AFTER2"))
+		l.WithTime(now.Add(2 * time.Minute)).Debug(makeMsg("BUFFERED"))
+	})
+
+	if assert.Len(t, lines, 4) {
+		assert.Contains(t, lines[0], makeMsg("ERROR"))
+		assert.Contains(t, lines[1], makeMsg("AFTER"))
+		assert.Contains(t, lines[2], makeMsg("ERROR2"))
+		assert.Contains(t, lines[3], makeMsg("AFTER2"))
+	}
+	assert.Equal(t, s1logger.BUFFER_MODE, l.Mode())
+	assert.Equal(t, 1, l.Buffer.RecordCount())
+}
+
+func TestResources_MultiValue(t *testing.T) {
+	r := (&s1logger.Resources{}).Clear()
+
+	r.Add("D:A").Add("D:B").Add("D:A").Set("U:1")
+	assert.Equal(t, "D:[A,B], U:1", r.String())
+	assert.Equal(t, map[string][]string{"D": {"A", "B"}, "U": {"1"}}, r.Object())
+
+	r.Remove("D:A")
+	assert.Equal(t, "D:B, U:1", r.String())
+
+	r.Remove("D:B").Remove("D:C")
+	assert.Equal(t, "U:1", r.String())
+
+	r.Add("D:A").Add("D:B").Set("D:C")
+	assert.Equal(t, "D:C, U:1", r.String())
+
+	r.Add("D:D").Unset("D")
+	assert.Equal(t, "U:1", r.String())
+}
+
+func TestResources_Limit(t *testing.T) {
+	r := (&s1logger.Resources{}).Clear()
+
+	for i := 0; i < s1logger.MAX_RESOURCE_IDS+4; i++ {
+		r.Add("D:" + strconv.Itoa(i))
+	}
+	assert.Len(t, r.Object()["D"], s1logger.MAX_RESOURCE_IDS)
+
+	r.SetLimit(2)
+	assert.Equal(t, "D:[0,1]", r.String())
+
+	r.Add("D:2")
+	assert.Equal(t, "D:[0,1]", r.String())
+
+	r.Clear().Add("D:0").Add("D:1").Add("D:2")
+	assert.Equal(t, "D:[0,1]", r.String())
+}
+
+func TestResources_ObjectOutput(t *testing.T) {
+	l := s1logger.NewAlways(s1logger.OPT_DEFAULT | s1logger.OPT_RESOURCE_OBJECT)
+	l.SetResource(UserResource).AddResource("D:A").AddResource("D:B")
+
+	entry := logrus.NewEntry(&l.Logger)
+	assert.NoError(t, s1logger.LoggerHook{Logger: l}.Fire(entry))
+	assert.Equal(t, map[string][]string{"D": {"A", "B"}, "U": {"001b1607-ca91-4929-8287-ac9eb1aca221"}}, entry.Data[s1logger.RESOURCE])
+
+	l.RemoveResource("D:A")
+	l.Options = s1logger.OPT_DEFAULT
+	entry = logrus.NewEntry(&l.Logger)
+	assert.NoError(t, s1logger.LoggerHook{Logger: l}.Fire(entry))
+	assert.Equal(t, "D:B, U:001b1607-ca91-4929-8287-ac9eb1aca221", entry.Data[s1logger.RESOURCE])
+}
+
+func TestCategory_Output(t *testing.T) {
+	l := s1logger.NewAlways(s1logger.OPT_DEFAULT)
+	defer l.Close()
+
+	// a log carries the category as cat, and leaves it out when there is none
+	lines := captureStdout(t, func() {
+		l.SetCategory("db").Info(makeMsg("info"))
+		l.ClearCategory().Info(makeMsg("info"))
+		l.SetCategory("billing").Error(makeMsg("error"))
+	})
+	if assert.Len(t, lines, 3) {
+		for i, expected := range []interface{}{"db", nil, "billing"} {
+			var log map[string]interface{}
+			assert.NoError(t, json.Unmarshal([]byte(lines[i]), &log))
+			assert.Equal(t, expected, log[s1logger.CATEGORY], lines[i])
+		}
+	}
+}
+
+func TestRunID(t *testing.T) {
+	l := s1logger.NewAlways(s1logger.OPT_DEFAULT)
+	defer l.Close()
+
+	// without a memory-mapped buffer, there is no run to match and logs leave the run ID out
+	assert.Len(t, l.RunID(), 10)
+	lines := captureStdout(t, func() {
+		l.Error(makeMsg("error"))
+	})
+	if assert.Len(t, lines, 1) {
+		assert.NotContains(t, lines[0], s1logger.RUN_ID)
+	}
+}
@@ -0,0 +1,140 @@
+package logger
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	DEFAULT_METRIC_NAMESPACE string = "s1util/logger"
+	MAX_METRIC_DIMENSIONS    int    = 30   // maximum number of dimensions of a metric in CloudWatch
+	MAX_METRIC_DIMENSION_LEN int    = 1024 // maximum length of a dimension value in CloudWatch, in characters
+
+	EMF_METADATA string = "_aws"
+)
+
+var (
+	ErrInvalidMetric = errors.New("invalid metric")
+)
+
+// Units CloudWatch accepts for a metric. An empty unit stands for None.
+var metricUnits = map[string]bool{
+	"Seconds": true, "Microseconds": true, "Milliseconds": true,
+	"Bytes": true, "Kilobytes": true, "Megabytes": true, "Gigabytes": true, "Terabytes": true,
+	"Bits": true, "Kilobits": true, "Megabits": true, "Gigabits": true, "Terabits": true,
+	"Percent": true, "Count": true,
+	"Bytes/Second": true, "Kilobytes/Second": true, "Megabytes/Second": true, "Gigabytes/Second": true, "Terabytes/Second": true,
+	"Bits/Second": true, "Kilobits/Second": true, "Megabits/Second": true, "Gigabits/Second": true, "Terabits/Second": true,
+	"Count/Second": true, "None": true,
+}
+
+// emfMetadata is the _aws block of a log in CloudWatch Embedded Metric Format.
+type emfMetadata struct {
+	Timestamp         int64            `json:"Timestamp"` // milliseconds since the epoch
+	CloudWatchMetrics []emfMetricGroup `json:"CloudWatchMetrics"`
+}
+
+type emfMetricGroup struct {
+	Namespace  string      `json:"Namespace"`
+	Dimensions [][]string  `json:"Dimensions"`
+	Metrics    []emfMetric `json:"Metrics"`
+}
+
+type emfMetric struct {
+	Name string `json:"Name"`
+	Unit string `json:"Unit"`
+}
+
+/*
+EncodeEMF returns a log in CloudWatch Embedded Metric Format, publishing a metric in a namespace at a given time.
+Every dimension is a field of the log, and the metric is published for the set of all of them.
+Returns ErrInvalidMetric if the namespace, the name, the value, the unit or the dimensions cannot be published.
+*/
+func EncodeEMF(namespace string, name string, value float64, unit string, dims map[string]string, at time.Time) ([]byte, error) {
+	return encodeEMF(namespace, name, value, unit, dims, nil, at)
+}
+
+// Same as EncodeEMF, with properties: fields of the log which are not dimensions, left out if they collide with one or with the metric.
+func encodeEMF(namespace string, name string, value float64, unit string, dims map[string]string, props map[string]string, at time.Time) ([]byte, error) {
+	if unit == "" {
+		unit = "None"
+	}
+	switch {
+	case namespace == "":
+		return nil, fmt.Errorf("%w: no namespace", ErrInvalidMetric)
+	case name == "" || name == EMF_METADATA:
+		return nil, fmt.Errorf("%w: name %q", ErrInvalidMetric, name)
+	case math.IsNaN(value) || math.IsInf(value, 0):
+		return nil, fmt.Errorf("%w: value %v", ErrInvalidMetric, value)
+	case !metricUnits[unit]:
+		return nil, fmt.Errorf("%w: unit %q", ErrInvalidMetric, unit)
+	case len(dims) > MAX_METRIC_DIMENSIONS:
+		return nil, fmt.Errorf("%w: %d dimensions, at most %d", ErrInvalidMetric, len(dims), MAX_METRIC_DIMENSIONS)
+	}
+
+	fields := make(map[string]interface{}, len(props)+len(dims)+2)
+	for k, v := range props {
+		fields[k] = v
+	}
+	names := make([]string, 0, len(dims))
+	for k, v := range dims {
+		// CloudWatch rejects empty dimension values, and a dimension must not hide the metric
+		if k == "" || v == "" || k == name || k == EMF_METADATA {
+			return nil, fmt.Errorf("%w: dimension %q=%q", ErrInvalidMetric, k, v)
+		}
+		if n := utf8.RuneCountInString(v); n > MAX_METRIC_DIMENSION_LEN {
+			return nil, fmt.Errorf("%w: dimension %q of %d characters, at most %d", ErrInvalidMetric, k, n, MAX_METRIC_DIMENSION_LEN)
+		}
+		fields[k] = v
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	fields[name] = value
+	fields[EMF_METADATA] = emfMetadata{
+		Timestamp: at.UnixNano() / int64(time.Millisecond),
+		CloudWatchMetrics: []emfMetricGroup{{
+			Namespace:  namespace,
+			Dimensions: [][]string{names},
+			Metrics:    []emfMetric{{Name: name, Unit: unit}},
+		}},
+	}
+	return json.Marshal(fields)
+}
+
+/*
+Metric publishes a metric in CloudWatch Embedded Metric Format, in the METRIC_NAMESPACE namespace.
+Its dimensions are the current category and the current resources of the types listed in METRIC_RESOURCE_DIMENSIONS,
+a type of several ids joined by commas, overridden by dims. The other resources are fields of the log, not dimensions,
+so ids do not make metrics of their own. The log is never buffered: it is printed, or shipped if there is a sink, in every mode.
+*/
+func (l *Logger) Metric(name string, value float64, unit string, dims map[string]string) error {
+	fields := make(map[string]string, len(dims)+1)
+	props := make(map[string]string)
+	for t, ids := range l.Resources.load().typeMap {
+		if l.metricResources[t] {
+			fields[t] = strings.Join(ids, ",")
+		} else {
+			props[t] = strings.Join(ids, ",")
+		}
+	}
+	if category := l.Category(); len(category) > 0 {
+		fields[CATEGORY] = category
+	}
+	for k, v := range dims {
+		fields[k] = v
+	}
+
+	log, err := encodeEMF(l.metricNamespace, name, value, unit, fields, props, time.Now())
+	if err != nil {
+		return err
+	}
+	emit(l.Shipper(), log)
+	return nil
+}
@@ -0,0 +1,118 @@
+package logger_test
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	s1logger "gitlab-smartgaia.sercomm.com/s1util/logger"
+)
+
+func TestEncodeEMF(t *testing.T) {
+	at := time.Unix(1600000000, 0)
+	log, err := s1logger.EncodeEMF("ns", "flushes", 2, "Count", map[string]string{"cat": "c", "D": "d1"}, at)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{
+		"_aws": {
+			"Timestamp": 1600000000000,
+			"CloudWatchMetrics": [{"Namespace": "ns", "Dimensions": [["D", "cat"]], "Metrics": [{"Name": "flushes", "Unit": "Count"}]}]
+		},
+		"D": "d1",
+		"cat": "c",
+		"flushes": 2
+	}`, string(log))
+
+	// no dimensions, and no unit
+	log, err = s1logger.EncodeEMF("ns", "latency", 1.5, "", nil, at)
+	assert.NoError(t, err)
+	assert.Contains(t, string(log), `"Dimensions":[[]]`)
+	assert.Contains(t, string(log), `"Unit":"None"`)
+
+	invalid := []func() ([]byte, error){
+		func() ([]byte, error) { return s1logger.EncodeEMF("", "m", 1, "", nil, at) },
+		func() ([]byte, error) { return s1logger.EncodeEMF("ns", "", 1, "", nil, at) },
+		func() ([]byte, error) { return s1logger.EncodeEMF("ns", "m", math.NaN(), "", nil, at) },
+		func() ([]byte, error) { return s1logger.EncodeEMF("ns", "m", 1, "Apples", nil, at) },
+		func() ([]byte, error) { return s1logger.EncodeEMF("ns", "m", 1, "", map[string]string{"m": "x"}, at) },
+		func() ([]byte, error) { return s1logger.EncodeEMF("ns", "m", 1, "", map[string]string{"d": ""}, at) },
+		func() ([]byte, error) {
+			return s1logger.EncodeEMF("ns", "m", 1, "", map[string]string{"d": strings.Repeat("x", s1logger.MAX_METRIC_DIMENSION_LEN+1)}, at)
+		},
+	}
+	for i, encode := range invalid {
+		_, err := encode()
+		assert.True(t, errors.Is(err, s1logger.ErrInvalidMetric), "case %d: %v", i, err)
+	}
+
+	// the length of a dimension value is counted in characters
+	_, err = s1logger.EncodeEMF("ns", "m", 1, "", map[string]string{"d": strings.Repeat("é", s1logger.MAX_METRIC_DIMENSION_LEN)}, at)
+	assert.NoError(t, err)
+}
+
+func TestMetric(t *testing.T) {
+	l := s1logger.NewAlways(s1logger.OPT_DEFAULT)
+	defer l.Close()
+	l.AddResource("D:A").AddResource("D:B").SetResource("U:1").SetCategory("billing")
+
+	// metrics are printed at once, in BUFFER_MODE as well, and leave the buffer alone
+	lines := captureStdout(t, func() {
+		assert.NoError(t, l.Metric("errors", 3, "Count", map[string]string{"U": "2", "op": "pay"}))
+		assert.Error(t, l.Metric("errors", 3, "Apples", nil))
+	})
+	assert.Equal(t, s1logger.BUFFER_MODE, l.Mode())
+	assert.Equal(t, 0, l.Buffer.RecordCount())
+
+	// resources are fields of the log, not dimensions, unless dims makes them one
+	if assert.Len(t, lines, 1) {
+		var log map[string]interface{}
+		assert.NoError(t, json.Unmarshal([]byte(lines[0]), &log))
+		assert.Equal(t, "A,B", log["D"])
+		assert.Equal(t, "2", log["U"])
+		assert.Equal(t, "billing", log[s1logger.CATEGORY])
+		assert.Equal(t, "pay", log["op"])
+		assert.Equal(t, 3.0, log["errors"])
+
+		metrics := log["_aws"].(map[string]interface{})["CloudWatchMetrics"].([]interface{})[0].(map[string]interface{})
+		assert.Equal(t, s1logger.DEFAULT_METRIC_NAMESPACE, metrics["Namespace"])
+		assert.Equal(t, []interface{}{[]interface{}{"U", "cat", "op"}}, metrics["Dimensions"])
+	}
+}
+
+func TestMetric_ResourceDimensions(t *testing.T) {
+	os.Setenv("METRIC_RESOURCE_DIMENSIONS", "D, G")
+	defer os.Unsetenv("METRIC_RESOURCE_DIMENSIONS")
+	l := s1logger.NewAlways(s1logger.OPT_DEFAULT)
+	defer l.Close()
+	l.AddResource("D:A").AddResource("D:B").SetResource("U:1")
+
+	// resource types listed in METRIC_RESOURCE_DIMENSIONS are dimensions
+	lines := captureStdout(t, func() {
+		assert.NoError(t, l.Metric("errors", 1, "Count", nil))
+	})
+	if assert.Len(t, lines, 1) {
+		var log map[string]interface{}
+		assert.NoError(t, json.Unmarshal([]byte(lines[0]), &log))
+		assert.Equal(t, "A,B", log["D"])
+		assert.Equal(t, "1", log["U"])
+
+		metrics := log["_aws"].(map[string]interface{})["CloudWatchMetrics"].([]interface{})[0].(map[string]interface{})
+		assert.Equal(t, []interface{}{[]interface{}{"D"}}, metrics["Dimensions"])
+	}
+}
+
+func TestMetric_Sink(t *testing.T) {
+	l := s1logger.NewAlways(s1logger.OPT_DEFAULT)
+	sink := &testSink{}
+	l.SetSink(sink)
+
+	assert.NoError(t, l.Metric("dropped", 1, "Count", nil))
+	assert.NoError(t, l.Close())
+	if logs := sink.logs(); assert.Len(t, logs, 1) {
+		assert.Contains(t, logs[0], `"dropped":1`)
+	}
+}
@@ -0,0 +1,263 @@
+package logger
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DEFAULT_SHIP_QUEUE_SIZE    int           = 1024
+	DEFAULT_SHIP_BATCH_SIZE    int           = 100
+	DEFAULT_SHIP_MAX_RETRIES   int           = 5
+	DEFAULT_SHIP_INTERVAL      time.Duration = time.Second
+	DEFAULT_SHIP_MIN_BACKOFF   time.Duration = 100 * time.Millisecond
+	DEFAULT_SHIP_MAX_BACKOFF   time.Duration = 10 * time.Second
+	DEFAULT_SHIP_CLOSE_TIMEOUT time.Duration = 5 * time.Second
+)
+
+var (
+	ErrShipperClosed = errors.New("shipper is closed")
+	ErrQueueFull     = errors.New("shipper queue is full")
+	ErrCloseTimeout  = errors.New("shipper did not drain before the close timeout")
+)
+
+// Sink receives the logs shipped by a Shipper, in batches, oldest first.
+type Sink interface {
+	Send(logs [][]byte) error
+}
+
+// SinkFunc adapts a function to the Sink interface.
+type SinkFunc func(logs [][]byte) error
+
+// ShipperOptions configures a Shipper. Zero values stand for the defaults.
+type ShipperOptions struct {
+	QueueSize    int           // maximum number of logs, or batches of ShipBatch, waiting to be shipped, newer ones are dropped
+	BatchSize    int           // maximum number of logs per batch
+	Interval     time.Duration // maximum time a log waits for its batch to be complete
+	MaxRetries   int           // number of retries of a batch the sink failed, before it is given up, negative for none
+	MinBackoff   time.Duration // wait before the first retry, doubled on every retry
+	MaxBackoff   time.Duration // maximum wait between retries
+	CloseTimeout time.Duration // maximum time Close waits for the queue to drain
+}
+
+// ShipperStats is a snapshot of the counters of a Shipper.
+type ShipperStats struct {
+	Queued  int // logs waiting to be shipped
+	Shipped int // logs the sink accepted
+	Dropped int // logs dropped since the queue was full or the shipper closed
+	Failed  int // logs given up after the last retry, or undelivered before the close timeout
+	Retries int // batches sent again after a failure
+}
+
+// Shipper ships logs to a sink from a goroutine of its own, so a slow sink does not block logging.
+type Shipper struct {
+	queued  int64 // updated atomically, as the counters below
+	shipped int64
+	dropped int64
+	failed  int64
+	retries int64
+
+	sink    Sink
+	options ShipperOptions
+
+	mu     sync.RWMutex // guards closed, so no log is queued once the queue is closed
+	closed bool
+	queue  chan [][]byte // logs queued together, a single log or the logs of a flush
+
+	abort   chan struct{} // closed when the close timeout passes
+	stopped chan struct{} // closed when the goroutine returns
+}
+
+// Send calls f(logs).
+func (f SinkFunc) Send(logs [][]byte) error {
+	return f(logs)
+}
+
+// NewShipper starts a shipper sending logs to sink.
+func NewShipper(sink Sink, options ShipperOptions) *Shipper {
+	if options.QueueSize <= 0 {
+		options.QueueSize = DEFAULT_SHIP_QUEUE_SIZE
+	}
+	if options.BatchSize <= 0 {
+		options.BatchSize = DEFAULT_SHIP_BATCH_SIZE
+	}
+	if options.Interval <= 0 {
+		options.Interval = DEFAULT_SHIP_INTERVAL
+	}
+	if options.MaxRetries < 0 {
+		options.MaxRetries = 0
+	} else if options.MaxRetries == 0 {
+		options.MaxRetries = DEFAULT_SHIP_MAX_RETRIES
+	}
+	if options.MinBackoff <= 0 {
+		options.MinBackoff = DEFAULT_SHIP_MIN_BACKOFF
+	}
+	if options.MaxBackoff <= 0 {
+		options.MaxBackoff = DEFAULT_SHIP_MAX_BACKOFF
+	}
+	if options.MaxBackoff < options.MinBackoff {
+		options.MaxBackoff = options.MinBackoff
+	}
+	if options.CloseTimeout <= 0 {
+		options.CloseTimeout = DEFAULT_SHIP_CLOSE_TIMEOUT
+	}
+
+	s := &Shipper{
+		sink:    sink,
+		options: options,
+		queue:   make(chan [][]byte, options.QueueSize),
+		abort:   make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+/*
+Ship queues a log without waiting. The log is dropped and counted if the queue is full or the shipper closed,
+returning ErrQueueFull or ErrShipperClosed.
+*/
+func (s *Shipper) Ship(log []byte) error {
+	return s.ShipBatch([][]byte{log})
+}
+
+/*
+ShipBatch queues logs as a single entry of the queue without waiting, such as the logs of a flush, so they
+fit in the queue as long as a single log does. They are still shipped in batches of at most BatchSize logs.
+The logs are dropped and counted if the queue is full or the shipper closed, returning ErrQueueFull or ErrShipperClosed.
+*/
+func (s *Shipper) ShipBatch(logs [][]byte) error {
+	if len(logs) == 0 {
+		return nil
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.closed {
+		atomic.AddInt64(&s.dropped, int64(len(logs)))
+		return ErrShipperClosed
+	}
+	select {
+	case s.queue <- logs:
+		atomic.AddInt64(&s.queued, int64(len(logs)))
+		return nil
+	default:
+		atomic.AddInt64(&s.dropped, int64(len(logs)))
+		return ErrQueueFull
+	}
+}
+
+// Stats returns the counters of the shipper.
+func (s *Shipper) Stats() ShipperStats {
+	return ShipperStats{
+		Queued:  int(atomic.LoadInt64(&s.queued)),
+		Shipped: int(atomic.LoadInt64(&s.shipped)),
+		Dropped: int(atomic.LoadInt64(&s.dropped)),
+		Failed:  int(atomic.LoadInt64(&s.failed)),
+		Retries: int(atomic.LoadInt64(&s.retries)),
+	}
+}
+
+/*
+Close stops queueing logs and ships the queued logs, waiting up to the close timeout.
+Returns ErrCloseTimeout if they could not all be shipped in time, the rest being counted as failed.
+*/
+func (s *Shipper) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ErrShipperClosed
+	}
+	s.closed = true
+	close(s.queue)
+	s.mu.Unlock()
+
+	timer := time.NewTimer(s.options.CloseTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-s.stopped:
+		return nil
+	case <-timer.C:
+		// the sink may never return, do not wait for it
+		close(s.abort)
+		return ErrCloseTimeout
+	}
+}
+
+// Gathers the queued logs into batches and sends them, until the queue is closed and drained.
+func (s *Shipper) run() {
+	defer close(s.stopped)
+
+	ticker := time.NewTicker(s.options.Interval)
+	defer ticker.Stop()
+
+	var batch [][]byte
+	for {
+		select {
+		case logs, ok := <-s.queue:
+			if !ok {
+				s.send(batch)
+				return
+			}
+			atomic.AddInt64(&s.queued, -int64(len(logs)))
+			for batch = append(batch, logs...); len(batch) >= s.options.BatchSize; batch = batch[s.options.BatchSize:] {
+				s.send(batch[:s.options.BatchSize:s.options.BatchSize])
+			}
+			if len(batch) == 0 {
+				batch = nil
+			}
+		case <-ticker.C:
+			if len(batch) > 0 {
+				s.send(batch)
+				batch = nil
+			}
+		case <-s.abort:
+			atomic.AddInt64(&s.failed, int64(len(batch))+atomic.LoadInt64(&s.queued))
+			return
+		}
+	}
+}
+
+// Sends a batch, retrying with exponential backoff as long as the sink fails and retries are left.
+func (s *Shipper) send(batch [][]byte) {
+	if len(batch) == 0 {
+		return
+	}
+
+	select {
+	case <-s.abort:
+		atomic.AddInt64(&s.failed, int64(len(batch)))
+		return
+	default:
+	}
+
+	backoff := s.options.MinBackoff
+	for retry := 0; ; retry++ {
+		if err := s.sink.Send(batch); err == nil {
+			atomic.AddInt64(&s.shipped, int64(len(batch)))
+			return
+		}
+		if retry == s.options.MaxRetries {
+			atomic.AddInt64(&s.failed, int64(len(batch)))
+			return
+		}
+		atomic.AddInt64(&s.retries, 1)
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-s.abort:
+			timer.Stop()
+			atomic.AddInt64(&s.failed, int64(len(batch)))
+			return
+		}
+
+		if backoff *= 2; backoff > s.options.MaxBackoff {
+			backoff = s.options.MaxBackoff
+		}
+	}
+}
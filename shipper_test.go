@@ -0,0 +1,270 @@
+package logger_test
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	s1logger "gitlab-smartgaia.sercomm.com/s1util/logger"
+	"gitlab-smartgaia.sercomm.com/s1util/logger/sink"
+)
+
+// testSink records the batches it receives, failing the first fails sends.
+type testSink struct {
+	mu      sync.Mutex
+	batches [][]string
+	fails   int
+}
+
+func (s *testSink) Send(logs [][]byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.fails > 0 {
+		s.fails--
+		return errors.New("sink unavailable")
+	}
+	batch := make([]string, len(logs))
+	for i, log := range logs {
+		batch[i] = string(log)
+	}
+	s.batches = append(s.batches, batch)
+	return nil
+}
+
+func (s *testSink) logs() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var logs []string
+	for _, batch := range s.batches {
+		logs = append(logs, batch...)
+	}
+	return logs
+}
+
+func TestShipper_Batches(t *testing.T) {
+	sink := &testSink{}
+	s := s1logger.NewShipper(sink, s1logger.ShipperOptions{BatchSize: 3, Interval: time.Hour})
+
+	for i := 0; i < 7; i++ {
+		assert.NoError(t, s.Ship([]byte(strconv.Itoa(i))))
+	}
+
+	// the incomplete batch is shipped on close
+	assert.NoError(t, s.Close())
+	assert.Equal(t, [][]string{{"0", "1", "2"}, {"3", "4", "5"}, {"6"}}, sink.batches)
+	assert.Equal(t, 7, s.Stats().Shipped)
+	assert.Equal(t, s1logger.ErrShipperClosed, s.Ship([]byte("late")))
+	assert.Equal(t, 1, s.Stats().Dropped)
+}
+
+func TestShipper_Interval(t *testing.T) {
+	sink := &testSink{}
+	s := s1logger.NewShipper(sink, s1logger.ShipperOptions{Interval: 10 * time.Millisecond})
+	defer s.Close()
+
+	// an incomplete batch is shipped after the interval
+	_ = s.Ship([]byte("log"))
+	assert.Eventually(t, func() bool { return len(sink.logs()) == 1 }, time.Second, 10*time.Millisecond)
+}
+
+func TestShipper_Retry(t *testing.T) {
+	sink := &testSink{fails: 2}
+	s := s1logger.NewShipper(sink, s1logger.ShipperOptions{MinBackoff: time.Millisecond})
+
+	_ = s.Ship([]byte("log"))
+	assert.NoError(t, s.Close())
+	assert.Equal(t, []string{"log"}, sink.logs())
+	assert.Equal(t, s1logger.ShipperStats{Shipped: 1, Retries: 2}, s.Stats())
+
+	// a batch is given up after the last retry
+	sink = &testSink{fails: 10}
+	s = s1logger.NewShipper(sink, s1logger.ShipperOptions{MaxRetries: 2, MinBackoff: time.Millisecond})
+
+	_ = s.Ship([]byte("log"))
+	assert.NoError(t, s.Close())
+	assert.Empty(t, sink.logs())
+	assert.Equal(t, s1logger.ShipperStats{Failed: 1, Retries: 2}, s.Stats())
+}
+
+func TestShipper_QueueFull(t *testing.T) {
+	release := make(chan struct{})
+	sink := s1logger.SinkFunc(func(logs [][]byte) error {
+		<-release
+		return nil
+	})
+	s := s1logger.NewShipper(sink, s1logger.ShipperOptions{QueueSize: 2, BatchSize: 1})
+
+	// the first log blocks in the sink, the next 2 fill the queue
+	dropped := 0
+	for i := 0; i < 10; i++ {
+		if s.Ship([]byte(strconv.Itoa(i))) == s1logger.ErrQueueFull {
+			dropped++
+		}
+	}
+	assert.GreaterOrEqual(t, dropped, 7)
+	assert.Equal(t, dropped, s.Stats().Dropped)
+
+	close(release)
+	assert.NoError(t, s.Close())
+	assert.Equal(t, 10-dropped, s.Stats().Shipped)
+}
+
+func TestShipper_ShipBatch(t *testing.T) {
+	release := make(chan struct{})
+	sink := &testSink{}
+	blocked := s1logger.SinkFunc(func(logs [][]byte) error {
+		<-release
+		return sink.Send(logs)
+	})
+	s := s1logger.NewShipper(blocked, s1logger.ShipperOptions{QueueSize: 1, BatchSize: 2})
+
+	// a complete batch blocks in the sink, then a batch of logs takes the single entry of the queue
+	assert.NoError(t, s.ShipBatch([][]byte{[]byte("0"), []byte("1")}))
+	assert.Eventually(t, func() bool { return s.Stats().Queued == 0 }, time.Second, time.Millisecond)
+	assert.NoError(t, s.ShipBatch([][]byte{[]byte("2"), []byte("3"), []byte("4")}))
+	assert.Equal(t, 3, s.Stats().Queued)
+
+	// the queue is full, a batch is dropped as a whole without waiting
+	assert.Equal(t, s1logger.ErrQueueFull, s.ShipBatch([][]byte{[]byte("5"), []byte("6")}))
+	assert.Equal(t, 2, s.Stats().Dropped)
+
+	// the queued batch is shipped in batches of at most BatchSize logs
+	close(release)
+	assert.NoError(t, s.Close())
+	assert.Equal(t, [][]string{{"0", "1"}, {"2", "3"}, {"4"}}, sink.batches)
+	assert.Equal(t, 5, s.Stats().Shipped)
+}
+
+func TestShipper_CloseTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	sink := s1logger.SinkFunc(func(logs [][]byte) error {
+		<-release
+		return nil
+	})
+	s := s1logger.NewShipper(sink, s1logger.ShipperOptions{BatchSize: 1, CloseTimeout: 50 * time.Millisecond})
+
+	for i := 0; i < 3; i++ {
+		_ = s.Ship([]byte(strconv.Itoa(i)))
+	}
+
+	start := time.Now()
+	assert.Equal(t, s1logger.ErrCloseTimeout, s.Close())
+	assert.Less(t, int64(time.Since(start)), int64(time.Second))
+}
+
+func TestSetSink(t *testing.T) {
+	os.Setenv("SHIP_BATCH_SIZE", "2")
+	defer os.Unsetenv("SHIP_BATCH_SIZE")
+
+	l := s1logger.NewAlways(s1logger.OPT_DEFAULT)
+	sink := &testSink{}
+	l.SetSink(sink)
+
+	// flushed and plain logs go to the sink rather than standard output
+	lines := captureStdout(t, func() {
+		l.Debug(makeMsg("DEBUG"))
+		l.Error(makeMsg("ERROR"))
+		l.Info(makeMsg("INFO"))
+	})
+	assert.Empty(t, lines)
+
+	assert.NoError(t, l.Close())
+	logs := sink.logs()
+	if assert.Len(t, logs, 3) {
+		assert.Contains(t, logs[0], makeMsg("DEBUG"))
+		assert.Contains(t, logs[1], makeMsg("ERROR"))
+		assert.Contains(t, logs[2], makeMsg("INFO"))
+	}
+	assert.Equal(t, [][]string{logs[:2], logs[2:]}, sink.batches)
+	assert.Nil(t, l.Shipper())
+}
+
+func TestSetSink_FlushSingleEntry(t *testing.T) {
+	os.Setenv("SHIP_QUEUE_SIZE", "2")
+	os.Setenv("SHIP_BATCH_SIZE", "1")
+	defer os.Unsetenv("SHIP_QUEUE_SIZE")
+	defer os.Unsetenv("SHIP_BATCH_SIZE")
+
+	l := s1logger.NewAlways(s1logger.OPT_DEFAULT)
+	sink := &testSink{}
+	slow := s1logger.SinkFunc(func(logs [][]byte) error {
+		time.Sleep(time.Millisecond)
+		return sink.Send(logs)
+	})
+	l.SetSink(slow)
+
+	// a flush of more logs than the queue holds takes a single entry of the queue, no log is dropped
+	for i := 0; i < 10; i++ {
+		l.Debug(makeMsg(strconv.Itoa(i)))
+	}
+	l.Error(makeMsg("ERROR"))
+	shipper := l.Shipper()
+	assert.NoError(t, l.Close())
+
+	assert.Len(t, sink.logs(), 11)
+	assert.Equal(t, 0, shipper.Stats().Dropped)
+}
+
+func TestSetSink_StalledSink(t *testing.T) {
+	os.Setenv("SHIP_QUEUE_SIZE", "1")
+	os.Setenv("SHIP_CLOSE_TIMEOUT", "10ms")
+	defer os.Unsetenv("SHIP_QUEUE_SIZE")
+	defer os.Unsetenv("SHIP_CLOSE_TIMEOUT")
+
+	release := make(chan struct{})
+	defer close(release)
+	l := s1logger.NewAlways(s1logger.OPT_DEFAULT)
+	l.SetSink(s1logger.SinkFunc(func(logs [][]byte) error {
+		<-release
+		return nil
+	}))
+
+	// errors, and the flush of the first one, return at once while the sink does not, their logs being dropped
+	for i := 0; i < 10; i++ {
+		l.Debug(makeMsg(strconv.Itoa(i)))
+	}
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		l.Error(makeMsg("ERROR"))
+	}
+	assert.Less(t, int64(time.Since(start)), int64(100*time.Millisecond))
+
+	shipper := l.Shipper()
+	assert.Greater(t, shipper.Stats().Dropped, 0)
+	assert.Equal(t, s1logger.ErrCloseTimeout, l.Close())
+}
+
+func TestSetSink_Syslog(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer pc.Close()
+
+	syslog, err := sink.NewSyslogSink(sink.SyslogConfig{Address: pc.LocalAddr().String(), EnterpriseID: "32473"})
+	assert.NoError(t, err)
+	defer syslog.Close()
+
+	l := s1logger.NewAlways(s1logger.OPT_DEFAULT)
+	l.SetResource(DeviceResource).SetCategory(Category).SetSink(syslog)
+	l.Error(makeMsg("ERROR"))
+	assert.NoError(t, l.Close())
+
+	// the resources and category of the log are structured data
+	buf := make([]byte, 4096)
+	_ = pc.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := pc.ReadFrom(buf)
+	if assert.NoError(t, err) {
+		assert.Contains(t, string(buf[:n]), `<131>1 `)
+		assert.Contains(t, string(buf[:n]), `[res@32473 D="3C62F006E1D1-2110DMM000018"][cat@32473 name="MyCategory"]`)
+		assert.Contains(t, string(buf[:n]), makeMsg("ERROR"))
+	}
+}
@@ -0,0 +1,273 @@
+package sink
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+/*
+*************************************************************
+
+	CONSTANT
+
+*************************************************************
+*/
+
+// Limits of a PutLogEvents request.
+const (
+	MaxBatchBytes  = 1048576        // sum of the sizes of the events
+	MaxBatchEvents = 10000          // number of events
+	MaxBatchSpan   = 24 * time.Hour // time between the oldest and the newest event
+	MaxEventBytes  = 262144         // size of an event, its message plus EventOverhead
+	EventOverhead  = 26             // bytes counted for every event on top of its message
+)
+
+const (
+	DefaultCloudWatchTimeout = 10 * time.Second
+
+	cloudWatchService = "logs"
+	cloudWatchTarget  = "Logs_20140328."
+)
+
+/*
+*************************************************************
+
+	VARIABLE
+
+*************************************************************
+*/
+
+var (
+	ErrMissingConfig = errors.New("missing configuration")
+)
+
+/*
+*************************************************************
+
+	STRUCT DEFINITION
+
+*************************************************************
+*/
+
+// CloudWatchConfig configures a CloudWatchSink. Zero values stand for the defaults.
+type CloudWatchConfig struct {
+	Region      string              // AWS region, e.g. eu-west-1
+	LogGroup    string              // log group, created on demand
+	LogStream   string              // log stream, created on demand
+	Endpoint    string              // URL of the service, https://logs.<Region>.amazonaws.com by default
+	Credentials Credentials         // static credentials, overriding Provider
+	Provider    CredentialsProvider // provider of the credentials, a RefreshingCredentials by default
+	Client      *http.Client        // client with a DefaultCloudWatchTimeout timeout by default
+}
+
+/*
+CloudWatchSink ships logs to CloudWatch Logs with the PutLogEvents API, signed with Signature Version 4.
+Logs are sent as events timestamped with their time field, in chronological order and split to honor the limits
+of a request. A log too large for an event is truncated.
+Failed requests, throttled ones included, are not retried by the sink but by the shipper, after its own backoff.
+Note: Delivery is at least once. When a request fails, the batch is sent again as a whole, including the events
+of the requests which succeeded.
+*/
+type CloudWatchSink struct {
+	config CloudWatchConfig
+
+	mu sync.Mutex // serializes the requests, the events of a stream must not interleave
+}
+
+// cloudWatchEvent is an event of a PutLogEvents request.
+type cloudWatchEvent struct {
+	Timestamp int64  `json:"timestamp"` // milliseconds since the epoch
+	Message   string `json:"message"`
+}
+
+// CloudWatchError is an error returned by the service.
+type CloudWatchError struct {
+	StatusCode int
+	Type       string // type of the error, e.g. ThrottlingException
+	Message    string
+}
+
+/*
+*************************************************************
+
+	CLOUDWATCH SINK
+
+*************************************************************
+*/
+
+// Returns a sink shipping logs to a given log group and stream. Returns ErrMissingConfig if one of them, or the region, is missing.
+func NewCloudWatchSink(config CloudWatchConfig) (*CloudWatchSink, error) {
+	if config.Region == "" || config.LogGroup == "" || config.LogStream == "" {
+		return nil, fmt.Errorf("%w: region, log group and log stream are required", ErrMissingConfig)
+	}
+	if config.Endpoint == "" {
+		config.Endpoint = fmt.Sprintf("https://logs.%s.amazonaws.com", config.Region)
+	}
+	if config.Credentials != (Credentials{}) {
+		config.Provider = config.Credentials
+	} else if config.Provider == nil {
+		config.Provider = NewRefreshingCredentials()
+	}
+	if config.Client == nil {
+		config.Client = &http.Client{Timeout: DefaultCloudWatchTimeout}
+	}
+	return &CloudWatchSink{config: config}, nil
+}
+
+/*
+Sends logs as events of the log stream, creating the log group and stream if they do not exist.
+A failed request is not retried, the shipper sends the batch again after its own backoff.
+*/
+func (s *CloudWatchSink) Send(logs [][]byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, events := range splitEvents(toEvents(logs, time.Now())) {
+		err := s.putLogEvents(events)
+		if isCloudWatchError(err, "ResourceNotFoundException") {
+			if err = s.create(); err == nil {
+				err = s.putLogEvents(events)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Creates the log group and stream, unless they exist already.
+func (s *CloudWatchSink) create() error {
+	group := map[string]string{"logGroupName": s.config.LogGroup}
+	if err := s.call("CreateLogGroup", group); err != nil && !isCloudWatchError(err, "ResourceAlreadyExistsException") {
+		return err
+	}
+
+	stream := map[string]string{"logGroupName": s.config.LogGroup, "logStreamName": s.config.LogStream}
+	if err := s.call("CreateLogStream", stream); err != nil && !isCloudWatchError(err, "ResourceAlreadyExistsException") {
+		return err
+	}
+	return nil
+}
+
+func (s *CloudWatchSink) putLogEvents(events []cloudWatchEvent) error {
+	return s.call("PutLogEvents", map[string]interface{}{
+		"logGroupName":  s.config.LogGroup,
+		"logStreamName": s.config.LogStream,
+		"logEvents":     events,
+	})
+}
+
+// Calls an action of the API.
+func (s *CloudWatchSink) call(action string, input interface{}) error {
+	body, err := json.Marshal(input)
+	if err != nil {
+		return err
+	}
+	return s.do(action, body)
+}
+
+// Sends a signed request of an action of the API.
+func (s *CloudWatchSink) do(action string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, s.config.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", cloudWatchTarget+action)
+	creds, err := s.config.Provider.Retrieve()
+	if err != nil {
+		return err
+	}
+	SignRequest(req, body, creds, s.config.Region, cloudWatchService, time.Now())
+
+	resp, err := s.config.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	cwErr := &CloudWatchError{StatusCode: resp.StatusCode}
+	var out struct {
+		Type    string `json:"__type"`
+		Message string `json:"message"`
+	}
+	if json.Unmarshal(data, &out) == nil {
+		// the type may be qualified, e.g. com.amazonaws.logs#ThrottlingException
+		cwErr.Type = out.Type[strings.LastIndex(out.Type, "#")+1:]
+		cwErr.Message = out.Message
+	}
+	return cwErr
+}
+
+func (e *CloudWatchError) Error() string {
+	return fmt.Sprintf("cloudwatch: %d %s: %s", e.StatusCode, e.Type, e.Message)
+}
+
+// Tells if err is a CloudWatchError of a given type.
+func isCloudWatchError(err error, errType string) bool {
+	var cwErr *CloudWatchError
+	return errors.As(err, &cwErr) && cwErr.Type == errType
+}
+
+/*
+Returns the events of logs in chronological order, timestamped with their time field, or now if they have none.
+Logs too large for an event are truncated, at the start of a UTF-8 character.
+*/
+func toEvents(logs [][]byte, now time.Time) []cloudWatchEvent {
+	events := make([]cloudWatchEvent, len(logs))
+	for i, log := range logs {
+		var fields struct {
+			Time time.Time `json:"time"`
+		}
+		t := now
+		if json.Unmarshal(log, &fields) == nil && !fields.Time.IsZero() {
+			t = fields.Time
+		}
+		if n := MaxEventBytes - EventOverhead; len(log) > n {
+			for n > 0 && !utf8.RuneStart(log[n]) {
+				n--
+			}
+			log = log[:n]
+		}
+		events[i] = cloudWatchEvent{Timestamp: t.UnixNano() / int64(time.Millisecond), Message: string(log)}
+	}
+
+	sort.SliceStable(events, func(a, b int) bool {
+		return events[a].Timestamp < events[b].Timestamp
+	})
+	return events
+}
+
+// Splits events in chronological order into batches honoring the limits of a request.
+func splitEvents(events []cloudWatchEvent) [][]cloudWatchEvent {
+	var batches [][]cloudWatchEvent
+	start, size := 0, 0
+	for i, e := range events {
+		eventSize := len(e.Message) + EventOverhead
+		if i > start && (i-start == MaxBatchEvents || size+eventSize > MaxBatchBytes ||
+			e.Timestamp-events[start].Timestamp >= int64(MaxBatchSpan/time.Millisecond)) {
+			batches = append(batches, events[start:i])
+			start, size = i, 0
+		}
+		size += eventSize
+	}
+	if start < len(events) {
+		batches = append(batches, events[start:])
+	}
+	return batches
+}
@@ -0,0 +1,227 @@
+package sink
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+*************************************************************
+
+	CONSTANT
+
+*************************************************************
+*/
+
+const (
+	DefaultECSEndpoint        = "http://169.254.170.2"
+	DefaultIMDSEndpoint       = "http://169.254.169.254"
+	DefaultCredentialsTimeout = 5 * time.Second
+	CredentialsExpiryWindow   = 5 * time.Minute // credentials are refreshed this long before they expire
+
+	imdsTokenTTL = "21600" // seconds, the maximum
+)
+
+/*
+*************************************************************
+
+	VARIABLE
+
+*************************************************************
+*/
+
+var (
+	ErrNoCredentials = errors.New("no credentials found")
+)
+
+/*
+*************************************************************
+
+	STRUCT DEFINITION
+
+*************************************************************
+*/
+
+// CredentialsProvider provides the credentials requests are signed with, every time one is signed.
+type CredentialsProvider interface {
+	Retrieve() (Credentials, error)
+}
+
+/*
+RefreshingCredentials provides the credentials of the environment, looked up in order:
+
+ 1. the AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN environment variables
+ 2. the ECS container endpoint, if AWS_CONTAINER_CREDENTIALS_RELATIVE_URI is set, e.g. for the role of an ECS task
+ 3. the EC2 instance metadata service, IMDSv2, for the role of the instance
+
+Temporary credentials are cached and retrieved again CredentialsExpiryWindow before they expire.
+Zero values of the fields stand for the defaults.
+*/
+type RefreshingCredentials struct {
+	ECSEndpoint  string       // DefaultECSEndpoint by default
+	IMDSEndpoint string       // DefaultIMDSEndpoint by default
+	Client       *http.Client // client with a DefaultCredentialsTimeout timeout by default
+
+	mu         sync.Mutex
+	creds      Credentials
+	expiration time.Time // zero for credentials which do not expire
+}
+
+// awsCredentials are the credentials returned by the ECS container endpoint and the instance metadata service.
+type awsCredentials struct {
+	Code            string // Success, instance metadata service only
+	AccessKeyID     string `json:"AccessKeyId"`
+	SecretAccessKey string
+	Token           string
+	Expiration      time.Time
+}
+
+/*
+*************************************************************
+
+	CREDENTIALS PROVIDER
+
+*************************************************************
+*/
+
+// Returns static credentials, so they can stand for a CredentialsProvider.
+func (c Credentials) Retrieve() (Credentials, error) {
+	return c, nil
+}
+
+// Returns a provider of the credentials of the environment, retrieved when they are first needed.
+func NewRefreshingCredentials() *RefreshingCredentials {
+	return &RefreshingCredentials{}
+}
+
+/*
+Returns the credentials of the environment, from the cache unless they are about to expire.
+If they cannot be retrieved again, the cached ones are returned as long as they have not expired.
+*/
+func (p *RefreshingCredentials) Retrieve() (Credentials, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	if p.creds != (Credentials{}) && (p.expiration.IsZero() || now.Before(p.expiration.Add(-CredentialsExpiryWindow))) {
+		return p.creds, nil
+	}
+
+	creds, expiration, err := p.retrieve()
+	if err != nil {
+		if p.creds != (Credentials{}) && now.Before(p.expiration) {
+			return p.creds, nil
+		}
+		return Credentials{}, err
+	}
+	p.creds, p.expiration = creds, expiration
+	return creds, nil
+}
+
+// Retrieves the credentials of the environment and the time they expire, zero if they do not.
+func (p *RefreshingCredentials) retrieve() (Credentials, time.Time, error) {
+	if creds := EnvCredentials(); creds.AccessKeyID != "" && creds.SecretAccessKey != "" {
+		return creds, time.Time{}, nil
+	}
+	if uri := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); uri != "" {
+		return p.fromECS(uri)
+	}
+	return p.fromIMDS()
+}
+
+// Retrieves the credentials of the ECS container endpoint at a given path.
+func (p *RefreshingCredentials) fromECS(uri string) (Credentials, time.Time, error) {
+	endpoint := p.ECSEndpoint
+	if endpoint == "" {
+		endpoint = DefaultECSEndpoint
+	}
+	req, err := http.NewRequest(http.MethodGet, endpoint+uri, nil)
+	if err != nil {
+		return Credentials{}, time.Time{}, err
+	}
+	data, err := p.get(req)
+	if err != nil {
+		return Credentials{}, time.Time{}, fmt.Errorf("%w: ecs credentials: %v", ErrNoCredentials, err)
+	}
+	return parseCredentials(data)
+}
+
+// Retrieves the credentials of the role of the instance from the instance metadata service, with a session token.
+func (p *RefreshingCredentials) fromIMDS() (Credentials, time.Time, error) {
+	endpoint := p.IMDSEndpoint
+	if endpoint == "" {
+		endpoint = DefaultIMDSEndpoint
+	}
+
+	req, err := http.NewRequest(http.MethodPut, endpoint+"/latest/api/token", nil)
+	if err != nil {
+		return Credentials{}, time.Time{}, err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", imdsTokenTTL)
+	token, err := p.get(req)
+	if err != nil {
+		return Credentials{}, time.Time{}, fmt.Errorf("%w: imds token: %v", ErrNoCredentials, err)
+	}
+
+	path := endpoint + "/latest/meta-data/iam/security-credentials/"
+	req, _ = http.NewRequest(http.MethodGet, path, nil)
+	req.Header.Set("X-aws-ec2-metadata-token", string(token))
+	roles, err := p.get(req)
+	if err != nil {
+		return Credentials{}, time.Time{}, fmt.Errorf("%w: imds role: %v", ErrNoCredentials, err)
+	}
+	role := strings.TrimSpace(strings.SplitN(string(roles), "\n", 2)[0])
+	if role == "" {
+		return Credentials{}, time.Time{}, fmt.Errorf("%w: the instance has no role", ErrNoCredentials)
+	}
+
+	req, _ = http.NewRequest(http.MethodGet, path+role, nil)
+	req.Header.Set("X-aws-ec2-metadata-token", string(token))
+	data, err := p.get(req)
+	if err != nil {
+		return Credentials{}, time.Time{}, fmt.Errorf("%w: imds credentials: %v", ErrNoCredentials, err)
+	}
+	return parseCredentials(data)
+}
+
+// Sends a request and returns the body of its response, failing unless the status is 200.
+func (p *RefreshingCredentials) get(req *http.Request) ([]byte, error) {
+	client := p.Client
+	if client == nil {
+		client = &http.Client{Timeout: DefaultCredentialsTimeout}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s %s: %d", req.Method, req.URL.Path, resp.StatusCode)
+	}
+	return data, nil
+}
+
+// Returns the credentials, and the time they expire, of a response of the ECS container endpoint or the instance metadata service.
+func parseCredentials(data []byte) (Credentials, time.Time, error) {
+	var out awsCredentials
+	if err := json.Unmarshal(data, &out); err != nil {
+		return Credentials{}, time.Time{}, err
+	}
+	if (out.Code != "" && out.Code != "Success") || out.AccessKeyID == "" || out.SecretAccessKey == "" {
+		return Credentials{}, time.Time{}, fmt.Errorf("%w: %s", ErrNoCredentials, out.Code)
+	}
+	creds := Credentials{AccessKeyID: out.AccessKeyID, SecretAccessKey: out.SecretAccessKey, SessionToken: out.Token}
+	return creds, out.Expiration, nil
+}
@@ -0,0 +1,402 @@
+package sink
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+*************************************************************
+
+	CONSTANT
+
+*************************************************************
+*/
+
+// Syslog severities, RFC 5424 section 6.2.1.
+const (
+	SeverityEmergency = iota
+	SeverityAlert
+	SeverityCritical
+	SeverityError
+	SeverityWarning
+	SeverityNotice
+	SeverityInformational
+	SeverityDebug
+)
+
+// Syslog facilities for applications, RFC 5424 section 6.2.1.
+const (
+	FacilityUser   = 1
+	FacilityDaemon = 3
+	FacilityLocal0 = 16
+	FacilityLocal1 = 17
+	FacilityLocal2 = 18
+	FacilityLocal3 = 19
+	FacilityLocal4 = 20
+	FacilityLocal5 = 21
+	FacilityLocal6 = 22
+	FacilityLocal7 = 23
+)
+
+const (
+	DefaultSyslogFacility = FacilityLocal0
+	DefaultSyslogTimeout  = 5 * time.Second
+
+	syslogVersion    = 1
+	syslogTimeFormat = "2006-01-02T15:04:05.000000Z07:00" // at most 6 digits of fraction
+	syslogNil        = "-"
+	syslogProbeWait  = time.Millisecond // a read past its deadline fails at once, without noticing a closed connection
+)
+
+/*
+*************************************************************
+
+	VARIABLE
+
+*************************************************************
+*/
+
+// Severities of the levels of the logs, as logrus marshals them.
+var syslogSeverities = map[string]int{
+	"panic":   SeverityEmergency,
+	"fatal":   SeverityCritical,
+	"error":   SeverityError,
+	"warning": SeverityWarning,
+	"warn":    SeverityWarning,
+	"info":    SeverityInformational,
+	"debug":   SeverityDebug,
+	"trace":   SeverityDebug,
+}
+
+/*
+*************************************************************
+
+	STRUCT DEFINITION
+
+*************************************************************
+*/
+
+// SyslogConfig configures a SyslogSink. Zero values stand for the defaults.
+type SyslogConfig struct {
+	Network      string        // udp, tcp, unix or unixgram, udp by default
+	Address      string        // address of the collector, e.g. 10.0.0.1:514 or /dev/log
+	Facility     int           // DefaultSyslogFacility by default, the kernel facility being reserved to the kernel
+	Hostname     string        // os.Hostname() by default
+	AppName      string        // name of the executable by default
+	EnterpriseID string        // private enterprise number the organization registered with IANA, naming the structured data elements, required
+	Timeout      time.Duration // maximum time to connect, or to write a batch
+}
+
+/*
+SyslogSink ships logs to a syslog collector as RFC 5424 messages. The level of a log gives the severity of its message,
+its resources and category are structured data elements, and the log itself is the message.
+Over tcp and unix, messages are framed by octet counting, RFC 6587, and the connection is opened again when it fails.
+Note: Delivery is at least once over tcp and unix, a batch failing midway being sent again as a whole, and at most once over udp.
+*/
+type SyslogSink struct {
+	config SyslogConfig
+	stream bool // messages are framed by octet counting
+
+	mu   sync.Mutex // serializes the writes, and guards conn
+	conn net.Conn
+}
+
+// syslogLog holds the fields of a log a message is made of.
+type syslogLog struct {
+	Level    string          `json:"level"`
+	Time     time.Time       `json:"time"`
+	Resource json.RawMessage `json:"res"`
+	Category string          `json:"cat"`
+}
+
+/*
+*************************************************************
+
+	SYSLOG SINK
+
+*************************************************************
+*/
+
+/*
+Returns a sink shipping logs to a syslog collector, connected on the first send.
+Returns ErrMissingConfig if there is no address, no valid enterprise number, or the network is not supported.
+*/
+func NewSyslogSink(config SyslogConfig) (*SyslogSink, error) {
+	if config.Address == "" {
+		return nil, fmt.Errorf("%w: address is required", ErrMissingConfig)
+	}
+	if !isEnterpriseID(config.EnterpriseID) {
+		return nil, fmt.Errorf("%w: enterprise number %q, a private enterprise number is required", ErrMissingConfig, config.EnterpriseID)
+	}
+	if config.Network == "" {
+		config.Network = "udp"
+	}
+
+	var stream bool
+	switch config.Network {
+	case "tcp", "tcp4", "tcp6", "unix":
+		stream = true
+	case "udp", "udp4", "udp6", "unixgram":
+	default:
+		return nil, fmt.Errorf("%w: unsupported network %q", ErrMissingConfig, config.Network)
+	}
+
+	if config.Facility <= 0 || config.Facility > FacilityLocal7 {
+		config.Facility = DefaultSyslogFacility
+	}
+	if config.Hostname == "" {
+		config.Hostname, _ = os.Hostname()
+	}
+	if config.AppName == "" {
+		config.AppName = filepath.Base(os.Args[0])
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = DefaultSyslogTimeout
+	}
+	return &SyslogSink{config: config, stream: stream}, nil
+}
+
+// Sends logs as syslog messages, connecting again once if the connection failed.
+func (s *SyslogSink) Send(logs [][]byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	messages := make([][]byte, len(logs))
+	for i, log := range logs {
+		messages[i] = s.format(log, now)
+	}
+
+	// the first write to a connection the collector closed would succeed, and its messages be lost
+	if s.conn != nil && s.stream && closedByPeer(s.conn) {
+		s.disconnect()
+	}
+
+	err := s.write(messages)
+	if err != nil {
+		s.disconnect()
+		err = s.write(messages)
+	}
+	if err != nil {
+		s.disconnect()
+	}
+	return err
+}
+
+// Close closes the connection to the collector, a later send connecting again.
+func (s *SyslogSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+// Writes messages, connecting first if needed.
+func (s *SyslogSink) write(messages [][]byte) error {
+	if s.conn == nil {
+		conn, err := net.DialTimeout(s.config.Network, s.config.Address, s.config.Timeout)
+		if err != nil {
+			return err
+		}
+		s.conn = conn
+	}
+	if err := s.conn.SetWriteDeadline(time.Now().Add(s.config.Timeout)); err != nil {
+		return err
+	}
+
+	if !s.stream {
+		// a datagram per message
+		for _, m := range messages {
+			if _, err := s.conn.Write(m); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var frames bytes.Buffer
+	for _, m := range messages {
+		frames.WriteString(strconv.Itoa(len(m)))
+		frames.WriteByte(' ')
+		frames.Write(m)
+	}
+	_, err := s.conn.Write(frames.Bytes())
+	return err
+}
+
+func (s *SyslogSink) disconnect() {
+	if s.conn != nil {
+		_ = s.conn.Close()
+		s.conn = nil
+	}
+}
+
+/*
+Returns the RFC 5424 message of a log, timestamped with its time field, or now if it has none.
+Logs which are not JSON are sent as notices without structured data.
+*/
+func (s *SyslogSink) format(log []byte, now time.Time) []byte {
+	severity := SeverityNotice
+	t := now
+	sd := syslogNil
+
+	var fields syslogLog
+	if json.Unmarshal(log, &fields) == nil {
+		severity = SeverityInformational
+		if sev, ok := syslogSeverities[fields.Level]; ok {
+			severity = sev
+		}
+		if !fields.Time.IsZero() {
+			t = fields.Time
+		}
+		sd = s.structuredData(parseResources(fields.Resource), fields.Category)
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "<%d>%d %s %s %s %d %s %s ",
+		s.config.Facility*8+severity,
+		syslogVersion,
+		t.Format(syslogTimeFormat),
+		headerField(s.config.Hostname, 255),
+		headerField(s.config.AppName, 48),
+		os.Getpid(),
+		syslogNil,
+		sd)
+	b.Write(log)
+	return b.Bytes()
+}
+
+// Returns the structured data of resources and a category, e.g. [res@32473 D="A" D="B"][cat@32473 name="db"].
+func (s *SyslogSink) structuredData(resources map[string][]string, category string) string {
+	var b strings.Builder
+	if len(resources) > 0 {
+		types := make([]string, 0, len(resources))
+		for t := range resources {
+			types = append(types, t)
+		}
+		sort.Strings(types)
+
+		fmt.Fprintf(&b, "[res@%s", s.config.EnterpriseID)
+		for _, t := range types {
+			for _, id := range resources[t] {
+				fmt.Fprintf(&b, ` %s="%s"`, sdName(t), sdValue(id))
+			}
+		}
+		b.WriteString("]")
+	}
+	if category != "" {
+		fmt.Fprintf(&b, `[cat@%s name="%s"]`, s.config.EnterpriseID, sdValue(category))
+	}
+
+	if b.Len() == 0 {
+		return syslogNil
+	}
+	return b.String()
+}
+
+// Tells if the peer closed a connection, reading it for a moment. A collector is not expected to send anything.
+func closedByPeer(conn net.Conn) bool {
+	if err := conn.SetReadDeadline(time.Now().Add(syslogProbeWait)); err != nil {
+		return true
+	}
+	defer conn.SetReadDeadline(time.Time{})
+
+	var p [1]byte
+	_, err := conn.Read(p[:])
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return false
+	}
+	return err != nil
+}
+
+/*
+Returns the resources of the res field of a log, either an object of resource types to ids,
+or a string such as "D:[A,B], U:1".
+*/
+func parseResources(raw json.RawMessage) map[string][]string {
+	if len(raw) == 0 {
+		return nil
+	}
+
+	var object map[string][]string
+	if json.Unmarshal(raw, &object) == nil {
+		return object
+	}
+
+	var str string
+	if json.Unmarshal(raw, &str) != nil || str == "" {
+		return nil
+	}
+	resources := make(map[string][]string)
+	for _, part := range strings.Split(str, ", ") {
+		i := strings.Index(part, ":")
+		if i < 0 {
+			continue
+		}
+		t, ids := part[:i], part[i+1:]
+		if strings.HasPrefix(ids, "[") && strings.HasSuffix(ids, "]") {
+			resources[t] = append(resources[t], strings.Split(ids[1:len(ids)-1], ",")...)
+		} else {
+			resources[t] = append(resources[t], ids)
+		}
+	}
+	return resources
+}
+
+// Returns a header field of printable characters, at most max, or the nil value if it is empty.
+func headerField(s string, max int) string {
+	b := make([]byte, 0, len(s))
+	for i := 0; i < len(s) && len(b) < max; i++ {
+		if c := s[i]; c > ' ' && c < 0x7f {
+			b = append(b, c)
+		}
+	}
+	if len(b) == 0 {
+		return syslogNil
+	}
+	return string(b)
+}
+
+// Returns a parameter name of the characters allowed, at most 32, RFC 5424 section 6.3.3.
+func sdName(s string) string {
+	b := make([]byte, 0, len(s))
+	for i := 0; i < len(s) && len(b) < 32; i++ {
+		if c := s[i]; c > ' ' && c < 0x7f && c != '=' && c != ']' && c != '"' {
+			b = append(b, c)
+		}
+	}
+	if len(b) == 0 {
+		return "X" // as resources of an unknown type
+	}
+	return string(b)
+}
+
+// Escapes a parameter value, RFC 5424 section 6.3.3.
+func sdValue(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`).Replace(s)
+}
+
+// Tells if s is a private enterprise number, which may be followed by sub-identifiers, e.g. 32473 or 32473.1, RFC 5424 section 7.2.2.
+func isEnterpriseID(s string) bool {
+	for _, part := range strings.Split(s, ".") {
+		if part == "" || strings.Trim(part, "0123456789") != "" {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,236 @@
+package sink_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	. "gitlab-smartgaia.sercomm.com/s1util/logger/sink"
+)
+
+// fakeCloudWatch stands in for CloudWatch Logs, keeping the events of every stream.
+type fakeCloudWatch struct {
+	mu       sync.Mutex
+	groups   map[string]bool
+	streams  map[string][]string // messages by group/stream
+	puts     int                 // PutLogEvents requests accepted
+	throttle int                 // number of PutLogEvents requests to throttle
+}
+
+func newFakeCloudWatch(t *testing.T) (*fakeCloudWatch, *httptest.Server) {
+	cw := &fakeCloudWatch{groups: map[string]bool{}, streams: map[string][]string{}}
+	return cw, httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cw.serve(t, w, r)
+	}))
+}
+
+func (cw *fakeCloudWatch) serve(t *testing.T, w http.ResponseWriter, r *http.Request) {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+
+	if auth := r.Header.Get("Authorization"); !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKID/") {
+		t.Errorf("expect a signed request but got %q", auth)
+	}
+
+	var in struct {
+		LogGroupName  string
+		LogStreamName string
+		LogEvents     []struct {
+			Timestamp int64
+			Message   string
+		}
+	}
+	body, _ := ioutil.ReadAll(r.Body)
+	_ = json.Unmarshal(body, &in)
+	stream := in.LogGroupName + "/" + in.LogStreamName
+
+	fail := func(errType string) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"__type":"com.amazonaws.logs#%s","message":"%s"}`, errType, errType)
+	}
+
+	switch r.Header.Get("X-Amz-Target") {
+	case "Logs_20140328.CreateLogGroup":
+		if cw.groups[in.LogGroupName] {
+			fail("ResourceAlreadyExistsException")
+			return
+		}
+		cw.groups[in.LogGroupName] = true
+	case "Logs_20140328.CreateLogStream":
+		if !cw.groups[in.LogGroupName] {
+			fail("ResourceNotFoundException")
+			return
+		}
+		cw.streams[stream] = []string{}
+	case "Logs_20140328.PutLogEvents":
+		if cw.throttle > 0 {
+			cw.throttle--
+			fail("ThrottlingException")
+			return
+		}
+		if _, ok := cw.streams[stream]; !ok {
+			fail("ResourceNotFoundException")
+			return
+		}
+
+		size := 0
+		for i, e := range in.LogEvents {
+			size += len(e.Message) + EventOverhead
+			if i > 0 && e.Timestamp < in.LogEvents[i-1].Timestamp {
+				fail("InvalidParameterException")
+				return
+			}
+		}
+		span := in.LogEvents[len(in.LogEvents)-1].Timestamp - in.LogEvents[0].Timestamp
+		if len(in.LogEvents) > MaxBatchEvents || size > MaxBatchBytes || span > int64(MaxBatchSpan/time.Millisecond) {
+			fail("InvalidParameterException")
+			return
+		}
+
+		for _, e := range in.LogEvents {
+			cw.streams[stream] = append(cw.streams[stream], e.Message)
+		}
+		cw.puts++
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	_, _ = w.Write([]byte("{}"))
+}
+
+func newCloudWatchSink(t *testing.T, endpoint string) *CloudWatchSink {
+	s, err := NewCloudWatchSink(CloudWatchConfig{
+		Region:      "eu-west-1",
+		LogGroup:    "group",
+		LogStream:   "stream",
+		Endpoint:    endpoint,
+		Credentials: Credentials{AccessKeyID: "AKID", SecretAccessKey: "SECRET"},
+	})
+	if err != nil {
+		t.Fatalf("expect no error but got %v", err)
+	}
+	return s
+}
+
+func logAt(msg string, t time.Time) []byte {
+	return []byte(fmt.Sprintf(`{"msg":%q,"time":%q}`, msg, t.Format(time.RFC3339Nano)))
+}
+
+func TestCloudWatchSink(t *testing.T) {
+	cw, server := newFakeCloudWatch(t)
+	defer server.Close()
+	s := newCloudWatchSink(t, server.URL)
+
+	// the log group and stream are created on demand, events are sent in chronological order,
+	// a log without time being timestamped when sent
+	now := time.Now()
+	err := s.Send([][]byte{[]byte("no time"), logAt("b", now.Add(-time.Second)), logAt("a", now.Add(-2*time.Second))})
+	if err != nil {
+		t.Fatalf("expect no error but got %v", err)
+	}
+
+	messages := cw.streams["group/stream"]
+	if len(messages) != 3 || !strings.Contains(messages[0], `"a"`) || !strings.Contains(messages[1], `"b"`) {
+		t.Fatalf("expect a, b and the log without time but got %q", messages)
+	}
+	if cw.puts != 1 {
+		t.Fatalf("expect 1 request but got %d", cw.puts)
+	}
+}
+
+func TestCloudWatchSink_Limits(t *testing.T) {
+	cw, server := newFakeCloudWatch(t)
+	defer server.Close()
+	s := newCloudWatchSink(t, server.URL)
+	now := time.Now()
+
+	// more events than a request takes
+	logs := make([][]byte, MaxBatchEvents+1)
+	for i := range logs {
+		logs[i] = logAt("log", now)
+	}
+	if err := s.Send(logs); err != nil || cw.puts != 2 {
+		t.Fatalf("expect 2 requests but got %d, %v", cw.puts, err)
+	}
+
+	// more bytes than a request takes, and a log larger than an event
+	big := strings.Repeat("x", 250000)
+	logs = [][]byte{logAt(big, now), logAt(big, now), logAt(big, now), logAt(big, now), logAt(big+big, now)}
+	if err := s.Send(logs); err != nil || cw.puts != 4 {
+		t.Fatalf("expect 2 more requests but got %d, %v", cw.puts, err)
+	}
+	messages := cw.streams["group/stream"]
+	if last := messages[len(messages)-1]; len(last) != MaxEventBytes-EventOverhead {
+		t.Fatalf("expect a truncated event of %d bytes but got %d", MaxEventBytes-EventOverhead, len(last))
+	}
+
+	// events over more than 24 hours
+	logs = [][]byte{logAt("old", now.Add(-25*time.Hour)), logAt("new", now)}
+	if err := s.Send(logs); err != nil || cw.puts != 6 {
+		t.Fatalf("expect 2 more requests but got %d, %v", cw.puts, err)
+	}
+}
+
+func TestCloudWatchSink_Throttling(t *testing.T) {
+	cw, server := newFakeCloudWatch(t)
+	defer server.Close()
+	s := newCloudWatchSink(t, server.URL)
+
+	// a throttled request is not retried, the shipper retries the batch
+	cw.throttle = 1
+	err := s.Send([][]byte{logAt("a", time.Now())})
+	if cwErr, ok := err.(*CloudWatchError); !ok || cwErr.Type != "ThrottlingException" {
+		t.Fatalf("expect ThrottlingException but got %v", err)
+	}
+	if err := s.Send([][]byte{logAt("a", time.Now())}); err != nil {
+		t.Fatalf("expect no error but got %v", err)
+	}
+	if len(cw.streams["group/stream"]) != 1 || cw.throttle != 0 {
+		t.Fatalf("expect 1 event after 2 requests but got %d", len(cw.streams["group/stream"]))
+	}
+}
+
+func TestNewCloudWatchSink_MissingConfig(t *testing.T) {
+	if _, err := NewCloudWatchSink(CloudWatchConfig{Region: "eu-west-1"}); err == nil {
+		t.Fatalf("expect ErrMissingConfig")
+	}
+}
+
+// The get-vanilla case of the AWS Signature Version 4 test suite.
+func TestSignRequest(t *testing.T) {
+	req, _ := http.NewRequest(http.MethodGet, "https://example.amazonaws.com/", nil)
+	creds := Credentials{AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"}
+	SignRequest(req, nil, creds, "us-east-1", "service", time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC))
+
+	expected := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, " +
+		"SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"
+	if auth := req.Header.Get("Authorization"); auth != expected {
+		t.Fatalf("expect %s but got %s", expected, auth)
+	}
+}
+
+func TestCloudWatchSink_TruncateUTF8(t *testing.T) {
+	cw, server := newFakeCloudWatch(t)
+	defer server.Close()
+	s := newCloudWatchSink(t, server.URL)
+
+	// a log too large for an event is not cut in the middle of a character
+	big := []byte(`{"msg":"x` + strings.Repeat("é", MaxEventBytes) + `"}`)
+	if err := s.Send([][]byte{big}); err != nil {
+		t.Fatalf("expect no error but got %v", err)
+	}
+	message := cw.streams["group/stream"][0]
+	if !utf8.ValidString(message) || strings.ContainsRune(message, utf8.RuneError) {
+		t.Fatalf("expect valid UTF-8 but got %q", message[len(message)-8:])
+	}
+	if len(message) > MaxEventBytes-EventOverhead || len(message) < MaxEventBytes-EventOverhead-1 {
+		t.Fatalf("expect an event of at most %d bytes but got %d", MaxEventBytes-EventOverhead, len(message))
+	}
+}
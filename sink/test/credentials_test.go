@@ -0,0 +1,170 @@
+package sink_test
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	. "gitlab-smartgaia.sercomm.com/s1util/logger/sink"
+)
+
+// unsetenv unsets environment variables until the returned function restores them.
+func unsetenv(names ...string) func() {
+	values := map[string]string{}
+	for _, name := range names {
+		if value, ok := os.LookupEnv(name); ok {
+			values[name] = value
+		}
+		os.Unsetenv(name)
+	}
+	return func() {
+		for _, name := range names {
+			os.Unsetenv(name)
+			if value, ok := values[name]; ok {
+				os.Setenv(name, value)
+			}
+		}
+	}
+}
+
+// fakeMetadata stands in for the ECS container endpoint and the instance metadata service.
+type fakeMetadata struct {
+	mu         sync.Mutex
+	requests   int // credentials requests
+	expiration time.Time
+}
+
+func (m *fakeMetadata) serve(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		credentials := func() {
+			m.requests++
+			fmt.Fprintf(w, `{"Code":"Success","AccessKeyId":"AKID","SecretAccessKey":"SECRET","Token":"TOKEN%d","Expiration":%q}`,
+				m.requests, m.expiration.Format(time.RFC3339))
+		}
+
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/v2/credentials/task":
+			credentials()
+		case r.Method == http.MethodPut && r.URL.Path == "/latest/api/token":
+			if r.Header.Get("X-aws-ec2-metadata-token-ttl-seconds") == "" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			_, _ = w.Write([]byte("IMDSTOKEN"))
+		case r.Header.Get("X-aws-ec2-metadata-token") != "IMDSTOKEN":
+			w.WriteHeader(http.StatusUnauthorized)
+		case r.URL.Path == "/latest/meta-data/iam/security-credentials/":
+			_, _ = w.Write([]byte("role\n"))
+		case r.URL.Path == "/latest/meta-data/iam/security-credentials/role":
+			credentials()
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+func TestRefreshingCredentials_Env(t *testing.T) {
+	defer unsetenv("AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_SESSION_TOKEN", "AWS_CONTAINER_CREDENTIALS_RELATIVE_URI")()
+	os.Setenv("AWS_ACCESS_KEY_ID", "AKID")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "SECRET")
+
+	// the environment variables come first, no endpoint being reachable
+	p := &RefreshingCredentials{ECSEndpoint: "http://127.0.0.1:0", IMDSEndpoint: "http://127.0.0.1:0"}
+	creds, err := p.Retrieve()
+	if err != nil || creds.AccessKeyID != "AKID" || creds.SecretAccessKey != "SECRET" {
+		t.Fatalf("expect the credentials of the environment but got %+v, %v", creds, err)
+	}
+}
+
+func TestRefreshingCredentials_ECS(t *testing.T) {
+	defer unsetenv("AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_SESSION_TOKEN", "AWS_CONTAINER_CREDENTIALS_RELATIVE_URI")()
+	os.Setenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI", "/v2/credentials/task")
+
+	m := &fakeMetadata{expiration: time.Now().Add(time.Hour)}
+	server := m.serve(t)
+	defer server.Close()
+	p := &RefreshingCredentials{ECSEndpoint: server.URL, IMDSEndpoint: "http://127.0.0.1:0"}
+
+	// credentials are cached until they are about to expire
+	for i := 0; i < 2; i++ {
+		creds, err := p.Retrieve()
+		if err != nil || creds.SessionToken != "TOKEN1" {
+			t.Fatalf("expect TOKEN1 but got %+v, %v", creds, err)
+		}
+	}
+
+	m.mu.Lock()
+	m.expiration = time.Now().Add(CredentialsExpiryWindow / 2)
+	m.mu.Unlock()
+	p = &RefreshingCredentials{ECSEndpoint: server.URL}
+	for i := 2; i < 4; i++ {
+		creds, err := p.Retrieve()
+		if expected := fmt.Sprintf("TOKEN%d", i); err != nil || creds.SessionToken != expected {
+			t.Fatalf("expect %s but got %+v, %v", expected, creds, err)
+		}
+	}
+
+	// credentials about to expire are still used while they cannot be refreshed
+	server.Close()
+	if creds, err := p.Retrieve(); err != nil || creds.SessionToken != "TOKEN3" {
+		t.Fatalf("expect TOKEN3 but got %+v, %v", creds, err)
+	}
+}
+
+func TestRefreshingCredentials_IMDS(t *testing.T) {
+	defer unsetenv("AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_SESSION_TOKEN", "AWS_CONTAINER_CREDENTIALS_RELATIVE_URI")()
+
+	m := &fakeMetadata{expiration: time.Now().Add(time.Hour)}
+	server := m.serve(t)
+	defer server.Close()
+
+	p := &RefreshingCredentials{IMDSEndpoint: server.URL}
+	creds, err := p.Retrieve()
+	if err != nil || creds.AccessKeyID != "AKID" || creds.SessionToken != "TOKEN1" {
+		t.Fatalf("expect the credentials of the role but got %+v, %v", creds, err)
+	}
+
+	// no credentials anywhere
+	server.Close()
+	p = &RefreshingCredentials{IMDSEndpoint: server.URL}
+	if _, err := p.Retrieve(); !errors.Is(err, ErrNoCredentials) {
+		t.Fatalf("expect ErrNoCredentials but got %v", err)
+	}
+}
+
+func TestCloudWatchSink_Provider(t *testing.T) {
+	defer unsetenv("AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_SESSION_TOKEN", "AWS_CONTAINER_CREDENTIALS_RELATIVE_URI")()
+	os.Setenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI", "/v2/credentials/task")
+
+	m := &fakeMetadata{expiration: time.Now().Add(time.Hour)}
+	metadata := m.serve(t)
+	defer metadata.Close()
+	cw, server := newFakeCloudWatch(t)
+	defer server.Close()
+
+	// requests are signed with the credentials of the provider
+	s, err := NewCloudWatchSink(CloudWatchConfig{
+		Region:    "eu-west-1",
+		LogGroup:  "group",
+		LogStream: "stream",
+		Endpoint:  server.URL,
+		Provider:  &RefreshingCredentials{ECSEndpoint: metadata.URL},
+	})
+	if err != nil {
+		t.Fatalf("expect no error but got %v", err)
+	}
+	if err := s.Send([][]byte{logAt("a", time.Now())}); err != nil || len(cw.streams["group/stream"]) != 1 {
+		t.Fatalf("expect 1 event but got %d, %v", len(cw.streams["group/stream"]), err)
+	}
+	if m.requests != 1 {
+		t.Fatalf("expect 1 credentials request but got %d", m.requests)
+	}
+}
@@ -0,0 +1,166 @@
+package sink_test
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	. "gitlab-smartgaia.sercomm.com/s1util/logger/sink"
+)
+
+const (
+	errorLog = `{"file":"a.go:1","func":"f","level":"error","msg":"boom","res":"D:[A,B], U:1","cat":"db","time":"2020-09-13T12:26:40.123456789Z"}`
+	debugLog = `{"level":"debug","msg":"step","res":{"D":["C"]},"time":"2020-09-13T12:26:41Z"}`
+)
+
+func newSyslogSink(t *testing.T, network, address string) *SyslogSink {
+	s, err := NewSyslogSink(SyslogConfig{
+		Network:      network,
+		Address:      address,
+		Hostname:     "host",
+		AppName:      "app",
+		EnterpriseID: "32473", // reserved for documentation by RFC 5612
+		Timeout:      time.Second,
+	})
+	if err != nil {
+		t.Fatalf("expect no error but got %v", err)
+	}
+	return s
+}
+
+// readFrame reads a message framed by octet counting.
+func readFrame(r *bufio.Reader) (string, error) {
+	length, err := r.ReadString(' ')
+	if err != nil {
+		return "", err
+	}
+	n, err := strconv.Atoi(strings.TrimSuffix(length, " "))
+	if err != nil {
+		return "", err
+	}
+	p := make([]byte, n)
+	_, err = io.ReadFull(r, p)
+	return string(p), err
+}
+
+func TestSyslogSink_UDP(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("expect a listener but got %v", err)
+	}
+	defer pc.Close()
+
+	s := newSyslogSink(t, "udp", pc.LocalAddr().String())
+	defer s.Close()
+	if err := s.Send([][]byte{[]byte(errorLog), []byte(debugLog), []byte("not json")}); err != nil {
+		t.Fatalf("expect no error but got %v", err)
+	}
+
+	pid := strconv.Itoa(os.Getpid())
+	expected := []string{
+		// local0 error, resources and category as structured data, the fraction truncated to microseconds
+		"<131>1 2020-09-13T12:26:40.123456Z host app " + pid + ` - [res@32473 D="A" D="B" U="1"][cat@32473 name="db"] ` + errorLog,
+		"<135>1 2020-09-13T12:26:41.000000Z host app " + pid + ` - [res@32473 D="C"] ` + debugLog,
+		"<133>1 ",
+	}
+
+	buf := make([]byte, 4096)
+	_ = pc.SetReadDeadline(time.Now().Add(time.Second))
+	for i, e := range expected {
+		n, _, err := pc.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("expect message %d but got %v", i, err)
+		}
+		if m := string(buf[:n]); !strings.HasPrefix(m, e) {
+			t.Fatalf("expect %s but got %s", e, m)
+		}
+	}
+}
+
+func TestSyslogSink_TCP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("expect a listener but got %v", err)
+	}
+	defer ln.Close()
+
+	conns := make(chan net.Conn, 2)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conns <- conn
+		}
+	}()
+
+	s := newSyslogSink(t, "tcp", ln.Addr().String())
+	defer s.Close()
+	if err := s.Send([][]byte{[]byte(errorLog), []byte(debugLog)}); err != nil {
+		t.Fatalf("expect no error but got %v", err)
+	}
+
+	// messages are framed by octet counting
+	conn := <-conns
+	r := bufio.NewReader(conn)
+	for _, log := range []string{errorLog, debugLog} {
+		m, err := readFrame(r)
+		if err != nil || !strings.HasSuffix(m, "] "+log) {
+			t.Fatalf("expect a message of %s but got %q, %v", log, m, err)
+		}
+	}
+
+	// the collector closes the connection, the sink connects again
+	conn.Close()
+	time.Sleep(50 * time.Millisecond)
+	if err := s.Send([][]byte{[]byte(debugLog)}); err != nil {
+		t.Fatalf("expect no error but got %v", err)
+	}
+
+	select {
+	case conn = <-conns:
+	case <-time.After(time.Second):
+		t.Fatalf("expect a new connection")
+	}
+	defer conn.Close()
+	if m, err := readFrame(bufio.NewReader(conn)); err != nil || !strings.HasSuffix(m, debugLog) {
+		t.Fatalf("expect a message of %s but got %q, %v", debugLog, m, err)
+	}
+}
+
+func TestSyslogSink_Unavailable(t *testing.T) {
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	address := ln.Addr().String()
+	ln.Close()
+
+	s := newSyslogSink(t, "tcp", address)
+	if err := s.Send([][]byte{[]byte(errorLog)}); err == nil {
+		t.Fatalf("expect an error without collector")
+	}
+}
+
+func TestNewSyslogSink_MissingConfig(t *testing.T) {
+	if _, err := NewSyslogSink(SyslogConfig{Network: "tcp"}); err == nil {
+		t.Fatalf("expect ErrMissingConfig")
+	}
+	if _, err := NewSyslogSink(SyslogConfig{Network: "ip", Address: "127.0.0.1", EnterpriseID: "32473"}); err == nil {
+		t.Fatalf("expect ErrMissingConfig")
+	}
+
+	// the enterprise number is required, there is none to default to
+	for _, id := range []string{"", "acme", "32473.", "32473@1"} {
+		if _, err := NewSyslogSink(SyslogConfig{Address: "127.0.0.1:514", EnterpriseID: id}); !errors.Is(err, ErrMissingConfig) {
+			t.Fatalf("expect ErrMissingConfig for %q but got %v", id, err)
+		}
+	}
+	if _, err := NewSyslogSink(SyslogConfig{Address: "127.0.0.1:514", EnterpriseID: "32473.1"}); err != nil {
+		t.Fatalf("expect no error but got %v", err)
+	}
+}